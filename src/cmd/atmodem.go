@@ -42,7 +42,7 @@ func (a *ATModemCommand) Run(args []string) error {
 	// Publish the command to the serial port
 	a.eventBus.Publish(types.Event{
 		Type:    types.EventATModemCommand,
-		Payload: command,
+		Payload: types.ATCommandPayload{Command: command, Priority: types.PriorityUser},
 	})
 
 	return nil
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+	"strings"
+)
+
+// AuxCommand implements CommandInterface for /aux
+// It sends an AT command on the secondary AT port opened with --aux-port
+type AuxCommand struct {
+	eventBus    *services.EventBus
+	name        string
+	description string
+}
+
+// NewAuxCommand creates a new aux command
+func NewAuxCommand(eventBus *services.EventBus) *AuxCommand {
+	return &AuxCommand{
+		eventBus:    eventBus,
+		name:        "aux",
+		description: "Send AT command on the aux port. Usage: /aux <command>",
+	}
+}
+
+// GetName returns the name of the command
+func (a *AuxCommand) GetName() string {
+	return a.name
+}
+
+// GetDescription returns the description of the command
+func (a *AuxCommand) GetDescription() string {
+	return a.description
+}
+
+// Run executes the aux command
+func (a *AuxCommand) Run(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	a.eventBus.Publish(types.Event{
+		Type: types.EventATModemCommand,
+		Payload: types.ATCommandPayload{
+			Command:  strings.Join(args, " "),
+			Role:     types.RoleAuxAT,
+			Priority: types.PriorityUser,
+		},
+	})
+
+	return nil
+}
+
+// Ensure AuxCommand implements CommandInterface
+var _ types.CommandInterface = (*AuxCommand)(nil)
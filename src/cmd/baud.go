@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+	"fmt"
+	"strconv"
+)
+
+// BaudCommand implements CommandInterface for /baud
+// It switches the modem to a new baud rate with AT+IPR and reopens the port at that rate
+type BaudCommand struct {
+	eventBus    *services.EventBus
+	name        string
+	description string
+}
+
+// NewBaudCommand creates a new baud command
+func NewBaudCommand(eventBus *services.EventBus) *BaudCommand {
+	return &BaudCommand{
+		eventBus:    eventBus,
+		name:        "baud",
+		description: "Change the modem baud rate with AT+IPR. Usage: /baud <rate>",
+	}
+}
+
+// GetName returns the name of the command
+func (b *BaudCommand) GetName() string {
+	return b.name
+}
+
+// GetDescription returns the description of the command
+func (b *BaudCommand) GetDescription() string {
+	return b.description
+}
+
+// Run executes the baud command
+func (b *BaudCommand) Run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: /baud <rate>")
+	}
+
+	rate, err := strconv.Atoi(args[0])
+	if err != nil || rate <= 0 {
+		return fmt.Errorf("invalid baud rate %q", args[0])
+	}
+
+	b.eventBus.Publish(types.Event{
+		Type:    types.EventChangeBaudRate,
+		Payload: rate,
+	})
+
+	return nil
+}
+
+// Ensure BaudCommand implements CommandInterface
+var _ types.CommandInterface = (*BaudCommand)(nil)
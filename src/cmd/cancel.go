@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+)
+
+// CancelCommand implements CommandInterface for /cancel
+// It drops queued AT commands and aborts the one waiting for its final result code
+type CancelCommand struct {
+	eventBus    *services.EventBus
+	name        string
+	description string
+}
+
+// NewCancelCommand creates a new cancel command
+func NewCancelCommand(eventBus *services.EventBus) *CancelCommand {
+	return &CancelCommand{
+		eventBus:    eventBus,
+		name:        "cancel",
+		description: "Cancel queued AT commands and the one in flight. Usage: /cancel [id]",
+	}
+}
+
+// GetName returns the name of the command
+func (c *CancelCommand) GetName() string {
+	return c.name
+}
+
+// GetDescription returns the description of the command
+func (c *CancelCommand) GetDescription() string {
+	return c.description
+}
+
+// Run executes the cancel command, without an id everything on every port is cancelled
+func (c *CancelCommand) Run(args []string) error {
+	id := ""
+	if len(args) > 0 {
+		id = args[0]
+	}
+
+	c.eventBus.Publish(types.Event{
+		Type:    types.EventCancelAT,
+		Payload: id,
+	})
+
+	return nil
+}
+
+// Ensure CancelCommand implements CommandInterface
+var _ types.CommandInterface = (*CancelCommand)(nil)
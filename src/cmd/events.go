@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+	"atcli/src/views"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EventsCommand implements CommandInterface for /events
+// It switches to the event inspector and controls its trace
+type EventsCommand struct {
+	eventBus    *services.EventBus
+	name        string
+	description string
+	eventsView  *views.EventsView
+}
+
+// NewEventsCommand creates a new events command
+func NewEventsCommand(eventBus *services.EventBus, eventsView *views.EventsView) *EventsCommand {
+	return &EventsCommand{
+		eventBus:    eventBus,
+		name:        "events",
+		description: "Trace the events on the bus. Usage: /events [pause|resume|clear|close], /events filter [terms], /events export [file]",
+		eventsView:  eventsView,
+	}
+}
+
+// GetName returns the name of the command
+func (e *EventsCommand) GetName() string {
+	return e.name
+}
+
+// GetDescription returns the description of the command
+func (e *EventsCommand) GetDescription() string {
+	return e.description
+}
+
+// Run executes the events command
+func (e *EventsCommand) Run(args []string) error {
+	if len(args) == 0 {
+		e.eventsView.Start()
+		e.eventBus.Publish(types.Event{
+			Type:    types.EventChangeLayout,
+			Payload: "events",
+		})
+		return nil
+	}
+
+	switch args[0] {
+	case "close":
+		e.eventsView.Stop()
+		e.eventBus.Publish(types.Event{
+			Type:    types.EventChangeLayout,
+			Payload: "home",
+		})
+	case "pause":
+		e.eventsView.SetPaused(true)
+	case "resume":
+		e.eventsView.SetPaused(false)
+	case "clear":
+		e.eventsView.Clear()
+	case "filter":
+		e.eventsView.SetFilter(strings.Join(args[1:], " "))
+	case "export":
+		path := fmt.Sprintf("atcli-events-%s.ndjson", time.Now().Format("20060102-150405"))
+		if len(args) > 1 {
+			path = args[1]
+		}
+		count, err := e.eventsView.Export(path)
+		if err != nil {
+			return fmt.Errorf("cannot export the events: %w", err)
+		}
+		services.LogMessage(fmt.Sprintf("[green]Exported %d events to %s[white]", count, path))
+	default:
+		return fmt.Errorf("usage: /events [pause|resume|clear|close], /events filter [terms], /events export [file]")
+	}
+
+	return nil
+}
+
+var _ types.CommandInterface = (*EventsCommand)(nil)
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// LineCommand implements CommandInterface for /dtr and /rts
+// It drives a modem control line on the main AT port
+type LineCommand struct {
+	eventBus    *services.EventBus
+	name        string
+	description string
+	canPulse    bool
+}
+
+// NewDTRCommand creates the /dtr command, a DTR pulse makes a modem set with AT&D hang up
+func NewDTRCommand(eventBus *services.EventBus) *LineCommand {
+	return &LineCommand{
+		eventBus:    eventBus,
+		name:        "dtr",
+		description: "Set the DTR line. Usage: /dtr on|off|pulse [ms]",
+		canPulse:    true,
+	}
+}
+
+// NewRTSCommand creates the /rts command
+func NewRTSCommand(eventBus *services.EventBus) *LineCommand {
+	return &LineCommand{
+		eventBus:    eventBus,
+		name:        "rts",
+		description: "Set the RTS line. Usage: /rts on|off",
+	}
+}
+
+// GetName returns the name of the command
+func (l *LineCommand) GetName() string {
+	return l.name
+}
+
+// GetDescription returns the description of the command
+func (l *LineCommand) GetDescription() string {
+	return l.description
+}
+
+// Run executes the line command
+func (l *LineCommand) Run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: /%s on|off", l.name)
+	}
+
+	request := types.ModemLineRequest{Line: l.name, Action: args[0]}
+	switch args[0] {
+	case "on", "off":
+	case "pulse":
+		if !l.canPulse {
+			return fmt.Errorf("/%s can only be set on or off", l.name)
+		}
+		if len(args) > 1 {
+			ms, err := strconv.Atoi(args[1])
+			if err != nil || ms <= 0 {
+				return fmt.Errorf("invalid pulse length %q, expected milliseconds", args[1])
+			}
+			request.Pulse = time.Duration(ms) * time.Millisecond
+		}
+	default:
+		return fmt.Errorf("unknown %s action %q", l.name, args[0])
+	}
+
+	l.eventBus.Publish(types.Event{
+		Type:    types.EventSetModemLine,
+		Payload: request,
+	})
+
+	return nil
+}
+
+// Ensure LineCommand implements CommandInterface
+var _ types.CommandInterface = (*LineCommand)(nil)
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+	"fmt"
+)
+
+// RunCommand implements CommandInterface for /run
+// It loads a flow script from disk and runs it on the main AT port
+type RunCommand struct {
+	eventBus    *services.EventBus
+	name        string
+	description string
+}
+
+// NewRunCommand creates a new run command
+func NewRunCommand(eventBus *services.EventBus) *RunCommand {
+	return &RunCommand{
+		eventBus:    eventBus,
+		name:        "run",
+		description: "Run a flow script. Usage: /run <file.yaml> [key=value ...]",
+	}
+}
+
+// GetName returns the name of the command
+func (r *RunCommand) GetName() string {
+	return r.name
+}
+
+// GetDescription returns the description of the command
+func (r *RunCommand) GetDescription() string {
+	return r.description
+}
+
+// Run executes the run command, the progress and the result show up in the reply view
+func (r *RunCommand) Run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: /run <file.yaml> [key=value ...]")
+	}
+
+	vars, err := services.ParseFlowVars(args[1:])
+	if err != nil {
+		return err
+	}
+
+	flow, err := services.LoadFlowScript(args[0], vars)
+	if err != nil {
+		return err
+	}
+
+	r.eventBus.Publish(types.Event{
+		Type:    types.EventATModemFlow,
+		Payload: flow,
+	})
+
+	return nil
+}
+
+// Ensure RunCommand implements CommandInterface
+var _ types.CommandInterface = (*RunCommand)(nil)
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"atcli/src/services"
+)
+
+// cmuxATChannel is the DLCI atcli keeps for AT commands when --cmux is on
+const cmuxATChannel = 1
+
+// startCMUX implements --cmux and --cmux-pty. It puts the modem on portName into multiplexer mode
+// and exposes the channels listed in ptys ("2:/tmp/ppp,3") as ptys for other programs.
+// The AT port then lives at cmux://1 and the other channels can be opened as cmux://<dlci>.
+func startCMUX(portName string, config services.LineConfig, ptys string) (*services.CMUX, []*services.CMUXBridge, error) {
+	type bridgeSpec struct {
+		dlci byte
+		link string
+	}
+
+	specs := []bridgeSpec{}
+	for _, spec := range strings.Split(ptys, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		channel, link, _ := strings.Cut(spec, ":")
+		dlci, err := strconv.Atoi(channel)
+		if err != nil || dlci <= 0 || dlci > 63 {
+			return nil, nil, fmt.Errorf("invalid --cmux-pty entry %q, expected DLCI[:link] e.g. 2:/tmp/ppp", spec)
+		}
+		if dlci == cmuxATChannel {
+			return nil, nil, fmt.Errorf("CMUX channel %d is used for AT commands, pick another for --cmux-pty", cmuxATChannel)
+		}
+		specs = append(specs, bridgeSpec{dlci: byte(dlci), link: link})
+	}
+
+	mux, err := services.OpenCMUX(portName, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not start CMUX on %s: %w", portName, err)
+	}
+	services.SetActiveCMUX(mux)
+
+	bridges := []*services.CMUXBridge{}
+	for _, spec := range specs {
+		bridge, err := services.BridgeCMUXChannel(mux, spec.dlci, spec.link)
+		if err != nil {
+			for _, bridge := range bridges {
+				bridge.Close()
+			}
+			mux.Close()
+			return nil, nil, err
+		}
+		services.LogMessage(fmt.Sprintf("[green]CMUX channel %d is on %s[white]", spec.dlci, bridge.Path()))
+		bridges = append(bridges, bridge)
+	}
+
+	return mux, bridges, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"syscall"
+
+	"atcli/src/services"
+	"atcli/src/types"
+)
+
+// colorTag matches the tview color tags of log messages, which mean nothing on stderr
+var colorTag = regexp.MustCompile(`\[[a-z]*\]`)
+
+// defaultSocketPath is where atcli daemon listens unless --socket says otherwise
+func defaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "atcli.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("atcli-%d.sock", os.Getuid()))
+}
+
+// runDaemon implements `atcli daemon`. It owns the ports and their command queue and serves them to
+// `atcli attach` and scripts on a Unix socket until it gets SIGINT or SIGTERM.
+func runDaemon(opts portOptions, socketPath string, serverOpts serverOptions) int {
+	// Only one daemon per socket, a socket file nobody answers on is left over from one that crashed
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		fmt.Fprintf(os.Stderr, "A daemon is already listening on %s\n", socketPath)
+		return exitFailed
+	}
+	os.Remove(socketPath)
+
+	eventBus := services.NewEventBus()
+	defer closeEventBus(eventBus)
+	services.InitLogService(eventBus)
+	eventBus.Subscribe(types.EventLogMessage, func(event types.Event) {
+		if message, ok := event.Payload.(string); ok {
+			fmt.Fprintln(os.Stderr, colorTag.ReplaceAllString(message, ""))
+		}
+	})
+
+	servers := serverOpts.watch(eventBus)
+	defer servers.Close()
+
+	opened, err := openPorts(eventBus, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	defer opened.Close()
+
+	// The socket gives full control of the modem, keep it to our user
+	listener, err := listenPrivate(socketPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+
+	daemon := services.NewDaemon(eventBus, opened.ports)
+
+	if err := serverOpts.start(eventBus, servers); err != nil {
+		listener.Close()
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		daemon.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving %s (%s) on %s\n", opened.PortName(), opened.LineMode(), socketPath)
+	if err := daemon.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	return exitOK
+}
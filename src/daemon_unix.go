@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskLock keeps two listeners from restoring each other's umask
+var umaskLock sync.Mutex
+
+// listenPrivate listens on a Unix socket only our user can connect to. The umask makes the socket 0600 as it
+// is created, a chmod afterwards would leave a moment in which anyone could connect.
+func listenPrivate(socketPath string) (net.Listener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", socketPath)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"atcli/src/services"
+	"atcli/src/views"
+)
+
+// probeTimeout bounds how long each probe command may take on a candidate port
+const probeTimeout = 1 * time.Second
+
+// resolveAutoPort implements --port auto, probing every port and selecting the AT port,
+// or asking the user when more than one could be it
+func resolveAutoPort(baudRate int) (string, error) {
+	fmt.Fprintf(os.Stderr, "Probing serial ports for a modem...\n")
+
+	candidates, err := services.DiscoverPorts(baudRate, probeTimeout)
+	if err != nil {
+		return "", fmt.Errorf("could not enumerate serial ports: %w", err)
+	}
+
+	for _, candidate := range candidates {
+		fmt.Fprintf(os.Stderr, "  %s\n", candidate.Describe())
+	}
+
+	selected, choices := services.SelectATPort(candidates)
+	if selected != nil {
+		fmt.Fprintf(os.Stderr, "Using %s\n", selected.Name)
+		return selected.Name, nil
+	}
+
+	if len(choices) == 0 {
+		return "", fmt.Errorf("no port answered AT, check the modem is powered and connected")
+	}
+
+	return views.PickPort(choices)
+}
+
+// resolveAutoBaud implements --baud auto, walking the common rates until the modem answers
+func resolveAutoBaud(portName string, config services.LineConfig) (int, error) {
+	config, err := config.WithPortOverrides(portName)
+	if err != nil {
+		return 0, err
+	}
+
+	fmt.Fprintf(os.Stderr, "Detecting the baud rate of %s...\n", portName)
+
+	rate, err := services.DetectBaudRate(portName, config, probeTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("could not detect the baud rate: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Modem answered at %d baud\n", rate)
+	return rate, nil
+}
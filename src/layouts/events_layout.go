@@ -0,0 +1,78 @@
+package layouts
+
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+	"atcli/src/views"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+type EventsLayout struct {
+	layout      *tview.Flex
+	leftPanel   *tview.Flex
+	commandView tview.Primitive
+	logView     tview.Primitive
+	logViewRef  *views.LogView // Reference to the actual LogView for accessing its methods
+	eventBus    *services.EventBus
+}
+
+func NewEventsLayout(viewManager *views.ViewManager, eventBus *services.EventBus) *EventsLayout {
+	// Get references to the views we'll need
+	commandView := viewManager.GetView("command").GetComponent()
+	eventsView := viewManager.GetView("events").GetComponent()
+	logViewRef := viewManager.GetView("log").(*views.LogView) // Get the actual LogView reference
+	logView := logViewRef.GetComponent()                      // Get the Primitive component
+
+	// Left panel: vertical flex for commandView and logView
+	leftPanel := tview.NewFlex().SetDirection(tview.FlexRow)
+
+	// Add both views to the left panel, but set logView's proportion to 0 initially to hide it
+	leftPanel.AddItem(commandView, 0, 1, false)
+	leftPanel.AddItem(logView, 0, 0, false) // Initially hidden with proportion 0
+
+	// Horizontal split for the two panels, the trace lines are long so it gets the most room
+	panelsFlex := tview.NewFlex().SetDirection(tview.FlexColumn)
+	panelsFlex.AddItem(leftPanel, 0, 1, false)
+	panelsFlex.AddItem(eventsView, 0, 2, false)
+	panelsFlex.SetBackgroundColor(tcell.ColorBlack)
+
+	// Events screen: input, panels, status
+	eventsScreen := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(viewManager.GetView("input").GetComponent(), 1, 0, true).
+		AddItem(panelsFlex, 0, 1, false).
+		AddItem(viewManager.GetView("statusbar").GetComponent(), 1, 0, false)
+	eventsScreen.SetBackgroundColor(tcell.ColorBlack)
+
+	return &EventsLayout{
+		layout:      eventsScreen,
+		leftPanel:   leftPanel,
+		commandView: commandView,
+		logView:     logView,
+		logViewRef:  logViewRef,
+		eventBus:    eventBus,
+	}
+}
+
+func (e *EventsLayout) GetName() string {
+	return "events"
+}
+
+func (e *EventsLayout) GetComponent() tview.Primitive {
+	return e.layout
+}
+
+// OnLayoutChange is called when the layout changes or becomes active
+func (e *EventsLayout) OnLayoutChange() {
+	// Check if the log view should be visible based on its state
+	if e.logViewRef.IsVisible() {
+		e.leftPanel.ResizeItem(e.commandView, 0, 2)
+		e.leftPanel.ResizeItem(e.logView, 0, 1)
+	} else {
+		e.leftPanel.ResizeItem(e.commandView, 0, 1)
+		e.leftPanel.ResizeItem(e.logView, 0, 0)
+	}
+}
+
+var _ types.LayoutInterface = (*EventsLayout)(nil)
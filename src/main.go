@@ -4,6 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -24,8 +27,30 @@ var (
 
 func main() {
 	version := flag.Bool("version", false, "Print version information and exit")
-	portName := flag.String("port", "/dev/serial0", "Serial port to use")
-	baudRate := flag.Int("baud", 115200, "Baud rate")
+	portName := flag.String("port", "/dev/serial0", "Port to use, auto to probe for the modem, or a device path or URL: serial:///dev/ttyUSB2, tcp://host:port, rfc2217://host:port, pty://[link], sim://[profile]")
+	baudRate := flag.String("baud", "115200", "Baud rate, or auto to detect the rate the modem is set to")
+	dataBits := flag.String("databits", "8", "Data bits: 5, 6, 7 or 8")
+	parity := flag.String("parity", "none", "Parity: none, odd, even, mark or space")
+	stopBits := flag.String("stopbits", "1", "Stop bits: 1, 1.5 or 2")
+	flowControl := flag.String("flow", "none", "Flow control: none or rtscts")
+	dtr := flag.String("dtr", "on", "Initial DTR state: on or off")
+	rts := flag.String("rts", "on", "Initial RTS state: on or off")
+	nmeaPortName := flag.String("nmea-port", "", "Optional port streaming NMEA sentences, e.g. /dev/ttyUSB1")
+	auxPortName := flag.String("aux-port", "", "Optional secondary AT port")
+	useCMUX := flag.Bool("cmux", false, "Put the modem into 27.010 CMUX mode and use channel 1 for AT, other channels can be used as cmux://<dlci>")
+	cmuxPTYs := flag.String("cmux-pty", "", "CMUX channels to expose as ptys for pppd or a GNSS reader, e.g. 2:/tmp/ppp,3:/tmp/gnss")
+	plain := flag.Bool("plain", false, "Use a line-oriented prompt instead of the full screen UI, for slow links and dumb terminals")
+	socket := flag.String("socket", defaultSocketPath(), "Unix socket of atcli daemon, used by daemon and attach")
+	httpAddr := flag.String("http", "", "Serve the HTTP and WebSocket API on this address, a bare port like 8080 listens on localhost only")
+	httpToken := flag.String("http-token", os.Getenv("ATCLI_HTTP_TOKEN"), "Token the HTTP API requires as Authorization: Bearer <token>, defaults to $ATCLI_HTTP_TOKEN")
+	metricsAddr := flag.String("metrics", "", "Serve Prometheus metrics on this address at /metrics, a bare port like 9100 listens on localhost only")
+	mqttBroker := flag.String("mqtt", "", "Publish signal, GPS, registration and connection state to this MQTT broker, e.g. tcp://localhost:1883, and run AT commands sent to <topic>/command")
+	mqttTopic := flag.String("mqtt-topic", "atcli/"+hostname(), "Prefix of the MQTT topics")
+	mqttClientID := flag.String("mqtt-client-id", fmt.Sprintf("atcli-%s-%d", hostname(), os.Getpid()), "MQTT client ID")
+	mqttUser := flag.String("mqtt-user", "", "MQTT user name")
+	mqttPassword := flag.String("mqtt-password", os.Getenv("ATCLI_MQTT_PASSWORD"), "MQTT password, defaults to $ATCLI_MQTT_PASSWORD")
+	poll := flag.Duration("poll", 0, "Ask for signal, registration and GPS position this often, e.g. 30s, for the HTTP API, metrics and MQTT")
+	output := flag.String("output", outputText, "Output of send, run and info: text, json for one JSON array at the end, or ndjson for a JSON object per line as it happens")
 	flag.Parse()
 
 	if *version {
@@ -36,11 +61,112 @@ func main() {
 		return
 	}
 
+	// Subcommands that don't start the interactive UI
+	switch flag.Arg(0) {
+	case "sim":
+		runSim(flag.Args()[1:])
+		return
+	}
+
+	lineConfig := services.DefaultLineConfig()
+	lineSettings := [][2]string{
+		{"databits", *dataBits},
+		{"parity", *parity},
+		{"stopbits", *stopBits},
+		{"flow", *flowControl},
+		{"dtr", *dtr},
+		{"rts", *rts},
+	}
+	if *baudRate != "auto" {
+		lineSettings = append(lineSettings, [2]string{"baud", *baudRate})
+	}
+	for _, setting := range lineSettings {
+		if err := lineConfig.Set(setting[0], setting[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// attach uses the ports of a running daemon, there is nothing to probe
+	attach := flag.Arg(0) == "attach"
+
+	if *portName == "auto" && !attach {
+		selected, err := resolveAutoPort(lineConfig.BaudRate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*portName = selected
+	}
+
+	if *baudRate == "auto" && !attach {
+		rate, err := resolveAutoBaud(*portName, lineConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lineConfig.BaudRate = rate
+	}
+
+	// One-shot subcommands run without the interactive UI and exit with the result
+	switch flag.Arg(0) {
+	case "send", "run", "info":
+		os.Exit(runOneShot(flag.Arg(0), flag.Args()[1:], *portName, lineConfig, *output))
+	}
+	if *output != outputText {
+		log.Fatalf("--output %s only works with send, run and info", *output)
+	}
+
+	ports := portOptions{
+		portName:   *portName,
+		lineConfig: lineConfig,
+		nmeaPort:   *nmeaPortName,
+		auxPort:    *auxPortName,
+		useCMUX:    *useCMUX,
+		cmuxPTYs:   *cmuxPTYs,
+	}
+
+	servers := serverOptions{
+		httpAddr:    *httpAddr,
+		httpToken:   *httpToken,
+		metricsAddr: *metricsAddr,
+		mqtt: services.MQTTOptions{
+			Broker:   *mqttBroker,
+			ClientID: *mqttClientID,
+			Username: *mqttUser,
+			Password: *mqttPassword,
+			Topic:    *mqttTopic,
+		},
+		poll:    *poll,
+		pollGPS: *nmeaPortName == "",
+	}
+
+	connect := func(eventBus *services.EventBus) (portSession, error) {
+		opened, err := openPorts(eventBus, ports)
+		if err != nil {
+			return nil, err
+		}
+		return opened, nil
+	}
+
+	switch flag.Arg(0) {
+	case "daemon":
+		os.Exit(runDaemon(ports, *socket, servers))
+	case "attach":
+		connect = func(eventBus *services.EventBus) (portSession, error) {
+			return services.DialDaemon(eventBus, *socket)
+		}
+	}
+	connect = servers.serve(connect)
+
+	// Plain mode replaces the layout with a prompt for slow links and dumb terminals
+	if *plain {
+		os.Exit(runPlain(connect))
+	}
+
 	app := tview.NewApplication()
 	app.EnableMouse(true)
 
 	// Initialise the event bus to send messages between components
 	eventBus := services.NewEventBus()
+	defer closeEventBus(eventBus)
 
 	// Initialize the log service with the event bus
 	services.InitLogService(eventBus)
@@ -62,16 +188,20 @@ func main() {
 
 	// Create and register the GPS view
 	gpsView := views.NewGPSView("GPS Location", app, eventBus)
+	gpsView.SetNMEAPort(*nmeaPortName != "")
 	viewManager.Register(gpsView)
 
 	// Create and register the log view
 	logView := views.NewLogView(app, eventBus)
 	viewManager.Register(logView)
 
+	// Create and register the event inspector
+	eventsView := views.NewEventsView(app, eventBus)
+	viewManager.Register(eventsView)
+
 	statusBar := views.NewStatusBar(eventBus)
 	viewManager.Register(statusBar)
 	statusBar.SetPortName(*portName)
-	statusBar.SetBaudRate(*baudRate)
 
 	// Create command manager and register commands
 	cmdManager := cmd.NewCommandManager(eventBus)
@@ -81,18 +211,42 @@ func main() {
 	cmdManager.RegisterCommand(cmd.NewSignalCommand(eventBus))
 	cmdManager.RegisterCommand(cmd.NewLogCommand(eventBus, logView))
 	cmdManager.RegisterCommand(cmd.NewGPSCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewAuxCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewBaudCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewDTRCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewRTSCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewCancelCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewRunCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewEventsCommand(eventBus, eventsView))
 
 	layoutManager.Register(layouts.NewHomeLayout(viewManager, eventBus), true)
 	layoutManager.Register(layouts.NewSignalChartLayout(viewManager, eventBus), false)
 	layoutManager.Register(layouts.NewGPSLayout(viewManager, eventBus), false)
+	layoutManager.Register(layouts.NewEventsLayout(viewManager, eventBus), false)
 	layoutManager.Register(layouts.NewHelpLayout(eventBus, cmdManager), false)
 
-	serialPort := services.NewSerialPort(eventBus, app, *portName, *baudRate)
-	defer serialPort.Close()
+	session, err := connect(eventBus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+	statusBar.SetPortName(session.PortName())
+	statusBar.SetLineMode(session.LineMode())
 
-	eventBus.Subscribe(types.EventAppRedraw, func(event types.Event) {
+	// Handle Ctrl+C gracefully
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		app.Stop()
+		session.Close()
+		os.Exit(0)
+	}()
+
+	// A redraw already waiting covers the ones asked for meanwhile
+	eventBus.SubscribeWith(types.EventAppRedraw, func(event types.Event) {
 		app.Draw()
-	})
+	}, services.SubscribeOptions{Queue: 1, Overflow: services.OverflowDropNewest})
 
 	eventBus.Subscribe(types.EventAppFocus, func(event types.Event) {
 		app.SetFocus(event.Payload.(tview.Primitive))
@@ -100,7 +254,7 @@ func main() {
 
 	eventBus.Subscribe(types.EventAppShutdown, func(event types.Event) {
 		// Clean up resources before exiting
-		serialPort.Close()
+		session.Close()
 
 		// Stop the application
 		app.Stop()
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"atcli/src/services"
+	"atcli/src/types"
+)
+
+// Exit codes of the one-shot subcommands
+const (
+	exitOK       = 0 // Every command ended with OK
+	exitFailed   = 1 // The modem answered with an error, a flow step failed or the port could not be opened
+	exitUsage    = 2 // Bad arguments, the same code the flag package uses
+	exitNoAnswer = 3 // A command got no final result code, or could not be sent
+)
+
+// infoFields are what `atcli info` asks for, modems that don't know a command just leave its field out
+var infoFields = []struct {
+	label   string
+	command string
+	capture string
+}{
+	{"Manufacturer", "AT+CGMI", `^(.+)$`},
+	{"Model", "AT+CGMM", `^(.+)$`},
+	{"Revision", "AT+CGMR", `^(?:\+CGMR: )?(.+)$`},
+	{"IMEI", "AT+CGSN", `^(\d{14,17})$`},
+	{"IMSI", "AT+CIMI", `^(\d{6,15})$`},
+	{"ICCID", "AT+CCID", `(\d{18,22}F?)`},
+	{"SIM", "AT+CPIN?", `\+CPIN: (.+)$`},
+	{"Registration", "AT+CREG?", `\+CREG: \d,(\d)`},
+	{"Operator", "AT+COPS?", `\+COPS: \d,\d,"([^"]*)"`},
+	{"Signal", "AT+CSQ", `\+CSQ: (\d+,\d+)`},
+}
+
+// runOneShot implements `atcli send`, `atcli run` and `atcli info`. They open the port, print what the modem
+// answered to stdout and return the exit code, without starting the interactive UI.
+func runOneShot(name string, args []string, portName string, config services.LineConfig, format string) int {
+	eventBus := services.NewEventBus()
+
+	out, err := newOneShotOutput(format, eventBus)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer out.close()
+
+	switch name {
+	case "send":
+		return runSend(eventBus, out, args, portName, config)
+	case "run":
+		return runScript(eventBus, out, args, portName, config)
+	default:
+		return runInfo(eventBus, out, args, portName, config)
+	}
+}
+
+// runSend implements `atcli send AT+CSQ [AT+CREG? ...]`, the commands go one after another until one fails
+func runSend(eventBus *services.EventBus, out *oneShotOutput, args []string, portName string, config services.LineConfig) int {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 0, "How long to wait for each final result code, default depends on the command")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: atcli [flags] send [--timeout 30s] <command> [command ...]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	port, err := services.NewSerialPort(eventBus, portName, config, types.RoleAT)
+	if err != nil {
+		out.fail(err)
+		return exitFailed
+	}
+	defer port.Close()
+
+	for _, command := range flags.Args() {
+		result := port.Transact(types.ATCommandPayload{Command: command, Priority: types.PriorityUser, Timeout: *timeout})
+		out.answer(result)
+		if result.Err != nil {
+			fmt.Fprintln(os.Stderr, result.Err)
+		}
+		if code := resultExitCode(result); code != exitOK {
+			return code
+		}
+	}
+	return exitOK
+}
+
+// runScript implements `atcli run script.yaml [key=value ...]`
+func runScript(eventBus *services.EventBus, out *oneShotOutput, args []string, portName string, config services.LineConfig) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: atcli [flags] run <file.yaml> [key=value ...]\n")
+		return exitUsage
+	}
+
+	vars, err := services.ParseFlowVars(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	flow, err := services.LoadFlowScript(args[0], vars)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	port, err := services.NewSerialPort(eventBus, portName, config, types.RoleAT)
+	if err != nil {
+		out.fail(err)
+		return exitFailed
+	}
+	defer port.Close()
+
+	// Show progress on stderr so stdout only carries what the modem said
+	eventBus.Subscribe(types.EventATFlowStep, func(event types.Event) {
+		progress, ok := event.Payload.(types.ATFlowProgress)
+		if !ok {
+			return
+		}
+		step := progress.Step
+		switch {
+		case step.Skipped:
+			fmt.Fprintf(os.Stderr, "[%d/%d] skipped\n", progress.Index+1, progress.Total)
+		case step.Err != nil:
+			fmt.Fprintf(os.Stderr, "[%d/%d] %s failed: %v\n", progress.Index+1, progress.Total, step.Command, step.Err)
+		default:
+			fmt.Fprintf(os.Stderr, "[%d/%d] %s ok\n", progress.Index+1, progress.Total, step.Command)
+		}
+		if !step.Skipped && step.Command != "" {
+			out.answer(step.Result)
+		}
+	})
+
+	result := services.NewATFlowRunner(port, flow).Run()
+	out.flow(result)
+	if result.OK() {
+		return exitOK
+	}
+
+	fmt.Fprintf(os.Stderr, "Flow %s failed: %v\n", flow.Name, result.Err)
+	if len(result.Steps) == 0 {
+		return exitFailed
+	}
+	last := result.Steps[len(result.Steps)-1]
+	if last.Result.Final == "" && last.Command != "" {
+		return exitNoAnswer
+	}
+	return exitFailed
+}
+
+// runInfo implements `atcli info`, a summary of the modem and SIM
+func runInfo(eventBus *services.EventBus, out *oneShotOutput, args []string, portName string, config services.LineConfig) int {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: atcli [flags] info\n")
+		return exitUsage
+	}
+
+	port, err := services.NewSerialPort(eventBus, portName, config, types.RoleAT)
+	if err != nil {
+		out.fail(err)
+		return exitFailed
+	}
+	defer port.Close()
+
+	// Only the AT check has to pass, the rest is whatever the modem supports
+	flow := types.ATFlow{Name: "info", Steps: []types.ATFlowStep{{Command: "AT", Retries: 2}}}
+	for _, field := range infoFields {
+		flow.Steps = append(flow.Steps, types.ATFlowStep{
+			Command:  field.command,
+			Optional: true,
+			Capture:  map[string]string{field.label: field.capture},
+		})
+	}
+
+	result := services.NewATFlowRunner(port, flow).Run()
+	if !result.OK() {
+		fmt.Fprintf(os.Stderr, "No answer from %s: %v\n", portName, result.Err)
+		return exitNoAnswer
+	}
+
+	out.info(portName, result.Vars)
+	return exitOK
+}
+
+// printAnswer writes what the modem answered to stdout, the way it appears in the replies panel
+func printAnswer(result types.ATResult) {
+	for _, line := range result.Lines {
+		fmt.Println(line)
+	}
+	if result.Final != "" {
+		fmt.Println(result.Final)
+	}
+}
+
+// resultExitCode maps a command's final result code to the exit code
+func resultExitCode(result types.ATResult) int {
+	switch {
+	case result.OK():
+		return exitOK
+	case result.Final == "":
+		return exitNoAnswer
+	default:
+		return exitFailed
+	}
+}
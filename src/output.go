@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"atcli/src/services"
+	"atcli/src/types"
+)
+
+// Output formats of the one-shot subcommands
+const (
+	outputText   = "text"   // What the modem said, line by line
+	outputJSON   = "json"   // One JSON array of every record, written at the end
+	outputNDJSON = "ndjson" // One JSON object per line, written as it happens
+)
+
+// oneShotOutput writes what the one-shot subcommands did to stdout. In the JSON formats every transaction
+// and URC on the event bus becomes a record, the same results the views are fed from.
+type oneShotOutput struct {
+	format  string
+	lock    sync.Mutex
+	records []any
+	encoder *json.Encoder
+}
+
+func newOneShotOutput(format string, eventBus *services.EventBus) (*oneShotOutput, error) {
+	switch format {
+	case outputText, outputJSON, outputNDJSON:
+	default:
+		return nil, fmt.Errorf("invalid output format %q, expected text, json or ndjson", format)
+	}
+
+	o := &oneShotOutput{format: format, encoder: json.NewEncoder(os.Stdout)}
+	if format == outputText {
+		return o, nil
+	}
+
+	eventBus.Subscribe(types.EventATResult, func(event types.Event) {
+		if result, ok := event.Payload.(types.ATResult); ok {
+			o.record(services.NewTransactionRecord(result))
+		}
+	})
+	services.TopicURC.Subscribe(eventBus, func(line types.SerialLine) {
+		o.record(services.NewURCRecord(line))
+	})
+
+	return o, nil
+}
+
+// record keeps a record for the JSON array, or writes it straight away as NDJSON
+func (o *oneShotOutput) record(record any) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.format == outputNDJSON {
+		o.encoder.Encode(record)
+		return
+	}
+	o.records = append(o.records, record)
+}
+
+// answer prints the lines of a result in text format, the JSON formats already have it as a transaction
+func (o *oneShotOutput) answer(result types.ATResult) {
+	if o.format == outputText {
+		printAnswer(result)
+	}
+}
+
+// flow records how a flow ended
+func (o *oneShotOutput) flow(result types.ATFlowResult) {
+	if o.format != outputText {
+		o.record(services.NewFlowRecord(result))
+	}
+}
+
+// fail reports an error that ends the subcommand on stderr, and as an error record in the JSON formats
+func (o *oneShotOutput) fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	if o.format != outputText {
+		o.record(services.NewErrorRecord(err))
+	}
+}
+
+// infoRecord is the summary of `atcli info` in the JSON formats
+type infoRecord struct {
+	Type   string            `json:"type"` // Always "info"
+	Port   string            `json:"port"`
+	Fields map[string]string `json:"fields"`
+}
+
+// info prints the fields `atcli info` found, in the order of infoFields
+func (o *oneShotOutput) info(portName string, vars map[string]string) {
+	fields := map[string]string{}
+	for _, field := range infoFields {
+		if value, ok := vars[field.label]; ok {
+			fields[field.label] = value
+		}
+	}
+
+	if o.format != outputText {
+		o.record(infoRecord{Type: "info", Port: portName, Fields: fields})
+		return
+	}
+
+	fmt.Printf("%-13s %s\n", "Port:", portName)
+	for _, field := range infoFields {
+		if value, ok := fields[field.label]; ok {
+			fmt.Printf("%-13s %s\n", field.label+":", value)
+		}
+	}
+}
+
+// close writes the JSON array
+func (o *oneShotOutput) close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.format != outputJSON {
+		return
+	}
+	if o.records == nil {
+		o.records = []any{}
+	}
+	o.encoder.SetIndent("", "  ")
+	o.encoder.Encode(o.records)
+}
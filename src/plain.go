@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"atcli/src/cmd"
+	"atcli/src/services"
+	"atcli/src/types"
+)
+
+// plainPrompt is what --plain shows while it waits for a command, plainTextPrompt while a > prompt waits for text
+const (
+	plainPrompt     = "atcli> "
+	plainTextPrompt = "> "
+)
+
+// plainConsole is where --plain reads commands from and prints to. Writes go above the line being typed.
+type plainConsole interface {
+	ReadLine() (string, error)
+	SetPrompt(prompt string)
+	io.Writer
+}
+
+// runPlain implements --plain, a prompt with history and slash commands instead of the full screen UI.
+// Commands and answers are printed with the same -> and <- markers as the replies panel.
+func runPlain(connect func(*services.EventBus) (portSession, error)) int {
+	eventBus := services.NewEventBus()
+	defer closeEventBus(eventBus)
+
+	// Only a person at a capable terminal gets line editing, dumb terminals and pipes are read line by line
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	var console plainConsole = &lineConsole{input: bufio.NewReader(os.Stdin), prompt: plainPrompt, showPrompt: interactive}
+	if interactive && term.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("TERM") != "dumb" {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err == nil {
+			defer term.Restore(int(os.Stdin.Fd()), state)
+			console = term.NewTerminal(struct {
+				io.Reader
+				io.Writer
+			}{os.Stdin, os.Stdout}, plainPrompt)
+		}
+	}
+
+	repl := newPlainREPL(eventBus, console)
+
+	cmdManager := cmd.NewCommandManager(eventBus)
+	cmdManager.RegisterCommand(newPlainHelpCommand(cmdManager, console))
+	cmdManager.RegisterCommand(cmd.NewQuitCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewATModemCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewAuxCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewBaudCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewDTRCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewRTSCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewCancelCommand(eventBus))
+	cmdManager.RegisterCommand(cmd.NewRunCommand(eventBus))
+
+	if terminal, ok := console.(*term.Terminal); ok {
+		terminal.AutoCompleteCallback = completeCommand(cmdManager)
+	}
+
+	session, err := connect(eventBus)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	defer session.Close()
+
+	// In raw mode Ctrl+C is a key, this only catches it on dumb terminals and pipes
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		repl.shutdown()
+	}()
+
+	fmt.Fprintf(console, "Connected to %s (%s), /help lists the commands, /quit exits\n", session.PortName(), session.LineMode())
+
+	repl.run()
+
+	// Piped commands are all read long before the modem answers them, wait for the answers before closing
+	if !interactive {
+		repl.waitIdle(session)
+	}
+	return exitOK
+}
+
+// plainREPL reads commands from the console and prints what happens on the event bus
+type plainREPL struct {
+	eventBus *services.EventBus
+	console  plainConsole
+
+	lock        sync.Mutex
+	prompt      *types.Prompt // The > prompt waiting for text, nil when there is none
+	promptLines []string
+	flows       int // Flows started and not finished yet
+
+	done    chan struct{}
+	closing sync.Once
+}
+
+func newPlainREPL(eventBus *services.EventBus, console plainConsole) *plainREPL {
+	r := &plainREPL{
+		eventBus: eventBus,
+		console:  console,
+		done:     make(chan struct{}),
+	}
+
+	eventBus.Subscribe(types.EventATResult, r.handleATResult)
+	services.TopicURC.Subscribe(eventBus, r.handleURC)
+	services.TopicSerialError.Subscribe(eventBus, r.handleSerialError)
+	eventBus.Subscribe(types.EventConnectionState, r.handleConnectionState)
+	eventBus.Subscribe(types.EventLogMessage, r.handleLogMessage)
+	services.TopicPrompt.Subscribe(eventBus, r.handlePrompt)
+	eventBus.Subscribe(types.EventATModemFlow, r.handleFlowStarted)
+	eventBus.Subscribe(types.EventATFlowStep, r.handleFlowStep)
+	eventBus.Subscribe(types.EventATFlowResult, r.handleFlowResult)
+	eventBus.Subscribe(types.EventAppShutdown, func(event types.Event) {
+		r.shutdown()
+	})
+
+	return r
+}
+
+// run reads lines until the input ends or /quit
+func (r *plainREPL) run() {
+	type input struct {
+		line string
+		err  error
+	}
+	lines := make(chan input)
+
+	go func() {
+		for {
+			line, err := r.console.ReadLine()
+			select {
+			case lines <- input{line, err}:
+			case <-r.done:
+				return
+			}
+			if err != nil && err != io.EOF {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case in := <-lines:
+			if in.err == nil {
+				r.handleLine(in.line)
+				continue
+			}
+			// Ctrl+D and Ctrl+C abort a > prompt first, the next one leaves
+			if in.err == io.EOF && r.abortPrompt() {
+				continue
+			}
+			return
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *plainREPL) shutdown() {
+	r.closing.Do(func() { close(r.done) })
+}
+
+// handleLine sends a command, or adds to the text of an open > prompt
+func (r *plainREPL) handleLine(line string) {
+	r.lock.Lock()
+	prompt := r.prompt
+	r.lock.Unlock()
+
+	if prompt == nil {
+		if line = strings.TrimSpace(line); line != "" {
+			r.eventBus.Publish(types.Event{Type: types.EventCommandSent, Payload: line})
+		}
+		return
+	}
+
+	switch strings.TrimSpace(line) {
+	case ".":
+		r.lock.Lock()
+		text := strings.Join(r.promptLines, "\n")
+		r.closePrompt()
+		r.lock.Unlock()
+		r.eventBus.Publish(types.Event{Type: types.EventPromptReply, Payload: types.PromptReply{Role: prompt.Role, Text: text}})
+	case "/abort":
+		r.abortPrompt()
+	default:
+		r.lock.Lock()
+		r.promptLines = append(r.promptLines, line)
+		r.lock.Unlock()
+	}
+}
+
+// abortPrompt answers an open > prompt with Esc, it returns false when there is none
+func (r *plainREPL) abortPrompt() bool {
+	r.lock.Lock()
+	prompt := r.prompt
+	r.closePrompt()
+	r.lock.Unlock()
+
+	if prompt == nil {
+		return false
+	}
+	fmt.Fprintln(r.console, "Aborted")
+	r.eventBus.Publish(types.Event{Type: types.EventPromptReply, Payload: types.PromptReply{Role: prompt.Role, Abort: true}})
+	return true
+}
+
+// closePrompt goes back to reading commands, the caller holds the lock
+func (r *plainREPL) closePrompt() {
+	r.prompt = nil
+	r.promptLines = nil
+	r.console.SetPrompt(plainPrompt)
+}
+
+func (r *plainREPL) handlePrompt(prompt types.Prompt) {
+	r.lock.Lock()
+	r.prompt = &prompt
+	r.promptLines = nil
+	r.console.SetPrompt(plainTextPrompt)
+	r.lock.Unlock()
+
+	fmt.Fprintf(r.console, "<- %s>\nType the text, a line with only . sends it, /abort or Ctrl+D cancels\n", roleTag(prompt.Role))
+}
+
+func (r *plainREPL) handleATResult(event types.Event) {
+	result, ok := event.Payload.(types.ATResult)
+	if !ok {
+		return
+	}
+
+	// The answer to the command that opened a > prompt ends it, whoever typed the text
+	r.lock.Lock()
+	if r.prompt != nil && r.prompt.ID == result.ID {
+		r.closePrompt()
+	}
+	r.lock.Unlock()
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "-> %s%s\n", roleTag(result.Role), result.Command)
+	for _, line := range result.Lines {
+		fmt.Fprintf(&out, "<- %s%s\n", roleTag(result.Role), line)
+	}
+	if result.Final != "" {
+		fmt.Fprintf(&out, "<- %s%s\n", roleTag(result.Role), result.Final)
+	}
+	// Port errors are already printed by handleSerialError
+	if result.Err != nil && !services.IsPortError(result.Err) {
+		fmt.Fprintf(&out, "error: %v\n", result.Err)
+	}
+	io.WriteString(r.console, out.String())
+}
+
+func (r *plainREPL) handleURC(line types.SerialLine) {
+	if line.Role == types.RoleNMEA || line.Text == "" {
+		return
+	}
+	fmt.Fprintf(r.console, "<- %s%s\n", roleTag(line.Role), line.Text)
+}
+
+func (r *plainREPL) handleSerialError(err error) {
+	fmt.Fprintf(r.console, "error: %v\n", err)
+}
+
+func (r *plainREPL) handleConnectionState(event types.Event) {
+	status, ok := event.Payload.(types.ConnectionStatus)
+	if !ok || status.State == types.ConnectionConnected {
+		return
+	}
+
+	switch status.State {
+	case types.ConnectionLost:
+		fmt.Fprintf(r.console, "%s lost: %v\n", status.Port, status.Err)
+	case types.ConnectionReconnecting:
+		fmt.Fprintf(r.console, "%s reconnecting (attempt %d)\n", status.Port, status.Attempt)
+	default:
+		fmt.Fprintf(r.console, "%s %s\n", status.Port, status.State)
+	}
+}
+
+// handleLogMessage prints what the command manager reports, e.g. unknown commands
+func (r *plainREPL) handleLogMessage(event types.Event) {
+	if message, ok := event.Payload.(string); ok {
+		fmt.Fprintln(r.console, message)
+	}
+}
+
+func (r *plainREPL) handleFlowStarted(event types.Event) {
+	r.lock.Lock()
+	r.flows++
+	r.lock.Unlock()
+}
+
+func (r *plainREPL) handleFlowStep(event types.Event) {
+	progress, ok := event.Payload.(types.ATFlowProgress)
+	if !ok {
+		return
+	}
+
+	step := progress.Step
+	label := fmt.Sprintf("[%s %d/%d]", flowLabel(progress.Name, progress.ID), progress.Index+1, progress.Total)
+	switch {
+	case step.Skipped:
+		fmt.Fprintf(r.console, "%s skipped\n", label)
+	case step.Err != nil:
+		fmt.Fprintf(r.console, "%s %s failed: %v\n", label, step.Command, step.Err)
+	default:
+		fmt.Fprintf(r.console, "%s %s ok\n", label, step.Command)
+	}
+}
+
+func (r *plainREPL) handleFlowResult(event types.Event) {
+	result, ok := event.Payload.(types.ATFlowResult)
+	if !ok {
+		return
+	}
+
+	r.lock.Lock()
+	if r.flows > 0 {
+		r.flows--
+	}
+	r.lock.Unlock()
+
+	name := flowLabel(result.Name, result.ID)
+	if result.Err != nil {
+		fmt.Fprintf(r.console, "Flow %s failed: %v\n", name, result.Err)
+		return
+	}
+	fmt.Fprintf(r.console, "Flow %s finished in %s\n", name, result.Duration.Round(time.Millisecond))
+}
+
+// waitIdle waits until no flow is running and no command is queued or in flight
+func (r *plainREPL) waitIdle(session portSession) {
+	for {
+		r.lock.Lock()
+		flows := r.flows
+		r.lock.Unlock()
+		if flows == 0 && session.Idle() {
+			return
+		}
+
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// roleTag tags traffic from ports other than the main AT port, the way the replies panel does
+func roleTag(role types.PortRole) string {
+	if role == "" || role == types.RoleAT {
+		return ""
+	}
+	return "(" + string(role) + ") "
+}
+
+func flowLabel(name string, id string) string {
+	if name != "" {
+		return name
+	}
+	return id
+}
+
+// completeCommand completes slash command names with Tab
+func completeCommand(cmdManager *cmd.CommandManager) func(string, int, rune) (string, int, bool) {
+	return func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' || !strings.HasPrefix(line, "/") || strings.Contains(line[:pos], " ") {
+			return "", 0, false
+		}
+
+		prefix := line[1:pos]
+		match := ""
+		for _, command := range cmdManager.ListCommands() {
+			if !strings.HasPrefix(command.Name, prefix) {
+				continue
+			}
+			if match != "" {
+				return "", 0, false // Not unique
+			}
+			match = command.Name
+		}
+		if match == "" {
+			return "", 0, false
+		}
+
+		completed := "/" + match + " "
+		return completed + strings.TrimLeft(line[pos:], " "), len(completed), true
+	}
+}
+
+// lineConsole is the plainConsole for dumb terminals and pipes, the terminal does its own line editing
+type lineConsole struct {
+	lock       sync.Mutex
+	input      *bufio.Reader
+	prompt     string
+	showPrompt bool // Prompts are for people, not for pipes
+	reading    bool
+}
+
+func (c *lineConsole) ReadLine() (string, error) {
+	c.lock.Lock()
+	if c.showPrompt {
+		io.WriteString(os.Stdout, c.prompt)
+	}
+	c.reading = true
+	c.lock.Unlock()
+
+	line, err := c.input.ReadString('\n')
+
+	c.lock.Lock()
+	c.reading = false
+	c.lock.Unlock()
+
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *lineConsole) SetPrompt(prompt string) {
+	c.lock.Lock()
+	c.prompt = prompt
+	c.lock.Unlock()
+}
+
+// Write prints on a line of its own and shows the prompt again.
+// Whatever was typed so far stays in the terminal's buffer, it is only gone from the screen.
+func (c *lineConsole) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	prompting := c.reading && c.showPrompt
+	if prompting {
+		io.WriteString(os.Stdout, "\n")
+	}
+	n, err := os.Stdout.Write(p)
+	if prompting {
+		io.WriteString(os.Stdout, c.prompt)
+	}
+	return n, err
+}
+
+// plainHelpCommand lists the commands in --plain, where there is no help layout to switch to
+type plainHelpCommand struct {
+	name        string
+	description string
+	cmdManager  *cmd.CommandManager
+	out         io.Writer
+}
+
+func newPlainHelpCommand(cmdManager *cmd.CommandManager, out io.Writer) *plainHelpCommand {
+	return &plainHelpCommand{
+		name:        "help",
+		description: "List the commands",
+		cmdManager:  cmdManager,
+		out:         out,
+	}
+}
+
+func (h *plainHelpCommand) GetName() string {
+	return h.name
+}
+
+func (h *plainHelpCommand) GetDescription() string {
+	return h.description
+}
+
+func (h *plainHelpCommand) Run(args []string) error {
+	commands := h.cmdManager.ListCommands()
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+
+	var out strings.Builder
+	out.WriteString("Anything not starting with / is sent to the modem as an AT command\n")
+	for _, command := range commands {
+		fmt.Fprintf(&out, "  /%-8s %s\n", command.Name, command.Description)
+	}
+	_, err := io.WriteString(h.out, out.String())
+	return err
+}
+
+// Ensure plainHelpCommand implements CommandInterface
+var _ types.CommandInterface = (*plainHelpCommand)(nil)
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"atcli/src/services"
+	"atcli/src/types"
+)
+
+// portOptions are the command line settings of the ports atcli opens for the UI and --plain
+type portOptions struct {
+	portName   string
+	lineConfig services.LineConfig
+	nmeaPort   string
+	auxPort    string
+	useCMUX    bool
+	cmuxPTYs   string
+}
+
+// portSession is what the UI and --plain work with, the ports themselves or a daemon holding them
+type portSession interface {
+	PortName() string // Of the main AT port
+	LineMode() string
+	Idle() bool // Nothing of ours is queued or in flight
+	Close()
+}
+
+// openedPorts are the ports of a session, ports[0] is the main AT port
+type openedPorts struct {
+	ports   []*services.SerialPort
+	mux     *services.CMUX
+	bridges []*services.CMUXBridge
+	closing sync.Once
+}
+
+// openPorts opens the AT port and the optional NMEA and aux ports on the event bus.
+// With CMUX the real port carries frames and every port opens a channel on it.
+func openPorts(eventBus *services.EventBus, opts portOptions) (*openedPorts, error) {
+	opened := &openedPorts{}
+
+	portName, lineConfig := opts.portName, opts.lineConfig
+	if opts.useCMUX {
+		var err error
+		opened.mux, opened.bridges, err = startCMUX(portName, lineConfig, opts.cmuxPTYs)
+		if err != nil {
+			return nil, err
+		}
+		portName = fmt.Sprintf("cmux://%d", cmuxATChannel)
+		lineConfig = opened.mux.LineConfig()
+	}
+
+	if err := opened.open(eventBus, portName, lineConfig, types.RoleAT); err != nil {
+		return nil, err
+	}
+
+	// Extra ports share the event bus, their traffic is tagged with the role so views can pick what they need
+	if opts.nmeaPort != "" {
+		if err := opened.open(eventBus, opts.nmeaPort, lineConfig, types.RoleNMEA); err != nil {
+			return nil, err
+		}
+	}
+	if opts.auxPort != "" {
+		if err := opened.open(eventBus, opts.auxPort, lineConfig, types.RoleAuxAT); err != nil {
+			return nil, err
+		}
+	}
+
+	return opened, nil
+}
+
+// open adds a port to the session, on failure it closes what the session already opened
+func (o *openedPorts) open(eventBus *services.EventBus, portName string, lineConfig services.LineConfig, role types.PortRole) error {
+	port, err := services.NewSerialPort(eventBus, portName, lineConfig, role)
+	if err != nil {
+		o.Close()
+		return err
+	}
+	o.ports = append(o.ports, port)
+	return nil
+}
+
+// at returns the main AT port
+func (o *openedPorts) at() *services.SerialPort {
+	return o.ports[0]
+}
+
+func (o *openedPorts) PortName() string {
+	return o.at().PortName()
+}
+
+func (o *openedPorts) LineMode() string {
+	return o.at().LineConfig().String()
+}
+
+// Idle reports whether no port has a command queued or in flight
+func (o *openedPorts) Idle() bool {
+	for _, port := range o.ports {
+		if !port.Idle() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes the ports, then the multiplexer under them. It is safe to call more than once.
+func (o *openedPorts) Close() {
+	o.closing.Do(func() {
+		for _, port := range o.ports {
+			port.Close()
+		}
+		for _, bridge := range o.bridges {
+			bridge.Close()
+		}
+		if o.mux != nil {
+			o.mux.Close()
+		}
+	})
+}
+
+var _ portSession = (*openedPorts)(nil)
+var _ portSession = (*services.DaemonClient)(nil)
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"atcli/src/services"
+)
+
+// eventBusShutdown is how long the queued subscribers get to handle what they have waiting on the way out
+const eventBusShutdown = 2 * time.Second
+
+// serverOptions are the modem monitor and the optional servers that share the ports with the UI, the plain
+// prompt or the daemon
+type serverOptions struct {
+	httpAddr    string // Where the HTTP API listens, empty for none
+	httpToken   string
+	metricsAddr string               // Where /metrics listens, empty for none
+	mqtt        services.MQTTOptions // No broker for none
+	poll        time.Duration        // How often the monitor asks for signal, registration and GPS, 0 to only listen
+	pollGPS     bool                 // False when a NMEA port streams the position
+}
+
+// runningServers are the monitor and servers started for a session
+type runningServers struct {
+	monitor     *services.ModemMonitor
+	metrics     *services.Metrics
+	metricsHTTP *http.Server
+	http        *http.Server
+	api         *services.HTTPAPI
+	mqtt        *services.MQTTPublisher
+}
+
+// servedSession closes the servers along with the ports they drive
+type servedSession struct {
+	portSession
+	servers *runningServers
+}
+
+var _ portSession = (*servedSession)(nil)
+
+// httpAddress binds a bare port or :port to localhost, anything else needs to be asked for
+func httpAddress(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return "127.0.0.1:" + addr
+	}
+	if strings.HasPrefix(addr, ":") {
+		return "127.0.0.1" + addr
+	}
+	return addr
+}
+
+// hostname names this machine in the default MQTT topic and client ID
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "localhost"
+	}
+	return name
+}
+
+// watch starts the monitor, and the metrics if asked for. It comes before the ports are opened, so they see
+// the ports' first state.
+func (o serverOptions) watch(eventBus *services.EventBus) *runningServers {
+	servers := &runningServers{monitor: services.NewModemMonitor(eventBus)}
+	if o.metricsAddr != "" {
+		servers.metrics = services.NewMetrics(eventBus)
+	}
+	return servers
+}
+
+// start starts polling and the servers asked for, once the ports are open
+func (o serverOptions) start(eventBus *services.EventBus, servers *runningServers) error {
+	servers.monitor.Poll(o.poll, o.pollGPS)
+
+	if o.httpAddr != "" {
+		api := services.NewHTTPAPI(eventBus, o.httpToken)
+		server, err := listenHTTP(o.httpAddr, api, "HTTP API", "/api", o.httpToken != "")
+		if err != nil {
+			return err
+		}
+		servers.api, servers.http = api, server
+	}
+
+	if servers.metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", servers.metrics)
+		server, err := listenHTTP(o.metricsAddr, mux, "Metrics", "/metrics", true)
+		if err != nil {
+			return err
+		}
+		servers.metricsHTTP = server
+	}
+
+	if o.mqtt.Broker != "" {
+		publisher, err := services.NewMQTTPublisher(eventBus, o.mqtt)
+		if err != nil {
+			return err
+		}
+		servers.mqtt = publisher
+	}
+
+	return nil
+}
+
+// listenHTTP serves handler on addr until the server is closed. Anything but localhost is reported,
+// along with what anyone there can then do when guarded is false.
+func listenHTTP(addr string, handler http.Handler, name string, path string, guarded bool) (*http.Server, error) {
+	listener, err := net.Listen("tcp", httpAddress(addr))
+	if err != nil {
+		return nil, fmt.Errorf("cannot start the %s: %w", name, err)
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			services.LogMessage(fmt.Sprintf("[red]%s stopped: %v[white]", name, err))
+		}
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	services.LogMessage(fmt.Sprintf("%s on http://%s%s", name, address, path))
+	if !address.IP.IsLoopback() && !guarded {
+		services.LogMessage(fmt.Sprintf("[yellow]The %s is reachable from other machines without a token, anyone there can use the modem[white]", name))
+	}
+	return server, nil
+}
+
+// serve makes connect start the servers on the session it opens
+func (o serverOptions) serve(connect func(*services.EventBus) (portSession, error)) func(*services.EventBus) (portSession, error) {
+	return func(eventBus *services.EventBus) (portSession, error) {
+		servers := o.watch(eventBus)
+		session, err := connect(eventBus)
+		if err != nil {
+			servers.Close()
+			return nil, err
+		}
+		if err := o.start(eventBus, servers); err != nil {
+			servers.Close()
+			session.Close()
+			return nil, err
+		}
+		return &servedSession{portSession: session, servers: servers}, nil
+	}
+}
+
+// Close stops the monitor and the servers
+func (s *runningServers) Close() {
+	s.monitor.Close()
+	if s.mqtt != nil {
+		s.mqtt.Close()
+	}
+	if s.http != nil {
+		s.http.Close()
+	}
+	if s.api != nil {
+		s.api.Close()
+	}
+	if s.metricsHTTP != nil {
+		s.metricsHTTP.Close()
+	}
+}
+
+// Close stops the servers, then closes the ports
+func (s *servedSession) Close() {
+	s.servers.Close()
+	s.portSession.Close()
+}
+
+// closeEventBus lets the queued subscribers, e.g. the monitor, finish what they have waiting
+func closeEventBus(eventBus *services.EventBus) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventBusShutdown)
+	defer cancel()
+	eventBus.Close(ctx)
+}
@@ -3,92 +3,414 @@ package services
 import (
 	"atcli/src/types"
 	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-// ATFlowRunner runs a sequence of ATFlowSteps, sending commands and waiting for expected responses.
+// maxFlowSteps stops a flow whose branches keep going round in circles
+const maxFlowSteps = 1000
+
+// defaultFailOn are the failure patterns of a step that doesn't list its own
+var defaultFailOn = []string{`^ERROR$`, `^\+CME ERROR:`, `^\+CMS ERROR:`}
+
+var flowVariable = regexp.MustCompile(`\$\{(\w+)\}`)
+
+var flowCounter atomic.Uint64
+
+// ATFlowRunner runs the steps of a flow on a port, sending commands through its queue at flow priority
 type ATFlowRunner struct {
-	eventBus        *EventBus
-	steps           []types.ATFlowStep
-	responseTimeout time.Duration
-	logf            func(string)
+	port *SerialPort
+	flow types.ATFlow
+	vars map[string]string
+	urcs chan string
 }
 
-// NewATFlowRunner creates a new ATFlowRunner.
-func NewATFlowRunner(eventBus *EventBus, steps []types.ATFlowStep, timeout time.Duration, logf func(string)) *ATFlowRunner {
+// NewATFlowRunner creates a new ATFlowRunner, the flow's Vars are copied so captures don't leak back to the caller
+func NewATFlowRunner(port *SerialPort, flow types.ATFlow) *ATFlowRunner {
+	if flow.ID == "" {
+		flow.ID = fmt.Sprintf("flow-%d", flowCounter.Add(1))
+	}
+
+	vars := make(map[string]string, len(flow.Vars))
+	for name, value := range flow.Vars {
+		vars[name] = value
+	}
+
 	return &ATFlowRunner{
-		eventBus:        eventBus,
-		steps:           steps,
-		responseTimeout: timeout,
-		logf:            logf,
+		port: port,
+		flow: flow,
+		vars: vars,
+		urcs: make(chan string, 64),
 	}
 }
 
-// Run executes the AT command flow. Returns true if all steps succeed, false otherwise.
-func (r *ATFlowRunner) Run() bool {
-	responsesCh := make(chan string, 10)
-	stopCh := make(chan struct{})
+// Run executes the flow and returns what happened to every step
+func (r *ATFlowRunner) Run() types.ATFlowResult {
+	started := time.Now()
+	result := types.ATFlowResult{ID: r.flow.ID, Name: r.flow.Name}
+
+	// Some expected responses are URCs that follow the final result code, e.g. +CGNSSPWR: READY!
+	subscription := TopicURC.Subscribe(r.port.eventBus, r.handleURC)
+	defer subscription.Unsubscribe()
+
+	steps := r.flow.Steps
+	for next, ran := 0, 0; next < len(steps); ran++ {
+		if ran == maxFlowSteps {
+			result.Err = fmt.Errorf("flow %s stopped after %d steps, check its branches for a loop", r.name(), ran)
+			break
+		}
+
+		step := steps[next]
+		stepResult := r.runStep(step)
+		result.Steps = append(result.Steps, stepResult)
+		r.port.eventBus.Publish(types.Event{
+			Type:    types.EventATFlowStep,
+			Payload: types.ATFlowProgress{ID: r.flow.ID, Name: r.flow.Name, Index: next, Total: len(steps), Step: stepResult},
+		})
+
+		target := step.OnSuccess
+		if stepResult.Err != nil {
+			LogMessage(fmt.Sprintf("[yellow][flow %s] %s failed: %v[white]", r.name(), stepName(step, next), stepResult.Err))
+			target = step.OnFailure
+			if target == "" && !step.Optional {
+				result.Err = fmt.Errorf("%s: %w", stepName(step, next), stepResult.Err)
+				break
+			}
+		}
+
+		if target == "" {
+			next++
+			continue
+		}
+		if target == "end" {
+			break
+		}
 
-	// Subscribe to serial responses
-	handler := func(event types.Event) {
-		if resp, ok := event.Payload.(string); ok {
-			responsesCh <- resp
+		index, err := findStep(steps, target)
+		if err != nil {
+			result.Err = err
+			break
 		}
+		next = index
 	}
-	r.eventBus.Subscribe(types.EventSerialResponse, handler)
 
-	succeeded := true
+	result.Vars = r.vars
+	result.Duration = time.Since(started)
+	return result
+}
 
-	for i, step := range r.steps {
-		r.logf(fmt.Sprintf("[ATFlow] Step %d: Sending '%s'", i+1, step.Command))
-		r.eventBus.Publish(types.Event{
-			Type:    types.EventATModemCommand,
-			Payload: step.Command,
-		})
+func (r *ATFlowRunner) name() string {
+	if r.flow.Name != "" {
+		return r.flow.Name
+	}
+	return r.flow.ID
+}
+
+func (r *ATFlowRunner) handleURC(line types.SerialLine) {
+	if line.Port != r.port.portName {
+		return
+	}
+	select {
+	case r.urcs <- line.Text:
+	default:
+	}
+}
+
+// runStep sends one step, retrying it until it passes or runs out of attempts
+func (r *ATFlowRunner) runStep(step types.ATFlowStep) types.ATFlowStepResult {
+	stepResult := types.ATFlowStepResult{Name: step.Name}
 
-		// Wait for all expected responses
-		expected := make(map[string]bool)
-		for _, exp := range step.ExpectedResponses {
-			expected[exp] = false
+	if step.When != "" {
+		holds, err := evalCondition(step.When, r.vars)
+		if err != nil {
+			stepResult.Err = err
+			return stepResult
 		}
+		if !holds {
+			stepResult.Skipped = true
+			return stepResult
+		}
+	}
+
+	command, err := r.expandStrict(step.Command)
+	if err != nil {
+		stepResult.Err = err
+		return stepResult
+	}
+	stepResult.Command = command
+
+	body, err := r.expandStrict(step.Body)
+	if err != nil {
+		stepResult.Err = err
+		return stepResult
+	}
 
-		deadline := time.Now().Add(r.responseTimeout)
-		stepSucceeded := true
-		for len(expected) > 0 {
+	expected, err := r.compile(step.ExpectedResponses)
+	if err != nil {
+		stepResult.Err = err
+		return stepResult
+	}
+	failOn := step.FailOn
+	if len(failOn) == 0 {
+		failOn = defaultFailOn
+	}
+	failures, err := r.compile(failOn)
+	if err != nil {
+		stepResult.Err = err
+		return stepResult
+	}
+
+	retryDelay := step.RetryDelay
+	if retryDelay <= 0 {
+		retryDelay = time.Second
+	}
+
+	for attempt := 0; attempt <= step.Retries; attempt++ {
+		if attempt > 0 {
+			// A closed port won't come back for the next attempt, the last one's failure stands
 			select {
-			case resp := <-responsesCh:
-				for exp := range expected {
-					if exp != "" && containsResponse(resp, exp) {
-						r.logf(fmt.Sprintf("[ATFlow] Step %d: Got expected response: '%s'", i+1, exp))
-						delete(expected, exp)
-					}
-				}
-			case <-time.After(time.Until(deadline)):
-				// Timeout
-				for exp := range expected {
-					r.logf(fmt.Sprintf("[ATFlow] Step %d: Timeout waiting for response: '%s'", i+1, exp))
-				}
-				stepSucceeded = false
-				break
+			case <-time.After(retryDelay):
+			case <-r.port.closed:
+				return stepResult
 			}
-			if !stepSucceeded {
-				break
+		}
+		stepResult.Attempts++
+
+		payload := types.ATCommandPayload{
+			Command:  command,
+			OwnerID:  r.flow.ID,
+			Priority: types.PriorityFlow,
+			Timeout:  step.Timeout,
+			Body:     body,
+		}
+		stepResult.Result, stepResult.URCs, stepResult.Err = r.attempt(payload, expected, failures)
+		if stepResult.Err == nil {
+			break
+		}
+	}
+
+	if stepResult.Err == nil {
+		stepResult.Err = r.capture(step.Capture, stepResult.Result, stepResult.URCs)
+	}
+	return stepResult
+}
+
+// attempt sends the command once and checks the answer, and any URCs after it, against the step's patterns
+func (r *ATFlowRunner) attempt(payload types.ATCommandPayload, expected []*regexp.Regexp, failures []*regexp.Regexp) (types.ATResult, []string, error) {
+	// URCs from before this attempt don't count
+	for drained := false; !drained; {
+		select {
+		case <-r.urcs:
+		default:
+			drained = true
+		}
+	}
+
+	result := r.port.Transact(payload)
+	if result.Err != nil {
+		return result, nil, result.Err
+	}
+	// The time the command waited in the queue doesn't count against the URCs that follow it
+	deadline := result.Sent.Add(commandTimeout(payload))
+
+	answer := append(append([]string{}, result.Lines...), result.Final)
+	if line, failed := matchAny(failures, answer); failed {
+		return result, nil, fmt.Errorf("'%s' answered %s", payload.Command, line)
+	}
+
+	missing := unmatched(expected, answer)
+	if len(expected) == 0 && !result.OK() {
+		return result, nil, fmt.Errorf("'%s' answered %s", payload.Command, result.Final)
+	}
+	if len(missing) > 0 && !result.OK() {
+		return result, nil, fmt.Errorf("'%s' answered %s, expected %s", payload.Command, result.Final, describe(missing))
+	}
+
+	// The rest of the expected responses may still come as URCs, until the step times out
+	var urcs []string
+	expire := time.After(time.Until(deadline))
+	for len(missing) > 0 {
+		select {
+		case line := <-r.urcs:
+			urcs = append(urcs, line)
+			if line, failed := matchAny(failures, []string{line}); failed {
+				return result, urcs, fmt.Errorf("'%s' was followed by %s", payload.Command, line)
 			}
+			missing = unmatched(missing, []string{line})
+		case <-expire:
+			return result, urcs, fmt.Errorf("timeout waiting for %s after '%s'", describe(missing), payload.Command)
+		case <-r.port.closed:
+			return result, urcs, fmt.Errorf("%s closed while waiting for %s", r.port.portName, describe(missing))
 		}
-		if !stepSucceeded {
-			succeeded = false
+	}
+
+	return result, urcs, nil
+}
+
+// capture keeps the values the step's capture patterns find in the answer
+func (r *ATFlowRunner) capture(captures map[string]string, result types.ATResult, urcs []string) error {
+	lines := append(append(append([]string{}, result.Lines...), result.Final), urcs...)
+	for name, pattern := range captures {
+		re, err := regexp.Compile(expandPattern(pattern, r.vars))
+		if err != nil {
+			return fmt.Errorf("invalid capture pattern for %s: %w", name, err)
+		}
+
+		found := false
+		for _, line := range lines {
+			match := re.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			r.vars[name] = match[0]
+			if len(match) > 1 {
+				r.vars[name] = match[1]
+			}
+			found = true
 			break
 		}
+		if !found {
+			return fmt.Errorf("nothing to capture for %s, no line matched %s", name, pattern)
+		}
 	}
-	close(stopCh)
-	return succeeded
+	return nil
 }
 
-// containsResponse checks if the response contains the expected substring (case-insensitive).
-func containsResponse(resp, exp string) bool {
-	return len(exp) > 0 && len(resp) > 0 && (resp == exp || containsIgnoreCase(resp, exp))
+func (r *ATFlowRunner) compile(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(expandPattern(pattern, r.vars))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// expand fills in ${name}, variables nobody set become empty
+func (r *ATFlowRunner) expand(text string) string {
+	return expandVars(text, r.vars)
+}
+
+// expandVars fills in ${name} from vars, variables nobody set become empty
+func expandVars(text string, vars map[string]string) string {
+	return flowVariable.ReplaceAllStringFunc(text, func(ref string) string {
+		return vars[ref[2:len(ref)-1]]
+	})
+}
+
+// expandPattern fills in ${name} in a regexp, the values match literally, e.g. an IP address or a +CGPADDR answer
+func expandPattern(pattern string, vars map[string]string) string {
+	return flowVariable.ReplaceAllStringFunc(pattern, func(ref string) string {
+		return regexp.QuoteMeta(vars[ref[2:len(ref)-1]])
+	})
 }
 
-func containsIgnoreCase(a, b string) bool {
-	return len(a) >= len(b) && (a == b || (len(a) > len(b) && containsIgnoreCase(a[1:], b))) || (len(a) >= len(b) && (a[:len(b)] == b || a[len(a)-len(b):] == b))
+// expandStrict fills in ${name} and fails on variables nobody set, a command with a hole in it is never right
+func (r *ATFlowRunner) expandStrict(text string) (string, error) {
+	for _, match := range flowVariable.FindAllStringSubmatch(text, -1) {
+		if _, ok := r.vars[match[1]]; !ok {
+			return "", fmt.Errorf("variable %s is not set", match[1])
+		}
+	}
+	return r.expand(text), nil
+}
+
+// evalCondition decides a step's When. It understands a == b, a != b, a =~ regexp, and on its own a value that is
+// true unless empty, 0 or false. The operator is the first one in the condition, found before the variables are
+// filled in, so a value with == in it can't move it, and values in the regexp match literally.
+func evalCondition(condition string, vars map[string]string) (bool, error) {
+	at, op := -1, ""
+	for _, candidate := range []string{"==", "!=", "=~"} {
+		if i := strings.Index(condition, candidate); i >= 0 && (at < 0 || i < at) {
+			at, op = i, candidate
+		}
+	}
+
+	if op != "" {
+		left, right := condition[:at], condition[at+len(op):]
+		left = expandVars(unquote(strings.TrimSpace(left)), vars)
+		if op == "=~" {
+			right = expandPattern(unquote(strings.TrimSpace(right)), vars)
+		} else {
+			right = expandVars(unquote(strings.TrimSpace(right)), vars)
+		}
+
+		switch op {
+		case "==":
+			return left == right, nil
+		case "!=":
+			return left != right, nil
+		default:
+			re, err := regexp.Compile(right)
+			if err != nil {
+				return false, fmt.Errorf("invalid condition %q: %w", condition, err)
+			}
+			return re.MatchString(left), nil
+		}
+	}
+
+	switch strings.ToLower(expandVars(unquote(strings.TrimSpace(condition)), vars)) {
+	case "", "0", "false":
+		return false, nil
+	}
+	return true, nil
+}
+
+func unquote(text string) string {
+	if len(text) >= 2 && (text[0] == '"' || text[0] == '\'') && text[len(text)-1] == text[0] {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
+
+// matchAny returns the first line any of the patterns matches
+func matchAny(patterns []*regexp.Regexp, lines []string) (string, bool) {
+	for _, line := range lines {
+		for _, re := range patterns {
+			if re.MatchString(line) {
+				return line, true
+			}
+		}
+	}
+	return "", false
+}
+
+// unmatched returns the patterns none of the lines match
+func unmatched(patterns []*regexp.Regexp, lines []string) []*regexp.Regexp {
+	var missing []*regexp.Regexp
+	for _, re := range patterns {
+		if _, found := matchAny([]*regexp.Regexp{re}, lines); !found {
+			missing = append(missing, re)
+		}
+	}
+	return missing
+}
+
+// describe lists patterns for an error message
+func describe(res []*regexp.Regexp) string {
+	quoted := make([]string, len(res))
+	for i, re := range res {
+		quoted[i] = fmt.Sprintf("'%s'", re)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func findStep(steps []types.ATFlowStep, name string) (int, error) {
+	for i, step := range steps {
+		if step.Name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no step named %q to go to", name)
+}
+
+func stepName(step types.ATFlowStep, index int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return fmt.Sprintf("step %d (%s)", index+1, step.Command)
 }
@@ -0,0 +1,292 @@
+package services
+
+import (
+	"atcli/src/types"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startSimPort opens a simulated modem with the given faults, e.g. AT+CSQ:error:2, once it has booted
+func startSimPort(t *testing.T, faults ...string) *SerialPort {
+	t.Helper()
+
+	query := url.Values{}
+	for _, fault := range faults {
+		query.Add("fault", fault)
+	}
+	target := url.URL{Scheme: "sim", Host: "simcom", RawQuery: query.Encode()}
+
+	// Commands sent while the modem boots go unanswered
+	eventBus := NewEventBus()
+	booted := make(chan struct{})
+	var once sync.Once
+	TopicURC.Subscribe(eventBus, func(line types.SerialLine) {
+		if line.Text == "PB DONE" {
+			once.Do(func() { close(booted) })
+		}
+	})
+
+	port, err := NewSerialPort(eventBus, target.String(), DefaultLineConfig(), types.RoleAT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(port.Close)
+
+	select {
+	case <-booted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the simulator didn't boot")
+	}
+	return port
+}
+
+func TestATFlowRunner(t *testing.T) {
+	tests := []struct {
+		name     string
+		faults   []string
+		given    map[string]string // Variables the flow starts with
+		steps    []types.ATFlowStep
+		commands []string // Of the steps as they ran, empty for a skipped one
+		attempts []int
+		vars     map[string]string // Variables the flow must end with
+		wantErr  string            // Empty when the flow must run to the end
+	}{
+		{
+			name:     "expected response in the answer",
+			steps:    []types.ATFlowStep{{Command: "AT+CSQ", ExpectedResponses: []string{`^\+CSQ: \d+,99$`}}},
+			commands: []string{"AT+CSQ"},
+			attempts: []int{1},
+		},
+		{
+			name:     "expected response missing",
+			steps:    []types.ATFlowStep{{Command: "AT+CPIN?", ExpectedResponses: []string{`^\+CPIN: SIM PIN$`}, Timeout: 200 * time.Millisecond}},
+			commands: []string{"AT+CPIN?"},
+			attempts: []int{1},
+			wantErr:  "timeout waiting for '^\\+CPIN: SIM PIN$'",
+		},
+		{
+			name:     "expected URC after the final result code",
+			steps:    []types.ATFlowStep{{Command: "AT+CGNSSPWR=1", ExpectedResponses: []string{`^OK$`, `READY!`}, Timeout: 5 * time.Second}},
+			commands: []string{"AT+CGNSSPWR=1"},
+			attempts: []int{1},
+		},
+		{
+			name:     "error fails the flow",
+			steps:    []types.ATFlowStep{{Command: "AT+BOGUS"}, {Command: "AT"}},
+			commands: []string{"AT+BOGUS"},
+			attempts: []int{1},
+			wantErr:  "'AT+BOGUS' answered ERROR",
+		},
+		{
+			name:   "retry until it passes",
+			faults: []string{"AT+CSQ:error:2"},
+			steps: []types.ATFlowStep{
+				{Command: "AT+CSQ"},
+				{Command: "AT+CSQ", Retries: 2, RetryDelay: 10 * time.Millisecond},
+			},
+			commands: []string{"AT+CSQ", "AT+CSQ"},
+			attempts: []int{1, 2},
+		},
+		{
+			name:     "retries run out",
+			faults:   []string{"AT+COPS:cme"},
+			steps:    []types.ATFlowStep{{Command: "AT+COPS?", Retries: 2, RetryDelay: 10 * time.Millisecond}},
+			commands: []string{"AT+COPS?"},
+			attempts: []int{3},
+			wantErr:  "+CME ERROR: 100",
+		},
+		{
+			name:     "timeout",
+			faults:   []string{"AT+CGPSINFO:timeout"},
+			steps:    []types.ATFlowStep{{Command: "AT+CGPSINFO", Timeout: 200 * time.Millisecond}},
+			commands: []string{"AT+CGPSINFO"},
+			attempts: []int{1},
+			wantErr:  "AT+CGPSINFO",
+		},
+		{
+			name: "optional step fails and the flow carries on",
+			steps: []types.ATFlowStep{
+				{Command: "AT+BOGUS", Optional: true},
+				{Command: "AT"},
+			},
+			commands: []string{"AT+BOGUS", "AT"},
+			attempts: []int{1, 1},
+		},
+		{
+			name: "branch on success past a step",
+			steps: []types.ATFlowStep{
+				{Command: "AT+CPIN?", Capture: map[string]string{"pin": `^\+CPIN: (.+)$`}},
+				{Command: "AT", When: "${pin} == READY", OnSuccess: "done"},
+				{Name: "unlock", Command: "AT+CPIN=1234"},
+				{Name: "done", Command: "AT+CGMI"},
+			},
+			commands: []string{"AT+CPIN?", "AT", "AT+CGMI"},
+			attempts: []int{1, 1, 1},
+			vars:     map[string]string{"pin": "READY"},
+		},
+		{
+			name: "branch on failure",
+			steps: []types.ATFlowStep{
+				{Command: "AT+BOGUS", OnFailure: "recover"},
+				{Command: "AT+CGMM"},
+				{Name: "recover", Command: "AT"},
+			},
+			commands: []string{"AT+BOGUS", "AT"},
+			attempts: []int{1, 1},
+		},
+		{
+			name: "end stops the flow",
+			steps: []types.ATFlowStep{
+				{Command: "AT", OnSuccess: "end"},
+				{Command: "AT+BOGUS"},
+			},
+			commands: []string{"AT"},
+			attempts: []int{1},
+		},
+		{
+			name:     "branch to a missing step",
+			steps:    []types.ATFlowStep{{Command: "AT", OnSuccess: "nowhere"}},
+			commands: []string{"AT"},
+			attempts: []int{1},
+			wantErr:  `no step named "nowhere"`,
+		},
+		{
+			name:  "when skips a step",
+			given: map[string]string{"op": ""},
+			steps: []types.ATFlowStep{
+				{Command: "AT+COPS?", When: `${op} != ""`},
+				{Command: "AT"},
+			},
+			commands: []string{"", "AT"},
+			attempts: []int{0, 1},
+		},
+		{
+			name:  "capture with a variable in the pattern",
+			given: map[string]string{"mcc": "262"},
+			steps: []types.ATFlowStep{
+				{Command: "AT+CPSI?", Capture: map[string]string{"mnc": `^\+CPSI: LTE,Online,${mcc}-(\d+),`, "cpsi": `^\+CPSI: `}},
+			},
+			commands: []string{"AT+CPSI?"},
+			attempts: []int{1},
+			vars:     map[string]string{"mcc": "262", "mnc": "03", "cpsi": "+CPSI: "},
+		},
+		{
+			name:     "nothing to capture",
+			steps:    []types.ATFlowStep{{Command: "AT", Capture: map[string]string{"csq": `^\+CSQ: (\d+)`}}},
+			commands: []string{"AT"},
+			attempts: []int{1},
+			wantErr:  "nothing to capture for csq",
+		},
+		{
+			name: "captured value in a later command",
+			steps: []types.ATFlowStep{
+				{Command: "AT+CGDCONT?", Capture: map[string]string{"apn": `^\+CGDCONT: 1,"IP","([^"]*)"`}},
+				{Command: `AT+CGDCONT=2,"IP","${apn}"`, ExpectedResponses: []string{`^OK$`}, Optional: true},
+			},
+			commands: []string{"AT+CGDCONT?", `AT+CGDCONT=2,"IP","internet"`},
+			attempts: []int{1, 1},
+			vars:     map[string]string{"apn": "internet"},
+		},
+		{
+			name:     "unset variable in a command",
+			steps:    []types.ATFlowStep{{Command: `AT+CGDCONT=1,"IP","${apn}"`}},
+			commands: []string{""},
+			attempts: []int{0},
+			wantErr:  "variable apn is not set",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port := startSimPort(t, test.faults...)
+			result := NewATFlowRunner(port, types.ATFlow{Name: "test", Steps: test.steps, Vars: test.given}).Run()
+
+			if test.wantErr == "" && result.Err != nil {
+				t.Fatalf("flow failed: %v", result.Err)
+			}
+			if test.wantErr != "" && (result.Err == nil || !strings.Contains(result.Err.Error(), test.wantErr)) {
+				t.Fatalf("flow ended with %v, want an error containing %q", result.Err, test.wantErr)
+			}
+
+			var commands []string
+			var attempts []int
+			for _, step := range result.Steps {
+				commands = append(commands, step.Command)
+				attempts = append(attempts, step.Attempts)
+			}
+			if !reflect.DeepEqual(commands, test.commands) {
+				t.Errorf("commands %q, want %q", commands, test.commands)
+			}
+			if !reflect.DeepEqual(attempts, test.attempts) {
+				t.Errorf("attempts %v, want %v", attempts, test.attempts)
+			}
+			for name, want := range test.vars {
+				if got, ok := result.Vars[name]; !ok || got != want {
+					t.Errorf("variable %s is %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	vars := map[string]string{
+		"pin":  "READY",
+		"csq":  "17",
+		"ip":   "10.0.0.1",
+		"eq":   "a == b",
+		"ne":   "x != y",
+		"none": "",
+		"off":  "false",
+	}
+
+	tests := []struct {
+		condition string
+		want      bool
+		wantErr   bool
+	}{
+		{condition: "${pin} == READY", want: true},
+		{condition: `${pin} == "SIM PIN"`, want: false},
+		{condition: `${none} != ""`, want: false},
+		{condition: `${pin} != ''`, want: true},
+		{condition: "${csq} =~ ^1[0-9]$", want: true},
+		{condition: "${csq} =~ ^2", want: false},
+		{condition: "10.0.0.1 =~ ^${ip}$", want: true},
+		{condition: "10x0x0x1 =~ ^${ip}$", want: false},
+		{condition: "${eq} == a", want: false},
+		{condition: `${eq} != ""`, want: true},
+		{condition: "${eq} =~ a == b", want: true},
+		{condition: "${ne} =~ !=", want: true},
+		{condition: "${ne} =~ ^!=", want: false},
+		{condition: "${pin} != a==b", want: true},
+		{condition: "${pin} == READY=~x", want: false},
+		{condition: "${pin}", want: true},
+		{condition: "${none}", want: false},
+		{condition: "${off}", want: false},
+		{condition: "${unset}", want: false},
+		{condition: "0", want: false},
+		{condition: "${csq} =~ (", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			got, err := evalCondition(test.condition, vars)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package services
+
+import (
+	"atcli/src/types"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultATTimeout is how long a command may take to reach its final result code unless the sender says otherwise
+const defaultATTimeout = 10 * time.Second
+
+// promptTimeout is how long a > prompt stays open for the user to type the text
+const promptTimeout = 5 * time.Minute
+
+const (
+	ctrlZ  = 0x1a // Ends the text typed at a > prompt and sends it
+	escape = 0x1b // Closes a > prompt without sending anything
+)
+
+// finalResultCodes end a transaction, the ones followed by text are matched on their prefix
+var finalResultCodes = []string{
+	"OK",
+	"ERROR",
+	"NO CARRIER",
+	"NO DIALTONE",
+	"NO ANSWER",
+	"BUSY",
+	"CONNECT",
+}
+
+var finalResultPrefixes = []string{
+	"+CME ERROR:",
+	"+CMS ERROR:",
+	"CONNECT ",
+}
+
+// unsolicitedLines are URCs without a +NAME: prefix that can arrive in the middle of a transaction
+var unsolicitedLines = []string{
+	"RING",
+	"RDY",
+	"SMS DONE",
+	"PB DONE",
+}
+
+var transactionCounter atomic.Uint64
+
+// IsFinalResultCode reports whether a line ends a command, OK, ERROR, +CME ERROR: 10 and so on
+func IsFinalResultCode(line string) bool {
+	for _, code := range finalResultCodes {
+		if line == code {
+			return true
+		}
+	}
+	for _, prefix := range finalResultPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPortError reports whether a transaction failed because of the port, not because the modem didn't answer in time or the command was cancelled
+func IsPortError(err error) bool {
+	return err != nil && !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrCancelled)
+}
+
+// commandName returns the +NAME a command's information responses start with, e.g. +CSQ for AT+CSQ?
+func commandName(command string) string {
+	upper := strings.ToUpper(strings.TrimSpace(command))
+	if !strings.HasPrefix(upper, "AT+") {
+		return ""
+	}
+
+	name := upper[2:]
+	if end := strings.IndexAny(name, "=?"); end >= 0 {
+		name = name[:end]
+	}
+	return name
+}
+
+// atTransaction is the command in flight on a port
+type atTransaction struct {
+	result   types.ATResult
+	name     string
+	echoed   bool
+	prompted bool          // A > prompt is open and waiting for its text
+	prompt   chan struct{} // The modem opened a > prompt
+	answered chan struct{} // The text for the prompt went out
+	done     chan struct{}
+}
+
+// belongs decides whether a line read during the transaction answers the command.
+// Information responses carry the command's +NAME, anything with another +NAME is a URC that happened to arrive now.
+func (t *atTransaction) belongs(line string) bool {
+	for _, urc := range unsolicitedLines {
+		if line == urc {
+			return false
+		}
+	}
+
+	if !strings.HasPrefix(line, "+") {
+		return true
+	}
+
+	prefix := line
+	if end := strings.Index(prefix, ":"); end >= 0 {
+		prefix = prefix[:end]
+	}
+	return strings.EqualFold(prefix, t.name)
+}
+
+// SendAT sends a command and waits for its transaction to finish. Don't call it from an event handler,
+// the port publishes while the transaction runs.
+func SendAT(eventBus *EventBus, payload types.ATCommandPayload) types.ATResult {
+	return SendATContext(context.Background(), eventBus, payload)
+}
+
+// SendATContext is SendAT that stops waiting when ctx is done. The command isn't cancelled, it still goes out
+// and its ATResult is published as usual.
+func SendATContext(ctx context.Context, eventBus *EventBus, payload types.ATCommandPayload) types.ATResult {
+	result := make(chan types.ATResult, 1)
+	payload.Result = result
+	if payload.ID == "" {
+		payload.ID = nextTransactionID()
+	}
+
+	eventBus.Publish(types.Event{Type: types.EventATModemCommand, Payload: payload})
+
+	// The port gives up on the command itself, in the queue or once sent, this only catches a port that never took it
+	select {
+	case r := <-result:
+		return r
+	case <-ctx.Done():
+		return types.ATResult{
+			ID:      payload.ID,
+			Role:    payload.Role,
+			Command: payload.Command,
+			Err:     ctx.Err(),
+		}
+	case <-time.After(maxQueueWait + commandTimeout(payload) + 5*time.Second):
+		return types.ATResult{
+			ID:      payload.ID,
+			Role:    payload.Role,
+			Command: payload.Command,
+			Err:     fmt.Errorf("no port took '%s'", payload.Command),
+		}
+	}
+}
+
+func nextTransactionID() string {
+	return fmt.Sprintf("at-%d", transactionCounter.Add(1))
+}
+
+// Transact queues one command and waits for the answer up to its final result code.
+// Commands on a port go out one at a time, the highest priority first.
+func (s *SerialPort) Transact(payload types.ATCommandPayload) types.ATResult {
+	return <-s.submit(payload, nil).result
+}
+
+func (s *SerialPort) newTransaction(payload types.ATCommandPayload) *atTransaction {
+	return &atTransaction{
+		result: types.ATResult{
+			ID:      payload.ID,
+			Port:    s.portName,
+			Role:    s.role,
+			Command: payload.Command,
+		},
+		name:     commandName(payload.Command),
+		prompt:   make(chan struct{}, 1),
+		answered: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// transact sends a command taken off the queue and collects the answer, only the queue worker calls it
+func (s *SerialPort) transact(cmd *queuedCommand) types.ATResult {
+	payload := cmd.payload
+	tx := s.newTransaction(payload)
+
+	port := s.currentPort()
+	if port == nil {
+		return s.finishTransaction(tx, payload, fmt.Errorf("not connected to %s, dropping '%s'", s.portName, payload.Command))
+	}
+
+	tx.result.Sent = time.Now()
+	s.txStateLock.Lock()
+	s.inflight = tx
+	s.txStateLock.Unlock()
+
+	_, err := port.Write([]byte(payload.Command + "\r\n"))
+
+	// If you want to debug your requests uncomment this
+	LogMessage(fmt.Sprintf("-> %s", payload.Command))
+
+	if err != nil {
+		s.clearInflight()
+		return s.finishTransaction(tx, payload, err)
+	}
+
+	// Echo the command with the prefix to the command view
+	TopicSerialResponse.Publish(s.eventBus, s.line(payload.Command))
+
+	expire := time.After(commandTimeout(payload))
+	for waiting := true; waiting; {
+		select {
+		case <-tx.done:
+			err = nil
+			waiting = false
+		case <-tx.prompt:
+			if payload.Body != "" {
+				if err = s.AnswerPrompt(types.PromptReply{Text: payload.Body}); err != nil {
+					waiting = false
+				}
+				continue
+			}
+			// Leave the prompt to the user, they get longer than the modem to answer
+			TopicPrompt.Publish(s.eventBus, types.Prompt{ID: tx.result.ID, Port: s.portName, Role: s.role})
+			expire = time.After(promptTimeout)
+		case <-tx.answered:
+			expire = time.After(commandTimeout(payload))
+		case <-expire:
+			err = fmt.Errorf("%w waiting for response to '%s'", ErrTimeout, payload.Command)
+			waiting = false
+		case <-cmd.cancelled:
+			err = fmt.Errorf("%w '%s'", ErrCancelled, payload.Command)
+			waiting = false
+		case <-s.closed:
+			err = fmt.Errorf("%s closed while waiting for response to '%s'", s.portName, payload.Command)
+			waiting = false
+		}
+	}
+
+	// Don't leave the modem stuck in a prompt nobody will answer
+	if err != nil && s.promptOpen(tx) {
+		port.Write([]byte{escape})
+	}
+	s.clearInflight()
+
+	return s.finishTransaction(tx, payload, err)
+}
+
+// openPrompt marks the command in flight as waiting for the text of a > prompt, false if no command is in flight
+func (s *SerialPort) openPrompt() bool {
+	s.txStateLock.Lock()
+	defer s.txStateLock.Unlock()
+
+	tx := s.inflight
+	if tx == nil || tx.prompted {
+		return tx != nil
+	}
+	tx.prompted = true
+	poke(tx.prompt)
+	return true
+}
+
+func (s *SerialPort) promptOpen(tx *atTransaction) bool {
+	s.txStateLock.Lock()
+	defer s.txStateLock.Unlock()
+	return tx.prompted
+}
+
+// AnswerPrompt sends the text for the open > prompt terminated with Ctrl-Z, or ESC to close it when reply.Abort is set
+func (s *SerialPort) AnswerPrompt(reply types.PromptReply) error {
+	s.txStateLock.Lock()
+	tx := s.inflight
+	if tx == nil || !tx.prompted {
+		s.txStateLock.Unlock()
+		return fmt.Errorf("no prompt open on %s", s.portName)
+	}
+	tx.prompted = false
+	s.txStateLock.Unlock()
+
+	port := s.currentPort()
+	if port == nil {
+		return fmt.Errorf("not connected to %s", s.portName)
+	}
+
+	data := []byte{escape}
+	if !reply.Abort {
+		data = append([]byte(reply.Text), ctrlZ)
+	}
+	if _, err := port.Write(data); err != nil {
+		return err
+	}
+
+	poke(tx.answered)
+	return nil
+}
+
+func (s *SerialPort) clearInflight() {
+	s.txStateLock.Lock()
+	s.inflight = nil
+	s.txStateLock.Unlock()
+}
+
+// finishTransaction hands the result to whoever asked for it and to anyone listening on the bus
+func (s *SerialPort) finishTransaction(tx *atTransaction, payload types.ATCommandPayload, err error) types.ATResult {
+	s.txStateLock.Lock()
+	result := tx.result
+	s.txStateLock.Unlock()
+
+	result.Err = err
+	if !result.Sent.IsZero() && result.Duration == 0 {
+		result.Duration = time.Since(result.Sent)
+	}
+
+	// A timeout or a cancel is the command's own failure, it is reported in the ATResult only
+	if IsPortError(err) {
+		TopicSerialError.Publish(s.eventBus, err)
+	} else if err == nil {
+		LogMessage(fmt.Sprintf("<- %s %s in %s", result.Command, result.Final, result.Duration.Round(time.Millisecond)))
+	}
+
+	s.eventBus.Publish(types.Event{Type: types.EventATResult, Payload: result})
+	if payload.Result != nil {
+		select {
+		case payload.Result <- result:
+		default:
+		}
+	}
+
+	return result
+}
+
+// classifyLine gives a line read from the port to the command in flight, or publishes it as a URC
+func (s *SerialPort) classifyLine(text string) {
+	if text == "" {
+		return
+	}
+
+	s.txStateLock.Lock()
+	tx := s.inflight
+	if tx != nil {
+		switch {
+		case !tx.echoed && strings.EqualFold(text, strings.TrimSpace(tx.result.Command)):
+			tx.echoed = true
+			s.txStateLock.Unlock()
+			return
+		case IsFinalResultCode(text):
+			tx.result.Final = text
+			tx.result.Duration = time.Since(tx.result.Sent)
+			s.inflight = nil
+			close(tx.done)
+			s.txStateLock.Unlock()
+			return
+		case tx.belongs(text):
+			tx.result.Lines = append(tx.result.Lines, text)
+			s.txStateLock.Unlock()
+			return
+		}
+	}
+	s.txStateLock.Unlock()
+
+	TopicURC.Publish(s.eventBus, s.line(text))
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"atcli/src/types"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIsFinalResultCode(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"OK", true},
+		{"ERROR", true},
+		{"+CME ERROR: 10", true},
+		{"+CMS ERROR: 500", true},
+		{"CONNECT", true},
+		{"CONNECT 115200", true},
+		{"NO CARRIER", true},
+		{"BUSY", true},
+		{"OK ", false},
+		{"ok", false},
+		{"CONNECTED", false},
+		{"+CSQ: 17,99", false},
+		{"RING", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			if got := IsFinalResultCode(test.line); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsPortError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"none", nil, false},
+		{"timeout", fmt.Errorf("%w waiting for response to 'AT'", ErrTimeout), false},
+		{"cancelled", fmt.Errorf("%w 'AT'", ErrCancelled), false},
+		{"timeout from a daemon record", errorFromText("timeout waiting for response to 'AT'"), false},
+		{"write failed", errors.New("write /dev/ttyUSB2: input/output error"), true},
+		{"not connected", errors.New("not connected to /dev/ttyUSB2, dropping 'AT'"), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsPortError(test.err); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"AT+CSQ", "+CSQ"},
+		{"at+cops?", "+COPS"},
+		{" AT+CGDCONT=1,\"IP\",\"internet\" ", "+CGDCONT"},
+		{"AT+CPIN=?", "+CPIN"},
+		{"AT", ""},
+		{"ATI", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			if got := commandName(test.command); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClassifyLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string   // In flight while the lines arrive, empty for none
+		lines   []string // As read from the port
+		answer  []string // Intermediate lines the command got
+		final   string   // Empty when the command must still be in flight
+		urcs    []string
+	}{
+		{
+			name:    "echo, answer and OK",
+			command: "AT+CSQ",
+			lines:   []string{"AT+CSQ", "+CSQ: 17,99", "OK"},
+			answer:  []string{"+CSQ: 17,99"},
+			final:   "OK",
+		},
+		{
+			name:    "echo is matched once and case-insensitively",
+			command: "at+cgmr",
+			lines:   []string{"AT+CGMR", "AT+CGMR", "OK"},
+			answer:  []string{"AT+CGMR"},
+			final:   "OK",
+		},
+		{
+			name:    "lines without a +NAME belong to the command",
+			command: "ATI",
+			lines:   []string{"Manufacturer: SIMCOM", "Model: SIM7600", "OK"},
+			answer:  []string{"Manufacturer: SIMCOM", "Model: SIM7600"},
+			final:   "OK",
+		},
+		{
+			name:    "another +NAME is a URC",
+			command: "AT+COPS?",
+			lines:   []string{"+CREG: 1", "+cops: 0,0,\"SIMULATED\",7", "+CME ERROR: 30"},
+			answer:  []string{"+cops: 0,0,\"SIMULATED\",7"},
+			final:   "+CME ERROR: 30",
+			urcs:    []string{"+CREG: 1"},
+		},
+		{
+			name:    "unsolicited lines without a +NAME",
+			command: "AT+CSQ",
+			lines:   []string{"RING", "+CSQ: 17,99", "SMS DONE"},
+			answer:  []string{"+CSQ: 17,99"},
+			urcs:    []string{"RING", "SMS DONE"},
+		},
+		{
+			name:    "lines after the final result code are URCs",
+			command: "AT",
+			lines:   []string{"OK", "+CSQ: 17,99", "OK"},
+			final:   "OK",
+			urcs:    []string{"+CSQ: 17,99", "OK"},
+		},
+		{
+			name:  "nothing in flight",
+			lines: []string{"+CEREG: 1", "", "RDY", "OK"},
+			urcs:  []string{"+CEREG: 1", "RDY", "OK"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eventBus := NewEventBus()
+			var urcs []string
+			TopicURC.Subscribe(eventBus, func(line types.SerialLine) {
+				urcs = append(urcs, line.Text)
+			})
+
+			s := &SerialPort{portName: "test", role: types.RoleAT, eventBus: eventBus}
+			var tx *atTransaction
+			if test.command != "" {
+				tx = s.newTransaction(types.ATCommandPayload{Command: test.command})
+				tx.result.Sent = time.Now()
+				s.inflight = tx
+			}
+
+			for _, line := range test.lines {
+				s.classifyLine(line)
+			}
+
+			if !reflect.DeepEqual(urcs, test.urcs) {
+				t.Errorf("URCs %q, want %q", urcs, test.urcs)
+			}
+			if tx == nil {
+				return
+			}
+			if !reflect.DeepEqual(tx.result.Lines, test.answer) {
+				t.Errorf("answer %q, want %q", tx.result.Lines, test.answer)
+			}
+			if tx.result.Final != test.final {
+				t.Errorf("final %q, want %q", tx.result.Final, test.final)
+			}
+
+			select {
+			case <-tx.done:
+				if test.final == "" {
+					t.Error("transaction finished without a final result code")
+				}
+				if s.inflight != nil {
+					t.Error("finished transaction still in flight")
+				}
+			default:
+				if test.final != "" {
+					t.Error("transaction still open after its final result code")
+				}
+			}
+		})
+	}
+}
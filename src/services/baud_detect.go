@@ -0,0 +1,49 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CommonBaudRates are the rates auto-baud walks, the ones modems accept for AT+IPR
+var CommonBaudRates = []int{9600, 19200, 38400, 57600, 115200, 230400, 460800, 921600}
+
+// DetectBaudRate walks CommonBaudRates sending AT at each and returns the first rate the modem answers OK at.
+// The rest of the line settings come from config.
+func DetectBaudRate(portName string, config LineConfig, timeout time.Duration) (int, error) {
+	config.BaudRate = CommonBaudRates[0]
+	mode := config.Mode()
+	port, err := OpenTransport(portName, &mode)
+	if err != nil {
+		return 0, err
+	}
+	defer port.Close()
+
+	if err := ApplyLineConfig(port, config); err != nil {
+		return 0, err
+	}
+	port.SetReadTimeout(50 * time.Millisecond)
+
+	for _, rate := range CommonBaudRates {
+		mode.BaudRate = rate
+		if err := port.SetMode(&mode); err != nil {
+			if errors.Is(err, ErrNotSupported) {
+				return 0, fmt.Errorf("%s has no baud rate to detect", portName)
+			}
+			return 0, err
+		}
+
+		// Throw away whatever was garbled at the previous rate, then a bare CR ends any half command
+		probeRead(port, 100*time.Millisecond, nil)
+		port.Write([]byte("\r"))
+		probeRead(port, 100*time.Millisecond, nil)
+
+		if strings.Contains(probeCommand(port, "AT", timeout), "OK") {
+			return rate, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no answer to AT at any of %v", CommonBaudRates)
+}
@@ -0,0 +1,526 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 3GPP TS 27.010 basic option framing
+const (
+	cmuxFlag = 0xF9
+	cmuxEA   = 0x01 // Extension bit, set on the last byte of a field
+	cmuxCR   = 0x02 // Command/response bit
+	cmuxPF   = 0x10 // Poll/final bit in the control field
+
+	cmuxSABM = 0x2F // Open a channel
+	cmuxUA   = 0x63 // Acknowledge
+	cmuxDM   = 0x0F // Refuse
+	cmuxDISC = 0x43 // Close a channel
+	cmuxUIH  = 0xEF // Data
+	cmuxUI   = 0x03 // Data, FCS covers the payload too
+)
+
+// Control channel (DLCI 0) message types, with EA set and C/R clear
+const (
+	cmuxMsgCLD  = 0xC1 // Multiplexer close down
+	cmuxMsgTest = 0x21 // Echo test
+	cmuxMsgMSC  = 0xE1 // Modem status command, carries the V.24 signals of a channel
+	cmuxMsgNSC  = 0x11 // Non supported command response
+)
+
+// V.24 signals in an MSC message
+const (
+	cmuxSignalFC  = 0x02 // Flow control, set when the sender can't take data
+	cmuxSignalRTC = 0x04 // Ready to communicate, DTR/DSR
+	cmuxSignalRTR = 0x08 // Ready to receive, RTS/CTS
+	cmuxSignalIC  = 0x40 // Incoming call, RI
+	cmuxSignalDV  = 0x80 // Data valid, DCD
+)
+
+const (
+	// cmuxDefaultFrameSize is the default N1 for basic option, what a modem uses after a plain AT+CMUX=0
+	cmuxDefaultFrameSize = 31
+	// cmuxAckTimeout bounds how long the modem may take to answer SABM and DISC
+	cmuxAckTimeout = 3 * time.Second
+)
+
+var cmuxCRCTable = func() [256]byte {
+	table := [256]byte{}
+	for i := range table {
+		crc := byte(i)
+		for bit := 0; bit < 8; bit++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xE0
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// cmuxFCS is the frame check sequence, a reflected CRC-8 over the header (and payload for UI frames)
+func cmuxFCS(data []byte) byte {
+	crc := byte(0xFF)
+	for _, b := range data {
+		crc = cmuxCRCTable[crc^b]
+	}
+	return 0xFF - crc
+}
+
+// cmuxCheckFCS reports whether fcs is right for data, running the received FCS through the CRC leaves 0xCF
+func cmuxCheckFCS(data []byte, fcs byte) bool {
+	crc := byte(0xFF)
+	for _, b := range data {
+		crc = cmuxCRCTable[crc^b]
+	}
+	return cmuxCRCTable[crc^fcs] == 0xCF
+}
+
+// cmuxFrame is one decoded frame, control has the P/F bit masked off
+type cmuxFrame struct {
+	dlci    byte
+	command bool // C/R bit of the address
+	control byte
+	poll    bool
+	data    []byte
+}
+
+// encodeCMUXFrame builds a basic option frame
+func encodeCMUXFrame(dlci byte, command bool, control byte, data []byte) []byte {
+	address := dlci<<2 | cmuxEA
+	if command {
+		address |= cmuxCR
+	}
+
+	header := []byte{address, control}
+	if len(data) <= 127 {
+		header = append(header, byte(len(data))<<1|cmuxEA)
+	} else {
+		header = append(header, byte(len(data)<<1), byte(len(data)>>7))
+	}
+
+	checked := header
+	if control&^cmuxPF == cmuxUI {
+		checked = append(append([]byte{}, header...), data...)
+	}
+
+	frame := append([]byte{cmuxFlag}, header...)
+	frame = append(frame, data...)
+	frame = append(frame, cmuxFCS(checked), cmuxFlag)
+	return frame
+}
+
+var errCMUXBadFrame = errors.New("cmux frame failed its check")
+
+// readCMUXFrame reads the next frame. A frame failing its FCS returns errCMUXBadFrame and the caller should carry on.
+func readCMUXFrame(reader *bufio.Reader) (cmuxFrame, error) {
+	// Find the opening flag, back to back flags close one frame and open the next
+	b, err := reader.ReadByte()
+	for err == nil && b != cmuxFlag {
+		b, err = reader.ReadByte()
+	}
+	for err == nil && b == cmuxFlag {
+		b, err = reader.ReadByte()
+	}
+	if err != nil {
+		return cmuxFrame{}, err
+	}
+
+	header := []byte{b}
+	control, err := reader.ReadByte()
+	if err != nil {
+		return cmuxFrame{}, err
+	}
+	header = append(header, control)
+
+	lengthByte, err := reader.ReadByte()
+	if err != nil {
+		return cmuxFrame{}, err
+	}
+	header = append(header, lengthByte)
+	length := int(lengthByte >> 1)
+	if lengthByte&cmuxEA == 0 {
+		high, err := reader.ReadByte()
+		if err != nil {
+			return cmuxFrame{}, err
+		}
+		header = append(header, high)
+		length |= int(high) << 7
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return cmuxFrame{}, err
+	}
+
+	fcs, err := reader.ReadByte()
+	if err != nil {
+		return cmuxFrame{}, err
+	}
+
+	checked := header
+	if control&^cmuxPF == cmuxUI {
+		checked = append(append([]byte{}, header...), data...)
+	}
+	if header[0]&cmuxEA == 0 || !cmuxCheckFCS(checked, fcs) {
+		return cmuxFrame{}, errCMUXBadFrame
+	}
+
+	return cmuxFrame{
+		dlci:    header[0] >> 2,
+		command: header[0]&cmuxCR != 0,
+		control: control &^ cmuxPF,
+		poll:    control&cmuxPF != 0,
+		data:    data,
+	}, nil
+}
+
+// cmuxControlMessages splits the payload of a DLCI 0 frame into type and value pairs
+func cmuxControlMessages(data []byte) [][2][]byte {
+	messages := [][2][]byte{}
+	for len(data) >= 2 {
+		msgType := data[0]
+		length := int(data[1] >> 1)
+		offset := 2
+		if data[1]&cmuxEA == 0 && len(data) > 2 {
+			length |= int(data[2]) << 7
+			offset = 3
+		}
+		if offset+length > len(data) {
+			break
+		}
+		messages = append(messages, [2][]byte{{msgType}, data[offset : offset+length]})
+		data = data[offset+length:]
+	}
+	return messages
+}
+
+// cmuxControlMessage builds a DLCI 0 message
+func cmuxControlMessage(msgType byte, command bool, value []byte) []byte {
+	if command {
+		msgType |= cmuxCR
+	}
+	return append([]byte{msgType, byte(len(value))<<1 | cmuxEA}, value...)
+}
+
+// CMUX is the host side of a 27.010 basic option multiplexer running over one transport.
+// Each DLCI the modem offers becomes a CMUXChannel, which is a Transport of its own.
+type CMUX struct {
+	base      Transport
+	config    LineConfig // What base was opened with, the channels share it
+	frameSize int
+
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	channels  map[byte]*CMUXChannel
+	acks      map[byte]chan byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// StartCMUX switches the modem on base into multiplexer mode with AT+CMUX=0 and opens the control channel.
+// Once it returns the port carries frames only, open channels with OpenChannel. config is what base was opened with.
+func StartCMUX(base Transport, config LineConfig) (*CMUX, error) {
+	base.SetReadTimeout(50 * time.Millisecond)
+
+	answer := probeCommand(base, "AT+CMUX=0", cmuxAckTimeout)
+	if !strings.Contains(answer, "OK") {
+		return nil, fmt.Errorf("modem did not accept AT+CMUX=0: %q", strings.TrimSpace(answer))
+	}
+
+	mux := &CMUX{
+		base:      base,
+		config:    config,
+		frameSize: cmuxDefaultFrameSize,
+		channels:  map[byte]*CMUXChannel{},
+		acks:      map[byte]chan byte{},
+		closed:    make(chan struct{}),
+	}
+
+	go mux.receive()
+
+	if err := mux.connect(0); err != nil {
+		mux.shutdown(err)
+		return nil, fmt.Errorf("modem did not open the CMUX control channel: %w", err)
+	}
+
+	return mux, nil
+}
+
+// OpenCMUX opens portName with the line config and starts the multiplexer on it
+func OpenCMUX(portName string, config LineConfig) (*CMUX, error) {
+	config, err := config.WithPortOverrides(portName)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := openWithConfig(portName, config)
+	if err != nil {
+		return nil, err
+	}
+
+	mux, err := StartCMUX(base, config)
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+
+	return mux, nil
+}
+
+// OpenChannel opens a DLCI and announces our V.24 signals for it, SIMCom modems hold data back until they get them
+func (m *CMUX) OpenChannel(dlci byte) (*CMUXChannel, error) {
+	if dlci == 0 || dlci > 63 {
+		return nil, fmt.Errorf("invalid CMUX channel %d, expected 1 to 63", dlci)
+	}
+
+	channel := newCMUXChannel(m, dlci)
+
+	m.lock.Lock()
+	if _, ok := m.channels[dlci]; ok {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("CMUX channel %d is already open", dlci)
+	}
+	m.channels[dlci] = channel
+	m.lock.Unlock()
+
+	if err := m.connect(dlci); err != nil {
+		m.removeChannel(dlci)
+		return nil, fmt.Errorf("modem did not open CMUX channel %d: %w", dlci, err)
+	}
+
+	if err := channel.sendSignals(); err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	return channel, nil
+}
+
+// Close closes every channel, tells the modem to leave multiplexer mode and closes the port underneath
+func (m *CMUX) Close() error {
+	m.lock.Lock()
+	channels := []*CMUXChannel{}
+	for _, channel := range m.channels {
+		channels = append(channels, channel)
+	}
+	m.lock.Unlock()
+
+	for _, channel := range channels {
+		channel.Close()
+	}
+
+	select {
+	case <-m.closed:
+	default:
+		m.send(0, true, cmuxUIH, cmuxControlMessage(cmuxMsgCLD, true, nil))
+	}
+
+	m.shutdown(io.EOF)
+	return m.base.Close()
+}
+
+// LineConfig returns the line settings of the port under the multiplexer, channels have to use the same
+func (m *CMUX) LineConfig() LineConfig {
+	return m.config
+}
+
+// Done is closed once the multiplexer stops, e.g. when the port underneath went away
+func (m *CMUX) Done() <-chan struct{} {
+	return m.closed
+}
+
+// connect sends SABM and waits for the modem to answer UA
+func (m *CMUX) connect(dlci byte) error {
+	return m.exchange(dlci, cmuxSABM)
+}
+
+// exchange sends SABM or DISC with the poll bit and waits for UA, DM is a refusal
+func (m *CMUX) exchange(dlci byte, control byte) error {
+	ack := make(chan byte, 1)
+	m.lock.Lock()
+	m.acks[dlci] = ack
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		delete(m.acks, dlci)
+		m.lock.Unlock()
+	}()
+
+	if err := m.send(dlci, true, control|cmuxPF, nil); err != nil {
+		return err
+	}
+
+	select {
+	case reply := <-ack:
+		if reply != cmuxUA {
+			return fmt.Errorf("refused by the modem")
+		}
+		return nil
+	case <-m.closed:
+		return m.err
+	case <-time.After(cmuxAckTimeout):
+		return fmt.Errorf("no answer from the modem")
+	}
+}
+
+func (m *CMUX) send(dlci byte, command bool, control byte, data []byte) error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	_, err := m.base.Write(encodeCMUXFrame(dlci, command, control, data))
+	return err
+}
+
+// receive runs for the life of the multiplexer, handing frames to their channel
+func (m *CMUX) receive() {
+	reader := bufio.NewReader(&blockingReader{transport: m.base, closed: m.closed})
+	for {
+		frame, err := readCMUXFrame(reader)
+		if errors.Is(err, errCMUXBadFrame) {
+			continue
+		}
+		if err != nil {
+			m.shutdown(err)
+			return
+		}
+
+		switch frame.control {
+		case cmuxUA, cmuxDM:
+			m.lock.Lock()
+			ack, ok := m.acks[frame.dlci]
+			m.lock.Unlock()
+			if ok {
+				select {
+				case ack <- frame.control:
+				default:
+				}
+			}
+			if frame.control == cmuxDM && frame.dlci != 0 {
+				// An unsolicited DM means the modem dropped the channel
+				if channel := m.channel(frame.dlci); channel != nil && !ok {
+					channel.shutdown(io.EOF)
+				}
+			}
+		case cmuxDISC:
+			m.send(frame.dlci, false, cmuxUA|cmuxPF, nil)
+			if frame.dlci == 0 {
+				m.shutdown(io.EOF)
+				return
+			}
+			if channel := m.channel(frame.dlci); channel != nil {
+				channel.shutdown(io.EOF)
+			}
+		case cmuxSABM:
+			// We are the initiator, the modem has no business opening channels
+			m.send(frame.dlci, false, cmuxDM|cmuxPF, nil)
+		case cmuxUIH, cmuxUI:
+			if frame.dlci == 0 {
+				if m.handleControl(frame.data) {
+					return
+				}
+				continue
+			}
+			if channel := m.channel(frame.dlci); channel != nil {
+				channel.deliver(frame.data)
+			}
+		}
+	}
+}
+
+// handleControl answers control channel messages, returns true once the modem has closed the multiplexer
+func (m *CMUX) handleControl(data []byte) bool {
+	for _, message := range cmuxControlMessages(data) {
+		msgType, value := message[0][0], message[1]
+		command := msgType&cmuxCR != 0
+		msgType &^= cmuxCR
+
+		if !command {
+			// Responses to our own MSC and CLD need no action
+			continue
+		}
+
+		switch msgType {
+		case cmuxMsgMSC:
+			if len(value) >= 2 {
+				if channel := m.channel(value[0] >> 2); channel != nil {
+					channel.setRemoteSignals(value[1])
+				}
+			}
+			m.send(0, true, cmuxUIH, cmuxControlMessage(cmuxMsgMSC, false, value))
+		case cmuxMsgTest:
+			m.send(0, true, cmuxUIH, cmuxControlMessage(cmuxMsgTest, false, value))
+		case cmuxMsgCLD:
+			m.send(0, true, cmuxUIH, cmuxControlMessage(cmuxMsgCLD, false, nil))
+			m.shutdown(io.EOF)
+			return true
+		default:
+			m.send(0, true, cmuxUIH, cmuxControlMessage(cmuxMsgNSC, false, []byte{msgType | cmuxCR}))
+		}
+	}
+	return false
+}
+
+func (m *CMUX) channel(dlci byte) *CMUXChannel {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.channels[dlci]
+}
+
+func (m *CMUX) removeChannel(dlci byte) {
+	m.lock.Lock()
+	delete(m.channels, dlci)
+	m.lock.Unlock()
+}
+
+func (m *CMUX) shutdown(err error) {
+	m.closeOnce.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		m.err = err
+		close(m.closed)
+
+		m.lock.Lock()
+		channels := []*CMUXChannel{}
+		for _, channel := range m.channels {
+			channels = append(channels, channel)
+		}
+		m.lock.Unlock()
+		for _, channel := range channels {
+			channel.shutdown(err)
+		}
+	})
+}
+
+// blockingReader turns a transport with a read timeout into a reader that waits for data,
+// bufio gives up on readers that keep returning nothing
+type blockingReader struct {
+	transport Transport
+	closed    <-chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.transport.Read(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+
+		select {
+		case <-r.closed:
+			return 0, io.EOF
+		default:
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package services
+
+import (
+	"atcli/src/types"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxQueueWait is how long a command may wait behind others before it is given up on
+const maxQueueWait = 5 * time.Minute
+
+// ErrCancelled is the error in the ATResult of a command cancelled before its final result code
+var ErrCancelled = errors.New("cancelled")
+
+// ErrTimeout is the error in the ATResult of a command the modem didn't answer in time
+var ErrTimeout = errors.New("timeout")
+
+// commandTimeouts are the defaults for commands that take longer than defaultATTimeout, the first matching prefix wins
+var commandTimeouts = []struct {
+	prefix  string
+	timeout time.Duration
+}{
+	{"AT+COPS=?", 180 * time.Second}, // Network scan
+	{"AT+COPS=", 120 * time.Second},
+	{"AT+CGACT", 150 * time.Second},
+	{"AT+CGATT", 75 * time.Second},
+	{"AT+CMGS", 60 * time.Second},
+	{"AT+CUSD", 30 * time.Second},
+	{"ATD", 60 * time.Second},
+}
+
+// commandTimeout is how long to wait for the final result code once the command is sent
+func commandTimeout(payload types.ATCommandPayload) time.Duration {
+	if payload.Timeout > 0 {
+		return payload.Timeout
+	}
+
+	upper := strings.ToUpper(strings.TrimSpace(payload.Command))
+	for _, known := range commandTimeouts {
+		if strings.HasPrefix(upper, known.prefix) {
+			return known.timeout
+		}
+	}
+	return defaultATTimeout
+}
+
+// queuedCommand is a command waiting for, or holding, the port
+type queuedCommand struct {
+	payload   types.ATCommandPayload
+	queued    time.Time
+	after     func(types.ATResult) // Runs before the next command goes out, e.g. to follow a baud rate change
+	result    chan types.ATResult
+	cancelled chan struct{}
+	cancel    sync.Once
+}
+
+// commandQueue holds the commands for one port, the worker takes the highest priority first.
+// Equal ones take turns between owners, so a client queueing a hundred commands can't starve another one.
+type commandQueue struct {
+	lock    sync.Mutex
+	waiting []*queuedCommand
+	current *queuedCommand
+	closed  bool
+	turn    uint64
+	served  map[string]uint64 // Turn each owner with commands still waiting was last served in
+	wake    chan struct{}     // Something was queued
+	changed chan struct{}     // Depth or the command in flight changed
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{
+		served:  map[string]uint64{},
+		wake:    make(chan struct{}, 1),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// poke wakes whoever waits on ch without blocking when it is already due to wake
+func poke(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the next command to send and makes it the current one, waiting is kept in arrival order so the first of the best wins
+func (q *commandQueue) pop() *queuedCommand {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	best := -1
+	for i, cmd := range q.waiting {
+		if best < 0 || q.before(cmd, q.waiting[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	cmd := q.waiting[best]
+	q.waiting = append(q.waiting[:best], q.waiting[best+1:]...)
+	q.current = cmd
+
+	// Owners with nothing left waiting are forgotten, their next command is as good as a newcomer's
+	owner := cmd.payload.OwnerID
+	delete(q.served, owner)
+	for _, waiting := range q.waiting {
+		if waiting.payload.OwnerID == owner {
+			q.turn++
+			q.served[owner] = q.turn
+			break
+		}
+	}
+	poke(q.changed)
+	return cmd
+}
+
+// before reports whether a goes ahead of b: higher priority first, then the owner served longest ago
+func (q *commandQueue) before(a, b *queuedCommand) bool {
+	if a.payload.Priority != b.payload.Priority {
+		return a.payload.Priority > b.payload.Priority
+	}
+	return q.served[a.payload.OwnerID] < q.served[b.payload.OwnerID]
+}
+
+// done clears the command in flight once its result is in
+func (q *commandQueue) done() {
+	q.lock.Lock()
+	q.current = nil
+	q.lock.Unlock()
+	poke(q.changed)
+}
+
+// status returns the depth and the command in flight
+func (q *commandQueue) status() (int, string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	inflight := ""
+	if q.current != nil {
+		inflight = q.current.payload.Command
+	}
+	return len(q.waiting), inflight
+}
+
+// owner returns who sent the command in flight, empty when idle
+func (q *commandQueue) owner() string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.current == nil {
+		return ""
+	}
+	return q.current.payload.OwnerID
+}
+
+// submit queues a command for the port, its ATResult arrives on the returned command's result channel
+func (s *SerialPort) submit(payload types.ATCommandPayload, after func(types.ATResult)) *queuedCommand {
+	if payload.ID == "" {
+		payload.ID = nextTransactionID()
+	}
+
+	cmd := &queuedCommand{
+		payload:   payload,
+		queued:    time.Now(),
+		after:     after,
+		result:    make(chan types.ATResult, 1),
+		cancelled: make(chan struct{}),
+	}
+
+	q := s.queue
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		s.fail(cmd, fmt.Errorf("%s is closed, dropping '%s'", s.portName, payload.Command))
+		return cmd
+	}
+	q.waiting = append(q.waiting, cmd)
+	q.lock.Unlock()
+
+	poke(q.wake)
+	poke(q.changed)
+	return cmd
+}
+
+// fail finishes a command that never got sent
+func (s *SerialPort) fail(cmd *queuedCommand, err error) {
+	cmd.result <- s.finishTransaction(s.newTransaction(cmd.payload), cmd.payload, err)
+}
+
+// runQueue sends the queued commands one at a time until the port is closed
+func (s *SerialPort) runQueue() {
+	q := s.queue
+	for {
+		cmd := q.pop()
+		if cmd == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-s.closed:
+				s.drainQueue()
+				return
+			}
+		}
+
+		var result types.ATResult
+		if waited := time.Since(cmd.queued); waited > maxQueueWait {
+			result = s.finishTransaction(s.newTransaction(cmd.payload), cmd.payload, fmt.Errorf("%w after %s in the queue, gave up on '%s'", ErrTimeout, waited.Round(time.Second), cmd.payload.Command))
+		} else {
+			result = s.transact(cmd)
+		}
+		if cmd.after != nil {
+			cmd.after(result)
+		}
+		q.done()
+		cmd.result <- result
+	}
+}
+
+// drainQueue fails everything still waiting once the port is closed
+func (s *SerialPort) drainQueue() {
+	q := s.queue
+	q.lock.Lock()
+	q.closed = true
+	waiting := q.waiting
+	q.waiting = nil
+	q.lock.Unlock()
+	poke(q.changed)
+
+	for _, cmd := range waiting {
+		s.fail(cmd, fmt.Errorf("%s closed before '%s' was sent", s.portName, cmd.payload.Command))
+	}
+}
+
+// Cancel drops queued commands and aborts the one in flight. An empty id cancels everything on the port.
+// Returns how many commands were cancelled.
+func (s *SerialPort) Cancel(id string) int {
+	return s.cancelWhere(func(payload types.ATCommandPayload) bool {
+		return id == "" || payload.ID == id
+	})
+}
+
+// CancelOwner cancels the commands of one owner, including those of flows it started, whose owner is owner/<flow>
+func (s *SerialPort) CancelOwner(owner string) int {
+	return s.cancelWhere(func(payload types.ATCommandPayload) bool {
+		return payload.OwnerID == owner || strings.HasPrefix(payload.OwnerID, owner+"/")
+	})
+}
+
+func (s *SerialPort) cancelWhere(match func(types.ATCommandPayload) bool) int {
+	q := s.queue
+	q.lock.Lock()
+	var dropped []*queuedCommand
+	kept := q.waiting[:0]
+	for _, cmd := range q.waiting {
+		if match(cmd.payload) {
+			dropped = append(dropped, cmd)
+		} else {
+			kept = append(kept, cmd)
+		}
+	}
+	q.waiting = kept
+
+	owners := map[string]bool{}
+	for _, cmd := range q.waiting {
+		owners[cmd.payload.OwnerID] = true
+	}
+	for owner := range q.served {
+		if !owners[owner] {
+			delete(q.served, owner)
+		}
+	}
+
+	current := q.current
+	if current != nil && !match(current.payload) {
+		current = nil
+	}
+	q.lock.Unlock()
+	poke(q.changed)
+
+	for _, cmd := range dropped {
+		s.fail(cmd, fmt.Errorf("%w '%s'", ErrCancelled, cmd.payload.Command))
+	}
+	if current != nil {
+		current.cancel.Do(func() { close(current.cancelled) })
+		return len(dropped) + 1
+	}
+	return len(dropped)
+}
+
+// Idle reports whether the port has no command queued or in flight
+func (s *SerialPort) Idle() bool {
+	depth, inflight := s.queue.status()
+	return depth == 0 && inflight == ""
+}
+
+// watchQueue tells the UI how many commands are waiting whenever that changes
+func (s *SerialPort) watchQueue() {
+	for {
+		select {
+		case <-s.queue.changed:
+		case <-s.closed:
+			return
+		}
+
+		depth, inflight := s.queue.status()
+		s.eventBus.Publish(types.Event{
+			Type:    types.EventATQueue,
+			Payload: types.ATQueueStatus{Port: s.portName, Role: s.role, Depth: depth, InFlight: inflight},
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"atcli/src/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queueTestCommand is a command as queued by owner, e.g. {"a", types.PriorityUser, "a1"}
+type queueTestCommand struct {
+	owner    string
+	priority types.ATPriority
+	command  string
+}
+
+func (q *commandQueue) push(commands ...queueTestCommand) {
+	for _, c := range commands {
+		q.waiting = append(q.waiting, &queuedCommand{
+			payload: types.ATCommandPayload{Command: c.command, OwnerID: c.owner, Priority: c.priority},
+			queued:  time.Now(),
+		})
+	}
+}
+
+// popAll takes up to n commands off the queue as the worker would, all of them when n < 0
+func (q *commandQueue) popAll(n int) []string {
+	var order []string
+	for ; n != 0; n-- {
+		cmd := q.pop()
+		if cmd == nil {
+			break
+		}
+		order = append(order, cmd.payload.Command)
+		q.done()
+	}
+	return order
+}
+
+func TestCommandQueueOrder(t *testing.T) {
+	const (
+		background = types.PriorityBackground
+		flow       = types.PriorityFlow
+		user       = types.PriorityUser
+	)
+
+	tests := []struct {
+		name   string
+		queued []queueTestCommand
+		pops   int                // Taken off before more is queued
+		more   []queueTestCommand // Queued after the first pops
+		want   []string
+	}{
+		{
+			name:   "higher priority first",
+			queued: []queueTestCommand{{"poll", background, "AT+CSQ"}, {"flow", flow, "AT+COPS?"}, {"user", user, "ATI"}},
+			want:   []string{"ATI", "AT+COPS?", "AT+CSQ"},
+		},
+		{
+			name:   "one owner in the order queued",
+			queued: []queueTestCommand{{"a", user, "a1"}, {"a", user, "a2"}, {"a", user, "a3"}},
+			want:   []string{"a1", "a2", "a3"},
+		},
+		{
+			name:   "owners of equal priority take turns",
+			queued: []queueTestCommand{{"a", flow, "a1"}, {"a", flow, "a2"}, {"a", flow, "a3"}, {"b", flow, "b1"}, {"b", flow, "b2"}},
+			want:   []string{"a1", "b1", "a2", "b2", "a3"},
+		},
+		{
+			name:   "a newcomer goes before the next of a busy owner",
+			queued: []queueTestCommand{{"a", flow, "a1"}, {"a", flow, "a2"}, {"a", flow, "a3"}},
+			pops:   2,
+			more:   []queueTestCommand{{"b", flow, "b1"}},
+			want:   []string{"a1", "a2", "b1", "a3"},
+		},
+		{
+			name:   "three owners round robin",
+			queued: []queueTestCommand{{"a", flow, "a1"}, {"a", flow, "a2"}, {"b", flow, "b1"}, {"b", flow, "b2"}, {"c", flow, "c1"}, {"c", flow, "c2"}},
+			want:   []string{"a1", "b1", "c1", "a2", "b2", "c2"},
+		},
+		{
+			name:   "priority goes before fairness",
+			queued: []queueTestCommand{{"a", user, "a1"}, {"a", user, "a2"}, {"b", background, "b1"}, {"a", user, "a3"}},
+			want:   []string{"a1", "a2", "a3", "b1"},
+		},
+		{
+			name:   "an owner that ran dry starts afresh",
+			queued: []queueTestCommand{{"a", flow, "a1"}, {"b", flow, "b1"}, {"b", flow, "b2"}, {"b", flow, "b3"}},
+			pops:   2,
+			more:   []queueTestCommand{{"a", flow, "a2"}},
+			want:   []string{"a1", "b1", "a2", "b2", "b3"},
+		},
+		{
+			name:   "a user command overtakes a running flow",
+			queued: []queueTestCommand{{"flow", flow, "f1"}, {"flow", flow, "f2"}, {"poll", background, "AT+CSQ"}},
+			pops:   1,
+			more:   []queueTestCommand{{"user", user, "ATI"}},
+			want:   []string{"f1", "ATI", "f2", "AT+CSQ"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newCommandQueue()
+			q.push(test.queued...)
+
+			order := []string{}
+			if test.more != nil {
+				order = append(order, q.popAll(test.pops)...)
+				q.push(test.more...)
+			}
+			order = append(order, q.popAll(-1)...)
+
+			if !reflect.DeepEqual(order, test.want) {
+				t.Errorf("sent %q, want %q", order, test.want)
+			}
+			if len(q.served) != 0 {
+				t.Errorf("owners %v still remembered with nothing waiting", q.served)
+			}
+		})
+	}
+}
+
+func TestCommandQueueCancelOwner(t *testing.T) {
+	s := &SerialPort{portName: "test", eventBus: NewEventBus(), queue: newCommandQueue()}
+	q := s.queue
+	q.push(
+		queueTestCommand{"http", types.PriorityFlow, "h1"},
+		queueTestCommand{"http/flow-1", types.PriorityFlow, "h2"},
+		queueTestCommand{"mqtt", types.PriorityFlow, "m1"},
+		queueTestCommand{"http", types.PriorityFlow, "h3"},
+		queueTestCommand{"httpd", types.PriorityFlow, "d1"},
+	)
+	results := []chan types.ATResult{}
+	for _, cmd := range q.waiting {
+		cmd.result = make(chan types.ATResult, 1)
+		results = append(results, cmd.result)
+	}
+	q.popAll(1)
+
+	if n := s.CancelOwner("http"); n != 2 {
+		t.Errorf("cancelled %d commands, want 2", n)
+	}
+	for i, want := range []bool{false, true, false, true, false} {
+		select {
+		case result := <-results[i]:
+			if !want {
+				t.Errorf("%s finished with %v", result.Command, result.Err)
+			}
+		default:
+			if want {
+				t.Errorf("command %d wasn't cancelled", i+1)
+			}
+		}
+	}
+	if order := q.popAll(-1); !reflect.DeepEqual(order, []string{"m1", "d1"}) {
+		t.Errorf("sent %q after the cancel, want m1 and d1", order)
+	}
+}
@@ -0,0 +1,382 @@
+package services
+
+import (
+	"atcli/src/types"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// daemonClientBuffer is how many records a client may fall behind before the daemon drops it
+const daemonClientBuffer = 1024
+
+// DaemonRequest is a line a client sends to the daemon, one JSON object per line. Type says which fields count:
+//
+//	command       Command, ID, Role, Priority (user, flow or background, default user), TimeoutMS, Body
+//	flow          Flow
+//	run           Path, Vars, the file is read by the daemon so Path must be absolute
+//	prompt_reply  Role, Text, Abort
+//	cancel        ID, empty cancels everything the client queued
+//	modem_line    Line, Action, PulseMS, Role
+//	baud          Rate
+type DaemonRequest struct {
+	Type      string            `json:"type"`
+	ID        string            `json:"id,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Role      types.PortRole    `json:"role,omitempty"`
+	Priority  string            `json:"priority,omitempty"`
+	TimeoutMS int64             `json:"timeout_ms,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Flow      *types.ATFlow     `json:"flow,omitempty"`
+	Path      string            `json:"path,omitempty"`
+	Vars      map[string]string `json:"vars,omitempty"`
+	Text      string            `json:"text,omitempty"`
+	Abort     bool              `json:"abort,omitempty"`
+	Line      string            `json:"line,omitempty"`
+	Action    string            `json:"action,omitempty"`
+	PulseMS   int64             `json:"pulse_ms,omitempty"`
+	Rate      int               `json:"rate,omitempty"`
+}
+
+// DaemonHello is the first line the daemon sends to a client
+type DaemonHello struct {
+	Type     string `json:"type"`   // Always "hello"
+	Client   string `json:"client"` // The daemon puts client/ in front of the IDs of the client's commands and flows
+	Port     string `json:"port"`
+	LineMode string `json:"line_mode"`
+}
+
+var daemonPriorities = map[string]types.ATPriority{
+	"":           types.PriorityUser,
+	"user":       types.PriorityUser,
+	"flow":       types.PriorityFlow,
+	"background": types.PriorityBackground,
+}
+
+// Daemon shares the ports of one process with clients on a socket. Every client sees the traffic of all
+// of them as NDJSON records, the same ones --output ndjson prints, and their commands take turns in the queue.
+type Daemon struct {
+	eventBus *EventBus
+	ports    []*SerialPort
+	counter  atomic.Uint64
+
+	lock     sync.Mutex
+	clients  map[string]*daemonClient
+	listener net.Listener
+}
+
+// daemonClient is one connection to the daemon
+type daemonClient struct {
+	id      string
+	conn    net.Conn
+	out     chan any
+	closed  chan struct{}
+	closing sync.Once
+}
+
+// NewDaemon creates a daemon for ports, ports[0] is the main AT port
+func NewDaemon(eventBus *EventBus, ports []*SerialPort) *Daemon {
+	d := &Daemon{
+		eventBus: eventBus,
+		ports:    ports,
+		clients:  map[string]*daemonClient{},
+	}
+
+	TopicSerialResponse.Subscribe(eventBus, func(line types.SerialLine) {
+		if line.Text != "" {
+			d.broadcast(NewLineRecord(line))
+		}
+	})
+	eventBus.Subscribe(types.EventATResult, func(event types.Event) {
+		if result, ok := event.Payload.(types.ATResult); ok {
+			d.broadcast(NewTransactionRecord(result))
+		}
+	})
+	TopicURC.Subscribe(eventBus, func(line types.SerialLine) {
+		d.broadcast(NewURCRecord(line))
+	})
+	TopicPrompt.Subscribe(eventBus, d.handlePrompt)
+	eventBus.Subscribe(types.EventATQueue, func(event types.Event) {
+		if status, ok := event.Payload.(types.ATQueueStatus); ok {
+			d.broadcast(NewQueueRecord(status))
+		}
+	})
+	TopicSerialError.Subscribe(eventBus, func(err error) {
+		d.broadcast(NewErrorRecord(err))
+	})
+	eventBus.Subscribe(types.EventConnectionState, func(event types.Event) {
+		if status, ok := event.Payload.(types.ConnectionStatus); ok {
+			d.broadcast(NewStateRecord(status))
+		}
+	})
+	eventBus.Subscribe(types.EventModemLines, func(event types.Event) {
+		if lines, ok := event.Payload.(types.ModemLines); ok {
+			d.broadcast(NewModemLinesRecord(lines))
+		}
+	})
+	eventBus.Subscribe(types.EventLineModeChanged, func(event types.Event) {
+		if mode, ok := event.Payload.(types.LineMode); ok {
+			d.broadcast(NewLineModeRecord(mode))
+		}
+	})
+	eventBus.Subscribe(types.EventATFlowStep, func(event types.Event) {
+		if progress, ok := event.Payload.(types.ATFlowProgress); ok {
+			d.broadcast(NewStepRecord(progress))
+		}
+	})
+	eventBus.Subscribe(types.EventATFlowResult, func(event types.Event) {
+		if result, ok := event.Payload.(types.ATFlowResult); ok {
+			d.broadcast(NewFlowRecord(result))
+		}
+	})
+
+	return d
+}
+
+// Serve accepts clients until Close, it returns net.ErrClosed then
+func (d *Daemon) Serve(listener net.Listener) error {
+	d.lock.Lock()
+	d.listener = listener
+	d.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go d.serveClient(conn)
+	}
+}
+
+// Close stops accepting clients and disconnects the ones attached
+func (d *Daemon) Close() {
+	d.lock.Lock()
+	listener := d.listener
+	clients := make([]*daemonClient, 0, len(d.clients))
+	for _, client := range d.clients {
+		clients = append(clients, client)
+	}
+	d.lock.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	for _, client := range clients {
+		client.close()
+	}
+}
+
+func (d *Daemon) serveClient(conn net.Conn) {
+	client := &daemonClient{
+		id:     fmt.Sprintf("client-%d", d.counter.Add(1)),
+		conn:   conn,
+		out:    make(chan any, daemonClientBuffer),
+		closed: make(chan struct{}),
+	}
+	go client.write()
+
+	// The client learns who it is and the state of the ports before any traffic
+	at := d.ports[0]
+	client.send(DaemonHello{Type: "hello", Client: client.id, Port: at.PortName(), LineMode: at.LineConfig().String()})
+	for _, port := range d.ports {
+		depth, inflight := port.queue.status()
+		client.send(NewQueueRecord(types.ATQueueStatus{Port: port.portName, Role: port.role, Depth: depth, InFlight: inflight}))
+		client.send(NewModemLinesRecord(port.ModemLines()))
+	}
+
+	d.lock.Lock()
+	d.clients[client.id] = client
+	d.lock.Unlock()
+	LogMessage(fmt.Sprintf("%s attached", client.id))
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var request DaemonRequest
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			client.send(NewErrorRecord(fmt.Errorf("invalid request: %w", err)))
+			continue
+		}
+		if err := d.handleRequest(client, request); err != nil {
+			client.send(NewErrorRecord(err))
+		}
+	}
+
+	d.lock.Lock()
+	delete(d.clients, client.id)
+	d.lock.Unlock()
+	client.close()
+
+	// Nobody is waiting for the answers any more
+	cancelled := 0
+	for _, port := range d.ports {
+		cancelled += port.CancelOwner(client.id)
+	}
+	LogMessage(fmt.Sprintf("%s detached, %d command(s) cancelled", client.id, cancelled))
+}
+
+// handleRequest publishes what the client asked for on the daemon's event bus, as the UI would
+func (d *Daemon) handleRequest(client *daemonClient, request DaemonRequest) error {
+	switch request.Type {
+	case "command":
+		priority, ok := daemonPriorities[request.Priority]
+		if !ok {
+			return fmt.Errorf("invalid priority %q, expected user, flow or background", request.Priority)
+		}
+		id := request.ID
+		if id == "" {
+			id = nextTransactionID()
+		}
+		d.eventBus.Publish(types.Event{
+			Type: types.EventATModemCommand,
+			Payload: types.ATCommandPayload{
+				Command:  request.Command,
+				OwnerID:  client.id,
+				Role:     request.Role,
+				ID:       client.scope(id),
+				Priority: priority,
+				Timeout:  time.Duration(request.TimeoutMS) * time.Millisecond,
+				Body:     request.Body,
+			},
+		})
+
+	case "flow", "run":
+		var flow types.ATFlow
+		if request.Type == "run" {
+			// Relative to the daemon's working directory would rarely be what the client meant
+			if !filepath.IsAbs(request.Path) {
+				return fmt.Errorf("run needs an absolute path, got %q, or send the flow itself in a flow request", request.Path)
+			}
+			var err error
+			if flow, err = LoadFlowScript(request.Path, request.Vars); err != nil {
+				return err
+			}
+		} else {
+			if request.Flow == nil {
+				return fmt.Errorf("flow request without a flow")
+			}
+			flow = *request.Flow
+		}
+		if flow.ID == "" {
+			flow.ID = fmt.Sprintf("flow-%d", flowCounter.Add(1))
+		}
+		flow.ID = client.scope(flow.ID)
+		d.eventBus.Publish(types.Event{Type: types.EventATModemFlow, Payload: flow})
+
+	case "prompt_reply":
+		d.eventBus.Publish(types.Event{
+			Type:    types.EventPromptReply,
+			Payload: types.PromptReply{Role: request.Role, Text: request.Text, Abort: request.Abort},
+		})
+
+	case "cancel":
+		if request.ID != "" {
+			d.eventBus.Publish(types.Event{Type: types.EventCancelAT, Payload: client.scope(request.ID)})
+			break
+		}
+		for _, port := range d.ports {
+			port.CancelOwner(client.id)
+		}
+
+	case "modem_line":
+		d.eventBus.Publish(types.Event{
+			Type: types.EventSetModemLine,
+			Payload: types.ModemLineRequest{
+				Line:   request.Line,
+				Action: request.Action,
+				Pulse:  time.Duration(request.PulseMS) * time.Millisecond,
+				Role:   request.Role,
+			},
+		})
+
+	case "baud":
+		d.eventBus.Publish(types.Event{Type: types.EventChangeBaudRate, Payload: request.Rate})
+
+	default:
+		return fmt.Errorf("unknown request type %q", request.Type)
+	}
+	return nil
+}
+
+// handlePrompt sends a > prompt to the client whose command opened it, or to everyone when it isn't a client's
+func (d *Daemon) handlePrompt(prompt types.Prompt) {
+	owner := ""
+	for _, port := range d.ports {
+		if port.portName == prompt.Port {
+			owner, _, _ = strings.Cut(port.queue.owner(), "/")
+		}
+	}
+
+	d.lock.Lock()
+	client := d.clients[owner]
+	d.lock.Unlock()
+
+	if client == nil {
+		d.broadcast(NewPromptRecord(prompt))
+		return
+	}
+	client.send(NewPromptRecord(prompt))
+}
+
+// broadcast sends a record to every client
+func (d *Daemon) broadcast(record any) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, client := range d.clients {
+		client.send(record)
+	}
+}
+
+// scope puts the client's ID in front of an ID it gave, so IDs from different clients never clash
+func (c *daemonClient) scope(id string) string {
+	if strings.HasPrefix(id, c.id+"/") {
+		return id
+	}
+	return c.id + "/" + id
+}
+
+// send queues a record for the client, a client that falls too far behind is dropped rather than holding up the port
+func (c *daemonClient) send(record any) {
+	select {
+	case c.out <- record:
+	case <-c.closed:
+	default:
+		// This runs inside event handlers, logging from here would publish from inside a publish
+		go LogMessage(fmt.Sprintf("[yellow]%s is not keeping up, disconnecting it[white]", c.id))
+		c.close()
+	}
+}
+
+func (c *daemonClient) write() {
+	encoder := json.NewEncoder(c.conn)
+	for {
+		select {
+		case record := <-c.out:
+			if err := encoder.Encode(record); err != nil {
+				c.close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *daemonClient) close() {
+	c.closing.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
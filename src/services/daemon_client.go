@@ -0,0 +1,338 @@
+package services
+
+import (
+	"atcli/src/types"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// priorityNames are the priorities as DaemonRequest spells them
+var priorityNames = map[types.ATPriority]string{
+	types.PriorityUser:       "user",
+	types.PriorityFlow:       "flow",
+	types.PriorityBackground: "background",
+}
+
+// DaemonClient stands in for the ports when attached to a daemon. Commands, flows and prompt replies published
+// on the event bus go to the daemon, and what happens on its ports comes back as the events the views know.
+type DaemonClient struct {
+	eventBus *EventBus
+	conn     net.Conn
+	hello    DaemonHello
+
+	writeLock sync.Mutex
+	encoder   *json.Encoder
+
+	lock     sync.Mutex
+	commands map[string]chan<- types.ATResult     // Our commands waiting for their result, by the ID the daemon gave them
+	flows    map[string]chan<- types.ATFlowResult // Our flows still running, the same way
+
+	closed  chan struct{}
+	closing sync.Once
+}
+
+// DialDaemon connects to the daemon listening on socket
+func DialDaemon(eventBus *EventBus, socket string) (*DaemonClient, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("no daemon on %s: %w", socket, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no greeting from the daemon on %s: %w", socket, err)
+	}
+	var hello DaemonHello
+	if err := json.Unmarshal(line, &hello); err != nil || hello.Type != "hello" {
+		conn.Close()
+		return nil, fmt.Errorf("%s is not an atcli daemon", socket)
+	}
+
+	c := &DaemonClient{
+		eventBus: eventBus,
+		conn:     conn,
+		hello:    hello,
+		encoder:  json.NewEncoder(conn),
+		commands: map[string]chan<- types.ATResult{},
+		flows:    map[string]chan<- types.ATFlowResult{},
+		closed:   make(chan struct{}),
+	}
+
+	eventBus.Subscribe(types.EventATModemCommand, c.handleCommand)
+	eventBus.Subscribe(types.EventATModemFlow, c.handleFlow)
+	eventBus.Subscribe(types.EventPromptReply, func(event types.Event) {
+		if reply, ok := event.Payload.(types.PromptReply); ok {
+			c.request(DaemonRequest{Type: "prompt_reply", Role: reply.Role, Text: reply.Text, Abort: reply.Abort})
+		}
+	})
+	eventBus.Subscribe(types.EventCancelAT, func(event types.Event) {
+		id, _ := event.Payload.(string)
+		c.request(DaemonRequest{Type: "cancel", ID: id})
+	})
+	eventBus.Subscribe(types.EventSetModemLine, func(event types.Event) {
+		if request, ok := event.Payload.(types.ModemLineRequest); ok {
+			c.request(DaemonRequest{
+				Type:    "modem_line",
+				Line:    request.Line,
+				Action:  request.Action,
+				PulseMS: request.Pulse.Milliseconds(),
+				Role:    request.Role,
+			})
+		}
+	})
+	eventBus.Subscribe(types.EventChangeBaudRate, func(event types.Event) {
+		if rate, ok := event.Payload.(int); ok {
+			c.request(DaemonRequest{Type: "baud", Rate: rate})
+		}
+	})
+
+	go c.read(reader)
+
+	return c, nil
+}
+
+// ID is the name the daemon knows this client by
+func (c *DaemonClient) ID() string {
+	return c.hello.Client
+}
+
+// PortName returns the daemon's main AT port
+func (c *DaemonClient) PortName() string {
+	return c.hello.Port
+}
+
+// LineMode returns the line settings of the daemon's main AT port when we attached
+func (c *DaemonClient) LineMode() string {
+	return c.hello.LineMode
+}
+
+// Idle reports whether none of our commands and flows are still waiting for their result
+func (c *DaemonClient) Idle() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.commands) == 0 && len(c.flows) == 0
+}
+
+// Close detaches from the daemon, it cancels whatever we still had queued
+func (c *DaemonClient) Close() {
+	c.closing.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+func (c *DaemonClient) handleCommand(event types.Event) {
+	payload, ok := event.Payload.(types.ATCommandPayload)
+	if !ok {
+		// fallback for legacy string payloads, as SerialPort.Write takes them
+		command, ok := event.Payload.(string)
+		if !ok {
+			return
+		}
+		payload = types.ATCommandPayload{Command: command, Priority: types.PriorityUser}
+	}
+	if payload.ID == "" {
+		payload.ID = nextTransactionID()
+	}
+
+	c.lock.Lock()
+	c.commands[c.scope(payload.ID)] = payload.Result
+	c.lock.Unlock()
+
+	c.request(DaemonRequest{
+		Type:      "command",
+		ID:        payload.ID,
+		Command:   payload.Command,
+		Role:      payload.Role,
+		Priority:  priorityNames[payload.Priority],
+		TimeoutMS: payload.Timeout.Milliseconds(),
+		Body:      payload.Body,
+	})
+}
+
+func (c *DaemonClient) handleFlow(event types.Event) {
+	var flow types.ATFlow
+	switch payload := event.Payload.(type) {
+	case types.ATFlow:
+		flow = payload
+	case []types.ATFlowStep:
+		flow = types.ATFlow{Steps: payload}
+	default:
+		return
+	}
+	if flow.ID == "" {
+		flow.ID = fmt.Sprintf("flow-%d", flowCounter.Add(1))
+	}
+
+	c.lock.Lock()
+	c.flows[c.scope(flow.ID)] = flow.Result
+	c.lock.Unlock()
+
+	c.request(DaemonRequest{Type: "flow", Flow: &flow})
+}
+
+// scope is the ID the daemon gives one of ours
+func (c *DaemonClient) scope(id string) string {
+	return c.hello.Client + "/" + id
+}
+
+// request sends a request to the daemon. It runs inside event handlers, so failures are reported from a goroutine.
+func (c *DaemonClient) request(request DaemonRequest) {
+	c.writeLock.Lock()
+	err := c.encoder.Encode(request)
+	c.writeLock.Unlock()
+
+	if err != nil {
+		go TopicSerialError.Publish(c.eventBus, fmt.Errorf("cannot reach the daemon: %w", err))
+	}
+}
+
+// read turns the daemon's records back into events until the connection ends
+func (c *DaemonClient) read(reader *bufio.Reader) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		c.dispatch(scanner.Bytes())
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = errors.New("the daemon closed the connection")
+	}
+	c.lost(err)
+}
+
+func (c *DaemonClient) dispatch(data []byte) {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(data, &header) != nil {
+		return
+	}
+
+	// Records this version doesn't know are skipped, the daemon may be newer
+	switch header.Type {
+	case "line":
+		var record LineRecord
+		if json.Unmarshal(data, &record) == nil {
+			TopicSerialResponse.Publish(c.eventBus, types.SerialLine{Port: record.Port, Role: record.Role, Text: record.Text})
+		}
+	case "transaction":
+		var record TransactionRecord
+		if json.Unmarshal(data, &record) != nil {
+			return
+		}
+		result := record.ATResult()
+		c.publish(types.EventATResult, result)
+
+		c.lock.Lock()
+		waiting, ours := c.commands[result.ID]
+		delete(c.commands, result.ID)
+		c.lock.Unlock()
+		if ours && waiting != nil {
+			select {
+			case waiting <- result:
+			default:
+			}
+		}
+	case "urc":
+		var record URCRecord
+		if json.Unmarshal(data, &record) == nil {
+			TopicURC.Publish(c.eventBus, types.SerialLine{Port: record.Port, Role: record.Role, Text: record.Text})
+		}
+	case "prompt":
+		var record PromptRecord
+		if json.Unmarshal(data, &record) == nil {
+			TopicPrompt.Publish(c.eventBus, types.Prompt{ID: record.ID, Port: record.Port, Role: record.Role})
+		}
+	case "queue":
+		var record QueueRecord
+		if json.Unmarshal(data, &record) == nil {
+			c.publish(types.EventATQueue, types.ATQueueStatus{Port: record.Port, Role: record.Role, Depth: record.Depth, InFlight: record.InFlight})
+		}
+	case "error":
+		var record ErrorRecord
+		if json.Unmarshal(data, &record) == nil {
+			TopicSerialError.Publish(c.eventBus, errors.New(record.Error))
+		}
+	case "state":
+		var record StateRecord
+		if json.Unmarshal(data, &record) == nil {
+			c.publish(types.EventConnectionState, record.ConnectionStatus())
+		}
+	case "modem_lines":
+		var record ModemLinesRecord
+		if json.Unmarshal(data, &record) == nil {
+			c.publish(types.EventModemLines, record.ModemLines())
+		}
+	case "line_mode":
+		var record LineModeRecord
+		if json.Unmarshal(data, &record) == nil {
+			c.publish(types.EventLineModeChanged, types.LineMode{Port: record.Port, Role: record.Role, Mode: record.Mode})
+		}
+	case "step":
+		var record StepRecord
+		if json.Unmarshal(data, &record) == nil {
+			c.publish(types.EventATFlowStep, record.ATFlowProgress())
+		}
+	case "flow":
+		var record FlowRecord
+		if json.Unmarshal(data, &record) != nil {
+			return
+		}
+		result := record.ATFlowResult()
+		c.publish(types.EventATFlowResult, result)
+
+		c.lock.Lock()
+		waiting, ours := c.flows[result.ID]
+		delete(c.flows, result.ID)
+		c.lock.Unlock()
+		if ours && waiting != nil {
+			select {
+			case waiting <- result:
+			default:
+			}
+		}
+	}
+}
+
+func (c *DaemonClient) publish(eventType types.EventType, payload interface{}) {
+	c.eventBus.Publish(types.Event{Type: eventType, Payload: payload})
+}
+
+// lost fails everything still waiting on the daemon, unless we hung up ourselves
+func (c *DaemonClient) lost(err error) {
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	c.lock.Lock()
+	commands, flows := c.commands, c.flows
+	c.commands = map[string]chan<- types.ATResult{}
+	c.flows = map[string]chan<- types.ATFlowResult{}
+	c.lock.Unlock()
+
+	for id, waiting := range commands {
+		select {
+		case waiting <- types.ATResult{ID: id, Port: c.hello.Port, Err: err}:
+		default:
+		}
+	}
+	for id, waiting := range flows {
+		select {
+		case waiting <- types.ATFlowResult{ID: id, Err: err}:
+		default:
+		}
+	}
+
+	c.publish(types.EventConnectionState, types.ConnectionStatus{Port: c.hello.Port, Role: types.RoleAT, State: types.ConnectionLost, Err: err})
+	TopicSerialError.Publish(c.eventBus, err)
+}
@@ -2,51 +2,306 @@ package services
 
 import (
 	"atcli/src/types"
-	"reflect"
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// OverflowPolicy is what a queued subscription does with an event when its queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the publisher wait for room in the queue
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the event being published
+	OverflowDropNewest
+	// OverflowDropOldest drops the longest waiting event to make room
+	OverflowDropOldest
+)
+
+// SubscribeOptions are how a subscription gets its events. The zero value calls the handler from inside
+// Publish, a Queue hands the events to a goroutine of the subscription's own, so a slow handler doesn't hold up
+// the publisher, e.g. the serial reader.
+type SubscribeOptions struct {
+	Queue    int // Events that may wait for the handler, 0 to call it from inside Publish
+	Overflow OverflowPolicy
+}
+
 // EventBus manages event subscriptions and publishing
 type EventBus struct {
-	subscribers map[types.EventType][]types.EventHandlerFunc
+	subscribers map[types.EventType][]*Subscription
+	taps        []*EventTap
 	lock        sync.RWMutex
+	nextID      uint64
+	closed      bool
+	published   atomic.Uint64
+}
+
+// Subscription is a handler subscribed to an event type, it is how the handler is unsubscribed again
+type Subscription struct {
+	id        uint64
+	eventType types.EventType
+	name      string // Of the handler, for the traces of taps
+	handler   types.EventHandlerFunc
+	eventBus  *EventBus
+
+	queue    chan types.Event
+	overflow OverflowPolicy
+	dropped  atomic.Uint64
+	stop     chan struct{}
+	stopping sync.Once
+	drain    atomic.Bool   // Set by Close, the queue is emptied before the goroutine returns
+	done     chan struct{} // Closed when the goroutine returned
 }
 
 // NewEventBus creates a new event bus
 func NewEventBus() *EventBus {
 	return &EventBus{
-		subscribers: make(map[types.EventType][]types.EventHandlerFunc),
+		subscribers: make(map[types.EventType][]*Subscription),
 	}
 }
 
-// Subscribe registers a handler for a specific event type
-func (b *EventBus) Subscribe(eventType types.EventType, handler types.EventHandlerFunc) {
+// Subscribe registers a handler for a specific event type, it is called from inside Publish
+func (b *EventBus) Subscribe(eventType types.EventType, handler types.EventHandlerFunc) *Subscription {
+	return b.SubscribeWith(eventType, handler, SubscribeOptions{})
+}
+
+// SubscribeWith registers a handler for a specific event type, delivered as opts says
+func (b *EventBus) SubscribeWith(eventType types.EventType, handler types.EventHandlerFunc, opts SubscribeOptions) *Subscription {
+	return b.subscribe(eventType, handlerName(handler), handler, opts)
+}
+
+// subscribe registers handler under name, the function a topic wraps rather than its wrapper
+func (b *EventBus) subscribe(eventType types.EventType, name string, handler types.EventHandlerFunc, opts SubscribeOptions) *Subscription {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.subscribers[eventType] = append(b.subscribers[eventType], handler)
+	b.nextID++
+	s := &Subscription{
+		id:        b.nextID,
+		eventType: eventType,
+		name:      name,
+		handler:   handler,
+		eventBus:  b,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if b.closed {
+		// Nothing is published any more, there's nothing to deliver
+		s.stopping.Do(func() { close(s.stop) })
+		close(s.done)
+		return s
+	}
+
+	if opts.Queue > 0 {
+		s.queue = make(chan types.Event, opts.Queue)
+		s.overflow = opts.Overflow
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	// Publish works on the slice it got without the lock, it is replaced rather than changed
+	subscribers := b.subscribers[eventType]
+	b.subscribers[eventType] = append(subscribers[:len(subscribers):len(subscribers)], s)
+	return s
 }
 
-// Unsubscribe removes a handler for a specific event type
-func (b *EventBus) Unsubscribe(eventType types.EventType, handler types.EventHandlerFunc) {
+// Unsubscribe removes the handler of a subscription. A Publish already under way may still call it,
+// events still waiting in its queue are dropped.
+func (b *EventBus) Unsubscribe(s *Subscription) {
+	if s == nil || s.eventBus != b {
+		return
+	}
+
 	b.lock.Lock()
-	defer b.lock.Unlock()
-	handlers := b.subscribers[eventType]
-	for i, h := range handlers {
-		if reflect.ValueOf(h).Pointer() == reflect.ValueOf(handler).Pointer() {
-			b.subscribers[eventType] = append(handlers[:i], handlers[i+1:]...)
+	subscribers := b.subscribers[s.eventType]
+	for i, subscriber := range subscribers {
+		if subscriber == s {
+			kept := make([]*Subscription, 0, len(subscribers)-1)
+			kept = append(kept, subscribers[:i]...)
+			b.subscribers[s.eventType] = append(kept, subscribers[i+1:]...)
 			break
 		}
 	}
+	b.lock.Unlock()
+
+	s.stopping.Do(func() { close(s.stop) })
 }
 
-// Publish sends an event to all subscribers
+// Publish sends an event to all subscribers. Handlers without a queue are called one after another before
+// it returns, without any lock held, so they may publish and subscribe themselves.
 func (b *EventBus) Publish(event types.Event) {
 	b.lock.RLock()
-	handlers := b.subscribers[event.Type]
-	defer b.lock.RUnlock()
+	subscribers := b.subscribers[event.Type]
+	taps := b.taps
+	closed := b.closed
+	b.lock.RUnlock()
+
+	if closed {
+		return
+	}
+	if len(taps) == 0 {
+		deliver(subscribers, event)
+		return
+	}
+
+	trace := EventTrace{
+		Seq:       b.published.Add(1),
+		Event:     event,
+		Publisher: publisher(),
+		Time:      time.Now(),
+		Handlers:  make([]HandlerTrace, 0, len(subscribers)),
+	}
+	for _, s := range subscribers {
+		handler := HandlerTrace{Name: s.name, Queued: s.queue != nil}
+		start := time.Now()
+		deliver([]*Subscription{s}, event)
+		handler.Duration = time.Since(start)
+
+		if handler.Queued {
+			trace.Queued++
+		}
+		trace.Handlers = append(trace.Handlers, handler)
+	}
+	trace.Duration = time.Since(trace.Time)
+
+	for _, tap := range taps {
+		tap.call(trace)
+	}
+}
 
-	for _, handler := range handlers {
-		handler(event)
+// deliver calls the handlers without a queue and queues the event for the others
+func deliver(subscribers []*Subscription, event types.Event) {
+	for _, s := range subscribers {
+		if s.queue != nil {
+			s.enqueue(event)
+		} else {
+			s.call(event)
+		}
+	}
+}
+
+// Close stops publishing, lets the queued subscriptions handle what they have waiting and waits for them
+// until ctx is done. A handler still running when ctx is done is left to finish by itself.
+func (b *EventBus) Close(ctx context.Context) error {
+	b.lock.Lock()
+	b.closed = true
+	var subscriptions []*Subscription
+	for _, subscribers := range b.subscribers {
+		subscriptions = append(subscriptions, subscribers...)
+	}
+	b.subscribers = make(map[types.EventType][]*Subscription)
+	b.taps = nil
+	b.lock.Unlock()
+
+	for _, s := range subscriptions {
+		s.drain.Store(true)
+		s.stopping.Do(func() { close(s.stop) })
+	}
+	for _, s := range subscriptions {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ID tells subscriptions apart, it is unique for the bus
+func (s *Subscription) ID() uint64 {
+	return s.id
+}
+
+// Dropped counts the events the subscription's queue had no room for
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Unsubscribe removes the handler from the bus
+func (s *Subscription) Unsubscribe() {
+	s.eventBus.Unsubscribe(s)
+}
+
+func (s *Subscription) enqueue(event types.Event) {
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+
+	switch s.overflow {
+	case OverflowDropNewest:
+		select {
+		case s.queue <- event:
+		default:
+			s.dropped.Add(1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.queue <- event:
+				return
+			default:
+			}
+			// The handler may have taken it in the meantime, then there's room without dropping anything
+			select {
+			case <-s.queue:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.queue <- event:
+		case <-s.stop:
+		}
+	}
+}
+
+// run calls the handler with the queued events until the subscription is stopped
+func (s *Subscription) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case event := <-s.queue:
+			s.call(event)
+		case <-s.stop:
+			if !s.drain.Load() {
+				return
+			}
+			for {
+				select {
+				case event := <-s.queue:
+					s.call(event)
+				default:
+					return
+				}
+			}
+		}
 	}
 }
+
+// call runs the handler, a panic in it is reported rather than taking the publisher down with it
+func (s *Subscription) call(event types.Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			message := fmt.Sprintf("Handler %d of %s panicked: %v", s.id, event.Type, r)
+			if event.Type == types.EventLogMessage {
+				// Logging it would only run into the same handler again
+				fmt.Fprintf(os.Stderr, "%s\n%s", message, debug.Stack())
+				return
+			}
+			// Published from a goroutine, as the panic may have come from inside LogMessage
+			go LogMessage("[red]" + message + "[white]")
+		}
+	}()
+
+	s.handler(event)
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"atcli/src/types"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxSummary is how long a payload summary may get before it is cut short
+const maxSummary = 120
+
+// EventTrace is what a tap sees of one Publish
+type EventTrace struct {
+	Seq       uint64 // Publish order, a handler's events are traced before the event that it handled
+	Event     types.Event
+	Publisher string         // Function that called Publish, e.g. services.(*ModemMonitor).parseCSQ
+	Time      time.Time      // When it was published
+	Handlers  []HandlerTrace // Subscribers it went to, in the order they got it
+	Queued    int            // Of those, how many got it in their queue rather than from inside Publish
+	Duration  time.Duration  // Delivery to all of them, the handlers called from inside Publish included
+}
+
+// HandlerTrace is how one subscriber took an event
+type HandlerTrace struct {
+	Name     string        // Handler function, e.g. views.(*ReplyView).SerialResponse
+	Queued   bool          // The event went in its queue, the handler runs later on its own goroutine
+	Duration time.Duration // How long the handler ran from inside Publish, or queueing the event took
+}
+
+// EventTap sees every event published on a bus, after its handlers
+type EventTap struct {
+	eventBus *EventBus
+	handler  func(EventTrace)
+}
+
+// Tap calls handler with a trace of every event published from now on, from inside Publish once the handlers
+// without a queue returned. It is for debugging, handler should be quick and must not publish itself.
+func (b *EventBus) Tap(handler func(EventTrace)) *EventTap {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	t := &EventTap{eventBus: b, handler: handler}
+	b.taps = append(b.taps[:len(b.taps):len(b.taps)], t)
+	return t
+}
+
+// Remove stops the tap
+func (t *EventTap) Remove() {
+	b := t.eventBus
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i, tap := range b.taps {
+		if tap == t {
+			kept := make([]*EventTap, 0, len(b.taps)-1)
+			kept = append(kept, b.taps[:i]...)
+			b.taps = append(kept, b.taps[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *EventTap) call(trace EventTrace) {
+	defer func() {
+		if r := recover(); r != nil {
+			go LogMessage(fmt.Sprintf("[red]Event tap panicked on %s: %v[white]", trace.Event.Type, r))
+		}
+	}()
+
+	t.handler(trace)
+}
+
+// handlerName names a handler function, e.g. views.(*ReplyView).SerialResponse
+func handlerName(handler any) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(handler).Pointer())
+	if fn == nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(fn.Name(), "atcli/src/"), "-fm")
+}
+
+// publisher names the function that published, past the bus, the topics and LogMessage
+func publisher() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := strings.TrimPrefix(frame.Function, "atcli/src/")
+		if !strings.HasPrefix(name, "services.(*EventBus).") && !strings.HasPrefix(name, "services.Topic[") &&
+			name != "services.LogMessage" {
+			return name
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// SummarizePayload describes an event's payload on one line
+func SummarizePayload(payload interface{}) string {
+	var summary string
+	switch p := payload.(type) {
+	case nil:
+		return ""
+	case error:
+		summary = p.Error()
+	case string:
+		summary = p
+	case fmt.Stringer:
+		summary = p.String()
+	default:
+		switch reflect.TypeOf(payload).Kind() {
+		case reflect.Pointer, reflect.Func, reflect.Chan, reflect.Interface:
+			// e.g. the view of EventAppFocus, its fields would fill the screen
+			summary = fmt.Sprintf("%T", payload)
+		default:
+			summary = fmt.Sprintf("%+v", payload)
+		}
+	}
+
+	summary = strings.Join(strings.Fields(summary), " ")
+	if utf8.RuneCountInString(summary) > maxSummary {
+		summary = string([]rune(summary)[:maxSummary-3]) + "..."
+	}
+	return summary
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"atcli/src/types"
+	"testing"
+	"time"
+)
+
+// slowTestHandler stands in for a handler that holds up Publish
+type slowTestHandler struct{}
+
+func (slowTestHandler) handle(types.SerialLine) {
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestEventTapHandlers(t *testing.T) {
+	eventBus := NewEventBus()
+	TopicURC.Subscribe(eventBus, slowTestHandler{}.handle)
+	TopicURC.SubscribeWith(eventBus, func(types.SerialLine) {}, SubscribeOptions{Queue: 1})
+	eventBus.Subscribe(types.EventURC, func(types.Event) {})
+
+	traces := make(chan EventTrace, 1)
+	eventBus.Tap(func(trace EventTrace) { traces <- trace })
+	TopicURC.Publish(eventBus, types.SerialLine{Text: "RING"})
+	trace := <-traces
+
+	tests := []struct {
+		name   string
+		queued bool
+		slow   bool
+	}{
+		{name: "services.slowTestHandler.handle", slow: true},
+		{name: "services.TestEventTapHandlers.func1", queued: true},
+		{name: "services.TestEventTapHandlers.func2"},
+	}
+
+	if len(trace.Handlers) != len(tests) || trace.Queued != 1 {
+		t.Fatalf("traced %+v with %d queued, want %d handlers with 1 queued", trace.Handlers, trace.Queued, len(tests))
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := trace.Handlers[i]
+			if handler.Name != test.name || handler.Queued != test.queued {
+				t.Errorf("got %+v, want %s queued %v", handler, test.name, test.queued)
+			}
+			if slow := handler.Duration >= 20*time.Millisecond; slow != test.slow {
+				t.Errorf("took %s, slow should be %v", handler.Duration, test.slow)
+			}
+		})
+	}
+	if trace.Duration < trace.Handlers[0].Duration {
+		t.Errorf("publish took %s, less than its slow handler", trace.Duration)
+	}
+}
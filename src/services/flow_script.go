@@ -0,0 +1,171 @@
+package services
+
+import (
+	"atcli/src/types"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// flowScript is the YAML form of a flow, e.g.
+//
+//	name: provision
+//	vars:
+//	  apn: internet
+//	steps:
+//	  - send: AT+CPIN?
+//	    capture: {pin: '\+CPIN: (\w+)'}
+//	  - send: AT+CGDCONT=1,"IP","${apn}"
+//	    when: ${pin} == READY
+//	    timeout: 5s
+//	    retries: 2
+type flowScript struct {
+	Name  string            `yaml:"name"`
+	Vars  map[string]string `yaml:"vars"`
+	Steps []flowScriptStep  `yaml:"steps"`
+}
+
+type flowScriptStep struct {
+	Name       string            `yaml:"name"`
+	Send       string            `yaml:"send"`
+	Body       string            `yaml:"body"`
+	Expect     stringList        `yaml:"expect"`
+	FailOn     stringList        `yaml:"fail_on"`
+	Timeout    string            `yaml:"timeout"`
+	Retries    int               `yaml:"retries"`
+	RetryDelay string            `yaml:"retry_delay"`
+	Optional   bool              `yaml:"optional"`
+	Capture    map[string]string `yaml:"capture"`
+	When       string            `yaml:"when"`
+	OnSuccess  string            `yaml:"on_success"`
+	OnFailure  string            `yaml:"on_failure"`
+}
+
+// stringList takes either a single string or a list of them
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// LoadFlowScript reads a flow from a YAML file. vars given here win over the ones in the file.
+func LoadFlowScript(path string, vars map[string]string) (types.ATFlow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return types.ATFlow{}, err
+	}
+	return ParseFlowScript(data, path, vars)
+}
+
+// ParseFlowScript reads a flow from YAML, path names it in errors and when the script has no name
+func ParseFlowScript(data []byte, path string, vars map[string]string) (types.ATFlow, error) {
+	var script flowScript
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&script); err != nil {
+		return types.ATFlow{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if script.Name == "" {
+		script.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	flow := types.ATFlow{Name: script.Name, Vars: map[string]string{}}
+	for name, value := range script.Vars {
+		flow.Vars[name] = value
+	}
+	for name, value := range vars {
+		flow.Vars[name] = value
+	}
+
+	if len(script.Steps) == 0 {
+		return types.ATFlow{}, fmt.Errorf("%s: no steps", path)
+	}
+
+	names := map[string]bool{"end": true}
+	for _, step := range script.Steps {
+		if step.Name != "" {
+			names[step.Name] = true
+		}
+	}
+
+	for i, step := range script.Steps {
+		where := fmt.Sprintf("%s: step %d", path, i+1)
+		if step.Send == "" {
+			return types.ATFlow{}, fmt.Errorf("%s has nothing to send", where)
+		}
+		for _, target := range []string{step.OnSuccess, step.OnFailure} {
+			if target != "" && !names[target] {
+				return types.ATFlow{}, fmt.Errorf("%s goes to %q, there is no step with that name", where, target)
+			}
+		}
+
+		timeout, err := parseScriptDuration(step.Timeout)
+		if err != nil {
+			return types.ATFlow{}, fmt.Errorf("%s has an invalid timeout: %w", where, err)
+		}
+		retryDelay, err := parseScriptDuration(step.RetryDelay)
+		if err != nil {
+			return types.ATFlow{}, fmt.Errorf("%s has an invalid retry_delay: %w", where, err)
+		}
+
+		flow.Steps = append(flow.Steps, types.ATFlowStep{
+			Name:              step.Name,
+			Command:           step.Send,
+			Body:              step.Body,
+			ExpectedResponses: step.Expect,
+			FailOn:            step.FailOn,
+			Timeout:           timeout,
+			Retries:           step.Retries,
+			RetryDelay:        retryDelay,
+			Optional:          step.Optional,
+			Capture:           step.Capture,
+			When:              step.When,
+			OnSuccess:         step.OnSuccess,
+			OnFailure:         step.OnFailure,
+		})
+	}
+
+	return flow, nil
+}
+
+// ParseFlowVars turns key=value arguments into flow variables
+func ParseFlowVars(args []string) (map[string]string, error) {
+	vars := make(map[string]string, len(args))
+	for _, arg := range args {
+		name, value, found := strings.Cut(arg, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid variable %q, expected key=value", arg)
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// parseScriptDuration accepts Go durations such as 500ms or 2m, and plain numbers as seconds
+func parseScriptDuration(text string) (time.Duration, error) {
+	if text == "" {
+		return 0, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(text, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(text)
+}
@@ -0,0 +1,353 @@
+package services
+
+import (
+	"atcli/src/types"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	httpMaxBody      = 1024 * 1024 // Largest command or flow script a request may carry
+	httpStreamBuffer = 1024        // How many records a WebSocket client may fall behind before it is dropped
+	httpWriteTimeout = 10 * time.Second
+)
+
+// httpStreamTypes are the records GET /api/events can stream
+var httpStreamTypes = map[string]bool{"line": true, "urc": true, "transaction": true, "signal": true, "gps": true}
+
+// HTTPCommand is the body of POST /api/command
+type HTTPCommand struct {
+	Command   string         `json:"command"`
+	Role      types.PortRole `json:"role,omitempty"`
+	Priority  string         `json:"priority,omitempty"` // user, flow or background, default user
+	TimeoutMS int64          `json:"timeout_ms,omitempty"`
+	Body      string         `json:"body,omitempty"` // Text for the > prompt, sent with Ctrl+Z
+}
+
+// HTTPFlowResult is the answer of POST /api/flow, the flow and the transaction of every step that sent a command
+type HTTPFlowResult struct {
+	Flow         FlowRecord          `json:"flow"`
+	Transactions []TransactionRecord `json:"transactions"`
+}
+
+// HTTPAPI lets programs that don't speak our socket protocol drive the modem:
+//
+//	POST /api/command  HTTPCommand as JSON, answers with the TransactionRecord once the modem has
+//	POST /api/flow     a flow script as YAML or JSON, the query sets its variables, answers with an HTTPFlowResult
+//	GET  /api/events   WebSocket of line, urc, transaction, signal and gps records, ?types=urc,signal picks some
+//
+// With a token every request needs Authorization: Bearer <token>, or ?token= where headers can't be set
+type HTTPAPI struct {
+	eventBus *EventBus
+	token    string
+	mux      *http.ServeMux
+	upgrader websocket.Upgrader
+
+	lock    sync.Mutex
+	streams map[*httpStream]bool
+}
+
+// httpStream is one WebSocket client of GET /api/events
+type httpStream struct {
+	conn    *websocket.Conn
+	types   map[string]bool
+	out     chan any
+	closed  chan struct{}
+	closing sync.Once
+}
+
+// NewHTTPAPI creates the API for the ports on eventBus, an empty token lets anyone who can connect in
+func NewHTTPAPI(eventBus *EventBus, token string) *HTTPAPI {
+	a := &HTTPAPI{
+		eventBus: eventBus,
+		token:    token,
+		mux:      http.NewServeMux(),
+		streams:  map[*httpStream]bool{},
+	}
+	// A web page may only open the stream from elsewhere when it has to know the token
+	a.upgrader.CheckOrigin = func(r *http.Request) bool {
+		return a.token != "" || sameOrigin(r)
+	}
+
+	a.mux.HandleFunc("/api/command", a.handleCommand)
+	a.mux.HandleFunc("/api/flow", a.handleFlow)
+	a.mux.HandleFunc("/api/events", a.handleEvents)
+
+	TopicSerialResponse.Subscribe(eventBus, func(line types.SerialLine) {
+		if line.Text != "" {
+			a.broadcast("line", NewLineRecord(line))
+		}
+	})
+	TopicURC.Subscribe(eventBus, func(line types.SerialLine) {
+		a.broadcast("urc", NewURCRecord(line))
+	})
+	eventBus.Subscribe(types.EventATResult, func(event types.Event) {
+		if result, ok := event.Payload.(types.ATResult); ok {
+			a.broadcast("transaction", NewTransactionRecord(result))
+		}
+	})
+	TopicSignalUpdated.Subscribe(eventBus, func(sample types.SignalSample) {
+		a.broadcast("signal", NewSignalRecord(sample))
+	})
+	TopicGPSUpdated.Subscribe(eventBus, func(fix types.GPSFix) {
+		a.broadcast("gps", NewGPSRecord(fix))
+	})
+
+	return a
+}
+
+// ServeHTTP checks the token and hands the request to its endpoint
+func (a *HTTPAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" && !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="atcli"`)
+		httpError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// Close disconnects the WebSocket clients, the server they came in on is closed by its owner
+func (a *HTTPAPI) Close() {
+	a.lock.Lock()
+	streams := make([]*httpStream, 0, len(a.streams))
+	for stream := range a.streams {
+		streams = append(streams, stream)
+	}
+	a.lock.Unlock()
+
+	for _, stream := range streams {
+		stream.close()
+	}
+}
+
+func (a *HTTPAPI) authorized(r *http.Request) bool {
+	given := r.URL.Query().Get("token")
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		given = token
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) == 1
+}
+
+func (a *HTTPAPI) handleCommand(w http.ResponseWriter, r *http.Request) {
+	if !allowedRequest(w, r, "application/json") {
+		return
+	}
+
+	var command HTTPCommand
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, httpMaxBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&command); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("invalid command: %w", err))
+		return
+	}
+	if strings.TrimSpace(command.Command) == "" {
+		httpError(w, http.StatusBadRequest, errors.New("no command given"))
+		return
+	}
+	priority, ok := daemonPriorities[command.Priority]
+	if !ok {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("invalid priority %q, expected user, flow or background", command.Priority))
+		return
+	}
+
+	// Like a flow, the command isn't stopped when the client hangs up, there's just no one left to answer
+	result := SendATContext(r.Context(), a.eventBus, types.ATCommandPayload{
+		Command:  command.Command,
+		Role:     command.Role,
+		Priority: priority,
+		Timeout:  time.Duration(command.TimeoutMS) * time.Millisecond,
+		Body:     command.Body,
+	})
+	if r.Context().Err() != nil {
+		return
+	}
+	httpJSON(w, http.StatusOK, NewTransactionRecord(result))
+}
+
+func (a *HTTPAPI) handleFlow(w http.ResponseWriter, r *http.Request) {
+	if !allowedRequest(w, r, "application/yaml", "application/x-yaml", "text/yaml", "application/json") {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpMaxBody))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	vars := map[string]string{}
+	for key, values := range r.URL.Query() {
+		if key != "token" {
+			vars[key] = values[len(values)-1]
+		}
+	}
+	flow, err := ParseFlowScript(data, "flow", vars)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	done := make(chan types.ATFlowResult, 1)
+	flow.ID = fmt.Sprintf("flow-%d", flowCounter.Add(1))
+	flow.Result = done
+	a.eventBus.Publish(types.Event{Type: types.EventATModemFlow, Payload: flow})
+
+	// A client that hangs up doesn't stop the flow, the modem may be halfway through it
+	var result types.ATFlowResult
+	select {
+	case result = <-done:
+	case <-r.Context().Done():
+		return
+	}
+
+	answer := HTTPFlowResult{Flow: NewFlowRecord(result), Transactions: []TransactionRecord{}}
+	for _, step := range result.Steps {
+		if !step.Skipped && step.Result.Command != "" {
+			answer.Transactions = append(answer.Transactions, NewTransactionRecord(step.Result))
+		}
+	}
+	httpJSON(w, http.StatusOK, answer)
+}
+
+func (a *HTTPAPI) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+
+	wanted := map[string]bool{}
+	if list := r.URL.Query().Get("types"); list != "" {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if !httpStreamTypes[name] {
+				httpError(w, http.StatusBadRequest, fmt.Errorf("unknown record type %q, expected line, urc, transaction, signal or gps", name))
+				return
+			}
+			wanted[name] = true
+		}
+	}
+
+	conn, err := a.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered the request already
+		return
+	}
+	stream := &httpStream{
+		conn:   conn,
+		types:  wanted,
+		out:    make(chan any, httpStreamBuffer),
+		closed: make(chan struct{}),
+	}
+
+	a.lock.Lock()
+	a.streams[stream] = true
+	a.lock.Unlock()
+
+	go stream.write()
+
+	// Nothing is expected from the client, reading is how its close and pings are noticed
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+
+	a.lock.Lock()
+	delete(a.streams, stream)
+	a.lock.Unlock()
+	stream.close()
+}
+
+// broadcast sends a record to the WebSocket clients that want its type
+func (a *HTTPAPI) broadcast(recordType string, record any) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for stream := range a.streams {
+		if len(stream.types) == 0 || stream.types[recordType] {
+			stream.send(record)
+		}
+	}
+}
+
+// send queues a record for the client, a client that falls too far behind is dropped rather than holding up the port
+func (s *httpStream) send(record any) {
+	select {
+	case s.out <- record:
+	case <-s.closed:
+	default:
+		s.close()
+	}
+}
+
+func (s *httpStream) write() {
+	for {
+		select {
+		case record := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(httpWriteTimeout))
+			if err := s.conn.WriteJSON(record); err != nil {
+				s.close()
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *httpStream) close() {
+	s.closing.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+// allowedRequest accepts POSTs of the given content types. Insisting on the type keeps web pages from sending
+// commands behind the user's back, a browser won't send these types elsewhere without asking us first.
+func allowedRequest(w http.ResponseWriter, r *http.Request, contentTypes ...string) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	for _, contentType := range contentTypes {
+		if mediaType == contentType {
+			return true
+		}
+	}
+	httpError(w, http.StatusUnsupportedMediaType, fmt.Errorf("expected Content-Type %s", strings.Join(contentTypes, ", ")))
+	return false
+}
+
+// sameOrigin reports whether a WebSocket request comes from a page we served, or from something that isn't a browser
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func httpJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	httpJSON(w, status, NewErrorRecord(err))
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.bug.st/serial"
+)
+
+// FlowControl selects how the modem and host throttle each other
+type FlowControl string
+
+const (
+	FlowNone   FlowControl = "none"
+	FlowRTSCTS FlowControl = "rtscts"
+)
+
+// FlowController is implemented by transports that can switch hardware flow control on and off
+type FlowController interface {
+	SetFlowControl(flow FlowControl) error
+}
+
+// LineConfig is the full serial line configuration for a port
+type LineConfig struct {
+	BaudRate    int
+	DataBits    int
+	Parity      serial.Parity
+	StopBits    serial.StopBits
+	FlowControl FlowControl
+	DTR         bool // Initial DTR state
+	RTS         bool // Initial RTS state
+}
+
+// DefaultLineConfig is 115200 8N1 without flow control, DTR and RTS asserted
+func DefaultLineConfig() LineConfig {
+	return LineConfig{
+		BaudRate:    115200,
+		DataBits:    8,
+		Parity:      serial.NoParity,
+		StopBits:    serial.OneStopBit,
+		FlowControl: FlowNone,
+		DTR:         true,
+		RTS:         true,
+	}
+}
+
+var parityNames = map[string]serial.Parity{
+	"none":  serial.NoParity,
+	"odd":   serial.OddParity,
+	"even":  serial.EvenParity,
+	"mark":  serial.MarkParity,
+	"space": serial.SpaceParity,
+}
+
+var stopBitNames = map[string]serial.StopBits{
+	"1":   serial.OneStopBit,
+	"1.5": serial.OnePointFiveStopBits,
+	"2":   serial.TwoStopBits,
+}
+
+// Set changes one setting by name, the names are shared by the command line flags and port URL queries
+func (c *LineConfig) Set(name string, value string) error {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch name {
+	case "baud":
+		baud, err := strconv.Atoi(value)
+		if err != nil || baud <= 0 {
+			return fmt.Errorf("invalid baud rate %q", value)
+		}
+		c.BaudRate = baud
+	case "databits":
+		bits, err := strconv.Atoi(value)
+		if err != nil || bits < 5 || bits > 8 {
+			return fmt.Errorf("invalid data bits %q, expected 5, 6, 7 or 8", value)
+		}
+		c.DataBits = bits
+	case "parity":
+		parity, ok := parityNames[value]
+		if !ok {
+			return fmt.Errorf("invalid parity %q, expected none, odd, even, mark or space", value)
+		}
+		c.Parity = parity
+	case "stopbits":
+		stopBits, ok := stopBitNames[value]
+		if !ok {
+			return fmt.Errorf("invalid stop bits %q, expected 1, 1.5 or 2", value)
+		}
+		c.StopBits = stopBits
+	case "flow":
+		switch FlowControl(value) {
+		case FlowNone, FlowRTSCTS:
+			c.FlowControl = FlowControl(value)
+		default:
+			return fmt.Errorf("invalid flow control %q, expected none or rtscts", value)
+		}
+	case "dtr", "rts":
+		var on bool
+		switch value {
+		case "on", "1", "true":
+			on = true
+		case "off", "0", "false":
+			on = false
+		default:
+			return fmt.Errorf("invalid %s state %q, expected on or off", name, value)
+		}
+		if name == "dtr" {
+			c.DTR = on
+		} else {
+			c.RTS = on
+		}
+	default:
+		return fmt.Errorf("unknown line setting %q", name)
+	}
+
+	return nil
+}
+
+// WithPortOverrides applies settings given in the port URL query,
+// e.g. serial:///dev/ttyUSB2?parity=even&flow=rtscts, so every port can have its own line settings
+func (c LineConfig) WithPortOverrides(port string) (LineConfig, error) {
+	target, err := ParsePortURL(port)
+	if err != nil {
+		return c, err
+	}
+
+	query := target.Query()
+	for _, name := range []string{"baud", "databits", "parity", "stopbits", "flow", "dtr", "rts"} {
+		if value := query.Get(name); value != "" {
+			if err := c.Set(name, value); err != nil {
+				return c, fmt.Errorf("%s: %w", port, err)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// Mode converts the config to the go.bug.st/serial mode
+func (c LineConfig) Mode() serial.Mode {
+	mode := serial.Mode{
+		BaudRate: c.BaudRate,
+		DataBits: c.DataBits,
+		Parity:   c.Parity,
+		StopBits: c.StopBits,
+	}
+
+	// Opening asserts both lines anyway, and ptys reject the modem bit ioctls used to set them
+	if !c.DTR || !c.RTS {
+		mode.InitialStatusBits = &serial.ModemOutputBits{DTR: c.DTR, RTS: c.RTS}
+	}
+
+	return mode
+}
+
+// String returns the conventional short form, e.g. 115200 8E1 RTS/CTS
+func (c LineConfig) String() string {
+	parity := "N"
+	for name, value := range parityNames {
+		if value == c.Parity {
+			parity = strings.ToUpper(name[:1])
+		}
+	}
+
+	stopBits := "1"
+	for name, value := range stopBitNames {
+		if value == c.StopBits {
+			stopBits = name
+		}
+	}
+
+	text := fmt.Sprintf("%d %d%s%s", c.BaudRate, c.DataBits, parity, stopBits)
+	if c.FlowControl == FlowRTSCTS {
+		text += " RTS/CTS"
+	}
+	return text
+}
+
+// hasDefaultFraming reports whether the framing is plain 8N1 with no flow control,
+// which is all a transport without line control can offer
+func (c LineConfig) hasDefaultFraming() bool {
+	defaults := DefaultLineConfig()
+	return c.DataBits == defaults.DataBits &&
+		c.Parity == defaults.Parity &&
+		c.StopBits == defaults.StopBits &&
+		c.FlowControl == defaults.FlowControl
+}
+
+// ApplyLineConfig puts the config on an open transport, failing if it asks for something the transport cannot do
+func ApplyLineConfig(t Transport, config LineConfig) error {
+	mode := config.Mode()
+	if err := t.SetMode(&mode); err != nil {
+		if !errors.Is(err, ErrNotSupported) {
+			return err
+		}
+		// Raw network and pty links carry bytes only, the baud rate is whatever the far end uses
+		if !config.hasDefaultFraming() {
+			return fmt.Errorf("this transport cannot change line settings, %s was requested", config)
+		}
+	}
+
+	if config.FlowControl != FlowNone {
+		controller, ok := t.(FlowController)
+		if !ok {
+			return fmt.Errorf("this transport does not support %s flow control", config.FlowControl)
+		}
+		if err := controller.SetFlowControl(config.FlowControl); err != nil {
+			return fmt.Errorf("could not enable %s flow control: %w", config.FlowControl, err)
+		}
+	}
+
+	// Asserted is the default everywhere, only insist when something else was asked for
+	if !config.DTR {
+		if err := t.SetDTR(false); err != nil {
+			return fmt.Errorf("could not drop DTR: %w", err)
+		}
+	}
+	if !config.RTS {
+		if err := t.SetRTS(false); err != nil {
+			return fmt.Errorf("could not drop RTS: %w", err)
+		}
+	}
+
+	return nil
+}
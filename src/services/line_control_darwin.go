@@ -0,0 +1,9 @@
+package services
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+	termiosRTSCTS   = unix.CRTSCTS
+)
@@ -0,0 +1,9 @@
+package services
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+	termiosRTSCTS   = unix.CRTSCTS
+)
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package services
+
+// lineControl has no implementation here, hardware flow control reports ErrNotSupported
+type lineControl struct{}
+
+func openLineControl(name string) (*lineControl, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *lineControl) SetHardwareFlow(enable bool) error {
+	return ErrNotSupported
+}
+
+func (c *lineControl) Close() error {
+	return nil
+}
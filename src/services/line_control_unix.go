@@ -0,0 +1,41 @@
+//go:build linux || darwin
+
+package services
+
+import "golang.org/x/sys/unix"
+
+// lineControl is a second descriptor on a tty used to change termios flags directly
+type lineControl struct {
+	fd int
+}
+
+func openLineControl(name string) (*lineControl, error) {
+	fd, err := unix.Open(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &lineControl{fd: fd}, nil
+}
+
+// SetHardwareFlow switches RTS/CTS flow control, termios is per device so it applies to the main handle too
+func (c *lineControl) SetHardwareFlow(enable bool) error {
+	termios, err := unix.IoctlGetTermios(c.fd, ioctlGetTermios)
+	if err != nil {
+		return err
+	}
+
+	if enable {
+		termios.Cflag |= termiosRTSCTS
+	} else {
+		termios.Cflag &^= termiosRTSCTS
+	}
+
+	return unix.IoctlSetTermios(c.fd, ioctlSetTermios, termios)
+}
+
+func (c *lineControl) Close() error {
+	if c == nil {
+		return nil
+	}
+	return unix.Close(c.fd)
+}
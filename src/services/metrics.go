@@ -0,0 +1,304 @@
+package services
+
+import (
+	"atcli/src/types"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics keeps the modem's health for Prometheus. It is fed from the same events the signal and GPS views
+// draw, so it counts whatever goes over the ports, from the UI, a flow, the API or the monitor's polling.
+type Metrics struct {
+	lock          sync.Mutex
+	signal        *types.SignalSample
+	fix           *types.GPSFix
+	registrations map[string]types.Registration // By domain, CREG, CEREG, ...
+	connected     map[metricsPort]bool
+	commands      map[metricsPort]uint64
+	errors        map[metricsError]uint64
+	timeouts      map[metricsPort]uint64
+	reconnects    map[metricsPort]uint64
+	serialErrors  map[metricsPort]uint64
+}
+
+// metricsPort labels the metrics of one port
+type metricsPort struct {
+	port string
+	role types.PortRole
+}
+
+// metricsError labels a final result code that isn't OK, e.g. kind cme and code 10 for +CME ERROR: 10
+type metricsError struct {
+	metricsPort
+	kind string
+	code string
+}
+
+// NewMetrics starts counting the events on eventBus
+func NewMetrics(eventBus *EventBus) *Metrics {
+	m := &Metrics{
+		registrations: map[string]types.Registration{},
+		connected:     map[metricsPort]bool{},
+		commands:      map[metricsPort]uint64{},
+		errors:        map[metricsError]uint64{},
+		timeouts:      map[metricsPort]uint64{},
+		reconnects:    map[metricsPort]uint64{},
+		serialErrors:  map[metricsPort]uint64{},
+	}
+
+	TopicSignalUpdated.Subscribe(eventBus, func(sample types.SignalSample) {
+		m.lock.Lock()
+		m.signal = &sample
+		m.lock.Unlock()
+	})
+	TopicGPSUpdated.Subscribe(eventBus, func(fix types.GPSFix) {
+		m.lock.Lock()
+		m.fix = &fix
+		m.lock.Unlock()
+	})
+	TopicRegistrationUpdated.Subscribe(eventBus, func(registration types.Registration) {
+		m.lock.Lock()
+		m.registrations[registration.Domain] = registration
+		m.lock.Unlock()
+	})
+	// Serial errors are counted from the results and connection states that carry their port, not from
+	// EventSerialError, which has no port and also reports invalid requests
+	eventBus.Subscribe(types.EventATResult, m.handleATResult)
+	eventBus.Subscribe(types.EventConnectionState, m.handleConnectionState)
+
+	return m
+}
+
+func (m *Metrics) handleATResult(event types.Event) {
+	result, ok := event.Payload.(types.ATResult)
+	if !ok || result.Sent.IsZero() {
+		// Never sent, given up on in the queue or cancelled before its turn
+		return
+	}
+	port := metricsPort{port: result.Port, role: result.Role}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.commands[port]++
+	switch {
+	case errors.Is(result.Err, ErrTimeout):
+		m.timeouts[port]++
+	case IsPortError(result.Err):
+		// Writing the command failed or the port went away before the answer
+		m.serialErrors[port]++
+	}
+	if result.Final != "" && !result.OK() {
+		m.errors[finalResultError(port, result.Final)]++
+	}
+}
+
+func (m *Metrics) handleConnectionState(event types.Event) {
+	status, ok := event.Payload.(types.ConnectionStatus)
+	if !ok {
+		return
+	}
+	port := metricsPort{port: status.Port, role: status.Role}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch status.State {
+	case types.ConnectionConnected:
+		m.connected[port] = true
+	case types.ConnectionReconnected:
+		m.connected[port] = true
+		m.reconnects[port]++
+	case types.ConnectionLost:
+		m.connected[port] = false
+		if status.Err != nil {
+			m.serialErrors[port]++
+		}
+	case types.ConnectionReconnecting:
+		m.connected[port] = false
+	}
+}
+
+// finalResultError labels an error result code
+func finalResultError(port metricsPort, final string) metricsError {
+	if code, ok := strings.CutPrefix(final, "+CME ERROR:"); ok {
+		return metricsError{metricsPort: port, kind: "cme", code: strings.TrimSpace(code)}
+	}
+	if code, ok := strings.CutPrefix(final, "+CMS ERROR:"); ok {
+		return metricsError{metricsPort: port, kind: "cms", code: strings.TrimSpace(code)}
+	}
+	if final == "ERROR" {
+		return metricsError{metricsPort: port, kind: "error"}
+	}
+	// NO CARRIER, BUSY, NO ANSWER and the like
+	return metricsError{metricsPort: port, kind: "result", code: final}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	out := &metricsWriter{w: w}
+
+	// Readings are left out until there is one, a made up 0 would look like a real one on a graph
+	if s := m.signal; s != nil {
+		if s.CSQ != 99 {
+			out.metric("atcli_signal_csq", "gauge", "Signal strength as AT+CSQ reports it, 0-31", float64(s.CSQ))
+			out.metric("atcli_signal_rssi_dbm", "gauge", "Received signal strength in dBm, from AT+CSQ", float64(s.RSSI))
+		}
+		if s.BER != 99 {
+			out.metric("atcli_signal_ber", "gauge", "Bit error rate as AT+CSQ reports it, 0-7", float64(s.BER))
+		}
+		if s.RSRP != 0 {
+			out.metric("atcli_signal_rsrp_dbm", "gauge", "LTE reference signal received power in dBm, from AT+CESQ", float64(s.RSRP))
+		}
+		if s.RSRQ != 0 {
+			out.metric("atcli_signal_rsrq_db", "gauge", "LTE reference signal received quality in dB, from AT+CESQ", s.RSRQ)
+		}
+	}
+
+	if f := m.fix; f != nil {
+		out.metric("atcli_gnss_fix", "gauge", "1 while the GNSS receiver has a position", boolValue(f.Fix))
+		out.metric("atcli_gnss_satellites", "gauge", "Satellites used for the position, only known from NMEA", float64(f.Satellites))
+	}
+
+	if len(m.registrations) > 0 {
+		domains := make([]string, 0, len(m.registrations))
+		for domain := range m.registrations {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+
+		out.header("atcli_registration_stat", "gauge", "Network registration <stat> of 27.007, 1 home, 5 roaming, 2 searching, 3 denied")
+		for _, domain := range domains {
+			out.sample("atcli_registration_stat", float64(m.registrations[domain].Stat), "domain", domain)
+		}
+		out.header("atcli_registered", "gauge", "1 while registered to a network, home or roaming")
+		for _, domain := range domains {
+			out.sample("atcli_registered", boolValue(m.registrations[domain].Registered), "domain", domain)
+		}
+	}
+
+	out.header("atcli_port_up", "gauge", "1 while the port is open")
+	for _, port := range sortedPorts(m.connected) {
+		out.sample("atcli_port_up", boolValue(m.connected[port]), "port", port.port, "role", string(port.role))
+	}
+
+	out.header("atcli_commands_total", "counter", "AT commands sent")
+	for _, port := range sortedPorts(m.commands) {
+		out.sample("atcli_commands_total", float64(m.commands[port]), "port", port.port, "role", string(port.role))
+	}
+
+	out.header("atcli_command_errors_total", "counter", "AT commands answered with an error, by kind (error, cme, cms or result) and code")
+	codes := make([]metricsError, 0, len(m.errors))
+	for code := range m.errors {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if codes[i].metricsPort != codes[j].metricsPort {
+			return portLess(codes[i].metricsPort, codes[j].metricsPort)
+		}
+		if codes[i].kind != codes[j].kind {
+			return codes[i].kind < codes[j].kind
+		}
+		return codes[i].code < codes[j].code
+	})
+	for _, code := range codes {
+		out.sample("atcli_command_errors_total", float64(m.errors[code]), "port", code.port, "role", string(code.role), "kind", code.kind, "code", code.code)
+	}
+
+	out.header("atcli_command_timeouts_total", "counter", "AT commands the modem didn't answer in time")
+	for _, port := range sortedPorts(m.timeouts) {
+		out.sample("atcli_command_timeouts_total", float64(m.timeouts[port]), "port", port.port, "role", string(port.role))
+	}
+
+	out.header("atcli_reconnects_total", "counter", "Times a port came back after it was lost")
+	for _, port := range sortedPorts(m.reconnects) {
+		out.sample("atcli_reconnects_total", float64(m.reconnects[port]), "port", port.port, "role", string(port.role))
+	}
+
+	out.header("atcli_serial_errors_total", "counter", "Errors reading or writing the port, not counting commands that timed out")
+	for _, port := range sortedPorts(m.serialErrors) {
+		out.sample("atcli_serial_errors_total", float64(m.serialErrors[port]), "port", port.port, "role", string(port.role))
+	}
+
+	return out.written, out.err
+}
+
+// metricsWriter writes the Prometheus text format, it remembers the first error and stops there
+type metricsWriter struct {
+	w       io.Writer
+	written int64
+	err     error
+}
+
+func (o *metricsWriter) printf(format string, args ...any) {
+	if o.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(o.w, format, args...)
+	o.written += int64(n)
+	o.err = err
+}
+
+func (o *metricsWriter) header(name string, kind string, help string) {
+	o.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value, labels are name and value pairs
+func (o *metricsWriter) sample(name string, value float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	o.printf("%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// metric writes a metric with a single unlabelled value
+func (o *metricsWriter) metric(name string, kind string, help string, value float64) {
+	o.header(name, kind, help)
+	o.sample(name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedPorts[V any](values map[metricsPort]V) []metricsPort {
+	ports := make([]metricsPort, 0, len(values))
+	for port := range values {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return portLess(ports[i], ports[j])
+	})
+	return ports
+}
+
+func portLess(a, b metricsPort) bool {
+	if a.port != b.port {
+		return a.port < b.port
+	}
+	return a.role < b.role
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
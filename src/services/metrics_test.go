@@ -0,0 +1,99 @@
+package services
+
+import (
+	"atcli/src/types"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsCounters(t *testing.T) {
+	sent := time.Now()
+	at := types.ATResult{Port: "/dev/ttyUSB2", Role: types.RoleAT, Command: "AT", Sent: sent}
+	aux := types.ATResult{Port: "/dev/ttyUSB3", Role: types.RoleAuxAT, Command: "AT", Sent: sent}
+	with := func(result types.ATResult, final string, err error) types.ATResult {
+		result.Final = final
+		result.Err = err
+		return result
+	}
+
+	tests := []struct {
+		name    string
+		results []types.ATResult
+		states  []types.ConnectionStatus
+		want    []string // Samples that must be in the output
+		absent  []string // Metrics that must have no sample
+	}{
+		{
+			name:    "final result codes by port",
+			results: []types.ATResult{with(at, "OK", nil), with(at, "+CME ERROR: 10", nil), with(aux, "ERROR", nil), with(aux, "ERROR", nil)},
+			want: []string{
+				`atcli_commands_total{port="/dev/ttyUSB2",role="at"} 2`,
+				`atcli_commands_total{port="/dev/ttyUSB3",role="aux"} 2`,
+				`atcli_command_errors_total{port="/dev/ttyUSB2",role="at",kind="cme",code="10"} 1`,
+				`atcli_command_errors_total{port="/dev/ttyUSB3",role="aux",kind="error",code=""} 2`,
+			},
+			absent: []string{"atcli_serial_errors_total{", "atcli_command_timeouts_total{"},
+		},
+		{
+			name: "timeouts and cancels aren't serial errors",
+			results: []types.ATResult{
+				with(at, "", fmt.Errorf("%w waiting for response to 'AT'", ErrTimeout)),
+				with(at, "", fmt.Errorf("%w 'AT'", ErrCancelled)),
+			},
+			want:   []string{`atcli_command_timeouts_total{port="/dev/ttyUSB2",role="at"} 1`},
+			absent: []string{"atcli_serial_errors_total{"},
+		},
+		{
+			name:    "write failures and lost ports are serial errors",
+			results: []types.ATResult{with(at, "", errors.New("write /dev/ttyUSB2: input/output error"))},
+			states: []types.ConnectionStatus{
+				{Port: "/dev/ttyUSB2", Role: types.RoleAT, State: types.ConnectionLost, Err: errors.New("EOF")},
+				{Port: "/dev/ttyUSB2", Role: types.RoleAT, State: types.ConnectionReconnecting, Attempt: 1},
+				{Port: "/dev/ttyUSB2", Role: types.RoleAT, State: types.ConnectionReconnected},
+			},
+			want: []string{
+				`atcli_serial_errors_total{port="/dev/ttyUSB2",role="at"} 2`,
+				`atcli_reconnects_total{port="/dev/ttyUSB2",role="at"} 1`,
+				`atcli_port_up{port="/dev/ttyUSB2",role="at"} 1`,
+			},
+		},
+		{
+			name:    "commands never sent aren't counted",
+			results: []types.ATResult{{Port: "/dev/ttyUSB2", Role: types.RoleAT, Command: "AT", Err: errors.New("not connected to /dev/ttyUSB2, dropping 'AT'")}},
+			absent:  []string{"atcli_commands_total{", "atcli_serial_errors_total{"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eventBus := NewEventBus()
+			m := NewMetrics(eventBus)
+			for _, result := range test.results {
+				eventBus.Publish(types.Event{Type: types.EventATResult, Payload: result})
+			}
+			for _, state := range test.states {
+				eventBus.Publish(types.Event{Type: types.EventConnectionState, Payload: state})
+			}
+			// Errors without a port say nothing about the port
+			TopicSerialError.Publish(eventBus, errors.New("invalid AT command payload"))
+
+			var out strings.Builder
+			if _, err := m.WriteTo(&out); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want+"\n") {
+					t.Errorf("no %s in\n%s", want, out.String())
+				}
+			}
+			for _, absent := range test.absent {
+				if strings.Contains(out.String(), absent) {
+					t.Errorf("unexpected %s in\n%s", absent, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"atcli/src/types"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// linePollInterval is how often the modem status lines are read, the OS has no portable way to wait for a change
+const linePollInterval = 250 * time.Millisecond
+
+// defaultDTRPulse is how long /dtr pulse drops DTR, long enough for modems set with AT&D to hang up
+const defaultDTRPulse = 1 * time.Second
+
+// ModemLines returns the last known state of the control lines
+func (s *SerialPort) ModemLines() types.ModemLines {
+	s.linesLock.Lock()
+	defer s.linesLock.Unlock()
+	return s.lines
+}
+
+// SetModemLine drives DTR or RTS as asked for by /dtr and /rts
+func (s *SerialPort) SetModemLine(request types.ModemLineRequest) error {
+	role := request.Role
+	if role == "" {
+		role = types.RoleAT
+	}
+	if role != s.role {
+		return nil
+	}
+
+	port := s.currentPort()
+	if port == nil {
+		return fmt.Errorf("not connected to %s", s.portName)
+	}
+
+	set := port.SetDTR
+	if request.Line == "rts" {
+		set = port.SetRTS
+	} else if request.Line != "dtr" {
+		return fmt.Errorf("unknown control line %q", request.Line)
+	}
+
+	switch request.Action {
+	case "on", "off":
+		if err := set(request.Action == "on"); err != nil {
+			return fmt.Errorf("could not set %s %s on %s: %w", request.Line, request.Action, s.portName, err)
+		}
+		s.setOutputLine(request.Line, request.Action == "on")
+	case "pulse":
+		pulse := request.Pulse
+		if pulse <= 0 {
+			pulse = defaultDTRPulse
+		}
+		if err := set(false); err != nil {
+			return fmt.Errorf("could not drop %s on %s: %w", request.Line, s.portName, err)
+		}
+		s.setOutputLine(request.Line, false)
+		time.Sleep(pulse)
+		if err := set(true); err != nil {
+			return fmt.Errorf("could not raise %s on %s: %w", request.Line, s.portName, err)
+		}
+		s.setOutputLine(request.Line, true)
+	default:
+		return fmt.Errorf("unknown %s action %q", request.Line, request.Action)
+	}
+
+	return nil
+}
+
+// setOutputLine records an output line change and keeps it over a reconnect
+func (s *SerialPort) setOutputLine(line string, on bool) {
+	s.connLock.Lock()
+	if line == "dtr" {
+		s.config.DTR = on
+	} else {
+		s.config.RTS = on
+	}
+	s.connLock.Unlock()
+
+	s.linesLock.Lock()
+	if line == "dtr" {
+		s.lines.DTR = on
+	} else {
+		s.lines.RTS = on
+	}
+	lines := s.lines
+	s.linesLock.Unlock()
+
+	s.eventBus.Publish(types.Event{Type: types.EventModemLines, Payload: lines})
+}
+
+// monitorLines polls CTS, DSR, RI and DCD, publishing the lines whenever they change
+// and a separate event for RI and DCD edges so ring and carrier can be followed without AT commands
+func (s *SerialPort) monitorLines() {
+	ticker := time.NewTicker(linePollInterval)
+	defer ticker.Stop()
+
+	seen := false
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		port := s.currentPort()
+		if port == nil {
+			continue
+		}
+
+		bits, err := port.GetModemStatusBits()
+		if err != nil {
+			// Network links and ptys have no lines to read, no point asking again
+			if errors.Is(err, ErrNotSupported) || !seen {
+				LogMessage(fmt.Sprintf("[yellow]Control line status is not available on %s: %v[white]", s.portName, err))
+				return
+			}
+			continue
+		}
+
+		s.linesLock.Lock()
+		previous := s.lines
+		s.lines.CTS = bits.CTS
+		s.lines.DSR = bits.DSR
+		s.lines.RI = bits.RI
+		s.lines.DCD = bits.DCD
+		lines := s.lines
+		s.linesLock.Unlock()
+
+		if seen && lines == previous {
+			continue
+		}
+
+		s.eventBus.Publish(types.Event{Type: types.EventModemLines, Payload: lines})
+
+		if !seen {
+			seen = true
+			continue
+		}
+		if lines.RI != previous.RI {
+			LogMessage(fmt.Sprintf("[yellow]RI %s on %s[white]", onOff(lines.RI), s.portName))
+			s.eventBus.Publish(types.Event{
+				Type:    types.EventRingIndicator,
+				Payload: types.ModemLineChange{Port: s.portName, Role: s.role, On: lines.RI},
+			})
+		}
+		if lines.DCD != previous.DCD {
+			LogMessage(fmt.Sprintf("[yellow]DCD %s on %s[white]", onOff(lines.DCD), s.portName))
+			s.eventBus.Publish(types.Event{
+				Type:    types.EventCarrierDetect,
+				Payload: types.ModemLineChange{Port: s.portName, Role: s.role, On: lines.DCD},
+			})
+		}
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
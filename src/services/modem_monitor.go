@@ -0,0 +1,416 @@
+package services
+
+import (
+	"atcli/src/types"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// monitorQueue is how many events the monitor may have waiting before it drops new ones
+const monitorQueue = 256
+
+var (
+	csqPattern          = regexp.MustCompile(`\+CSQ:\s*(\d+),\s*(\d+)`)
+	cesqPattern         = regexp.MustCompile(`\+CESQ:\s*(\d+),\s*(\d+),\s*(\d+),\s*(\d+),\s*(\d+),\s*(\d+)`)
+	registrationPattern = regexp.MustCompile(`^\+(CREG|CGREG|CEREG|C5GREG):\s*(.*)$`)
+	// Format: +CGPSINFO: <lat>,<N/S>,<lon>,<E/W>,<date>,<UTC time>,<alt>,<speed>,<course>
+	cgpsinfoPattern = regexp.MustCompile(`\+CGPSINFO:\s*([^,]*),([^,]*),([^,]*),([^,]*),([^,]*),([^,]*),([^,]*),([^,]*),([^,]*)`)
+)
+
+// registrationStatus names the <stat> values of 27.007
+var registrationStatus = map[int]string{
+	0:  "not registered",
+	1:  "registered, home",
+	2:  "searching",
+	3:  "denied",
+	4:  "unknown",
+	5:  "registered, roaming",
+	6:  "registered for SMS only, home",
+	7:  "registered for SMS only, roaming",
+	8:  "emergency services only",
+	9:  "registered, home, CSFB not preferred",
+	10: "registered, roaming, CSFB not preferred",
+}
+
+// ModemMonitor reads the signal, registration and GPS position out of whatever the modem says, whoever asked
+// for it, and publishes them as EventSignalUpdated, EventRegistrationUpdated and EventGPSUpdated. The views
+// draw these events and the API and the publishers pass them on, Poll makes the monitor ask by itself.
+type ModemMonitor struct {
+	eventBus *EventBus
+
+	lock    sync.Mutex
+	signal  types.SignalSample
+	fix     types.GPSFix
+	polling bool
+
+	stop     chan struct{}
+	stopping sync.Once
+}
+
+// NewModemMonitor starts watching the answers, URCs and NMEA sentences on eventBus
+func NewModemMonitor(eventBus *EventBus) *ModemMonitor {
+	m := &ModemMonitor{
+		eventBus: eventBus,
+		signal:   types.SignalSample{CSQ: 99, BER: 99},
+		stop:     make(chan struct{}),
+	}
+
+	// Queued, the parsing and the events it finds don't hold up the serial reader
+	queue := SubscribeOptions{Queue: monitorQueue, Overflow: OverflowDropNewest}
+	eventBus.SubscribeWith(types.EventATResult, m.handleATResult, queue)
+	TopicURC.SubscribeWith(eventBus, m.handleURC, queue)
+	TopicSerialResponse.SubscribeWith(eventBus, m.handleSerialResponse, queue)
+
+	return m
+}
+
+// Poll asks the modem for its signal and registration every interval, and for its position unless a NMEA port
+// streams it anyway. The queries go at background priority, so anything typed or sent over the API goes first.
+func (m *ModemMonitor) Poll(interval time.Duration, gps bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.polling || interval <= 0 {
+		return
+	}
+	m.polling = true
+
+	commands := []string{"AT+CSQ", "AT+CESQ", "AT+CREG?", "AT+CEREG?"}
+	if gps {
+		commands = append(commands, "AT+CGPSINFO")
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			for _, command := range commands {
+				SendAT(m.eventBus, types.ATCommandPayload{Command: command, OwnerID: "monitor", Priority: types.PriorityBackground})
+			}
+
+			select {
+			case <-ticker.C:
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops polling
+func (m *ModemMonitor) Close() {
+	m.stopping.Do(func() {
+		close(m.stop)
+	})
+}
+
+func (m *ModemMonitor) handleATResult(event types.Event) {
+	result, ok := event.Payload.(types.ATResult)
+	if !ok || !result.OK() {
+		return
+	}
+
+	for _, line := range result.Lines {
+		switch {
+		case strings.HasPrefix(line, "+CSQ:"):
+			m.parseCSQ(line)
+		case strings.HasPrefix(line, "+CESQ:"):
+			m.parseCESQ(line)
+		case strings.HasPrefix(line, "+CGPSINFO:"):
+			m.parseCGPSINFO(line)
+		default:
+			m.parseRegistration(result.Port, line, true)
+		}
+	}
+}
+
+func (m *ModemMonitor) handleURC(line types.SerialLine) {
+	// AT+CGPSINFO=<secs> reports the position by itself
+	if strings.HasPrefix(line.Text, "+CGPSINFO:") {
+		m.parseCGPSINFO(line.Text)
+		return
+	}
+	m.parseRegistration(line.Port, line.Text, false)
+}
+
+// handleSerialResponse reads the sentences streaming in on the NMEA port
+func (m *ModemMonitor) handleSerialResponse(line types.SerialLine) {
+	if line.Role == types.RoleNMEA {
+		m.parseNMEA(line.Text)
+	}
+}
+
+// parseCSQ extracts the signal strength from a +CSQ answer
+func (m *ModemMonitor) parseCSQ(line string) {
+	matches := csqPattern.FindStringSubmatch(line)
+	if len(matches) < 3 {
+		return
+	}
+
+	csq, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return
+	}
+
+	m.lock.Lock()
+	m.signal.CSQ = csq
+	m.signal.BER, _ = strconv.Atoi(matches[2])
+	// 0 is -113 dBm or less, 31 is -51 dBm or more and 99 is not known
+	m.signal.RSSI = 0
+	if csq != 99 {
+		m.signal.RSSI = -113 + (2 * csq)
+	}
+	m.signal.Time = time.Now()
+	sample := m.signal
+	m.lock.Unlock()
+
+	TopicSignalUpdated.Publish(m.eventBus, sample)
+}
+
+// parseCESQ extracts the LTE signal quality from a +CESQ answer: <rxlev>,<ber>,<rscp>,<ecno>,<rsrq>,<rsrp>
+func (m *ModemMonitor) parseCESQ(line string) {
+	matches := cesqPattern.FindStringSubmatch(line)
+	if len(matches) < 7 {
+		return
+	}
+	rsrq, _ := strconv.Atoi(matches[5])
+	rsrp, _ := strconv.Atoi(matches[6])
+
+	m.lock.Lock()
+	// RSRQ 0-34 is -20 dB to -3 dB in half steps, RSRP 0-97 is -141 dBm to -44 dBm, 255 is not known
+	m.signal.RSRQ = 0
+	if rsrq <= 34 {
+		m.signal.RSRQ = -20 + float64(rsrq)/2
+	}
+	m.signal.RSRP = 0
+	if rsrp <= 97 {
+		m.signal.RSRP = -141 + rsrp
+	}
+	m.signal.Time = time.Now()
+	sample := m.signal
+	m.lock.Unlock()
+
+	TopicSignalUpdated.Publish(m.eventBus, sample)
+}
+
+// parseRegistration reads a network registration line. An answer to a query starts with the <n> it was
+// set to report with, a URC starts with <stat>, both go on with the area, cell and access technology.
+func (m *ModemMonitor) parseRegistration(port string, line string, answer bool) {
+	matches := registrationPattern.FindStringSubmatch(line)
+	if matches == nil {
+		return
+	}
+
+	fields := strings.Split(matches[2], ",")
+	for i := range fields {
+		fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+	}
+	if answer {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return
+	}
+	stat, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+
+	registration := types.Registration{
+		Port:       port,
+		Domain:     matches[1],
+		Stat:       stat,
+		Status:     registrationStatus[stat],
+		Registered: stat == 1 || stat == 5 || stat == 6 || stat == 7 || stat == 9 || stat == 10,
+		AccessTech: -1,
+		Time:       time.Now(),
+	}
+	if registration.Status == "" {
+		registration.Status = "unknown"
+	}
+	if len(fields) >= 3 {
+		registration.Area = fields[1]
+		registration.CellID = fields[2]
+	}
+	if len(fields) >= 4 {
+		if tech, err := strconv.Atoi(fields[3]); err == nil {
+			registration.AccessTech = tech
+		}
+	}
+	TopicRegistrationUpdated.Publish(m.eventBus, registration)
+}
+
+// parseCGPSINFO extracts the position from a +CGPSINFO answer, its fields are empty while there is no fix
+func (m *ModemMonitor) parseCGPSINFO(line string) {
+	m.lock.Lock()
+	fix := m.readCGPSINFO(line)
+	m.lock.Unlock()
+
+	m.publishFix(fix)
+}
+
+// readCGPSINFO updates the fix from a +CGPSINFO answer and returns it. Called with the lock held.
+func (m *ModemMonitor) readCGPSINFO(line string) types.GPSFix {
+	matches := cgpsinfoPattern.FindStringSubmatch(line)
+	if len(matches) < 10 || matches[1] == "" || matches[3] == "" {
+		return m.setFix(false)
+	}
+
+	m.setPosition(matches[1], matches[2], matches[3], matches[4])
+
+	// Parse date (format: DDMMYY)
+	if date := matches[5]; len(date) == 6 {
+		m.fix.Date = fmt.Sprintf("%s-%s-%s", date[0:2], date[2:4], date[4:6])
+	} else {
+		m.fix.Date = "N/A"
+	}
+
+	// Parse UTC time (format: hhmmss.ss as float)
+	if utc, err := strconv.ParseFloat(matches[6], 64); err == nil {
+		seconds := int(utc)
+		m.fix.UTC = fmt.Sprintf("%02d:%02d:%02d UTC", seconds/10000, (seconds/100)%100, seconds%100)
+	} else {
+		m.fix.UTC = "N/A"
+	}
+
+	// Parse altitude (meters)
+	if altitude, err := strconv.ParseFloat(matches[7], 64); err == nil {
+		m.fix.Altitude = altitude
+	}
+
+	m.fix.Time = time.Now()
+	return m.setFix(true)
+}
+
+// parseNMEA updates the fix from RMC (position, date and time) and GGA (altitude and satellites) sentences
+func (m *ModemMonitor) parseNMEA(sentence string) {
+	if !strings.HasPrefix(sentence, "$") {
+		return
+	}
+
+	// Drop sentences with a bad checksum, partial lines are common right after the port opens
+	body := sentence[1:]
+	if star := strings.LastIndex(body, "*"); star >= 0 {
+		var sum byte
+		for i := 0; i < star; i++ {
+			sum ^= body[i]
+		}
+		if fmt.Sprintf("%02X", sum) != strings.ToUpper(body[star+1:]) {
+			return
+		}
+		body = body[:star]
+	}
+
+	fields := strings.Split(body, ",")
+	if len(fields[0]) != 5 {
+		return
+	}
+
+	m.lock.Lock()
+	fix, changed := m.readNMEA(fields)
+	m.lock.Unlock()
+
+	if changed {
+		m.publishFix(fix)
+	}
+}
+
+// readNMEA updates the fix from the fields of a sentence, and returns it when that changed whether there is one.
+// Called with the lock held.
+func (m *ModemMonitor) readNMEA(fields []string) (types.GPSFix, bool) {
+	switch fields[0][2:] {
+	case "RMC":
+		// $GxRMC,hhmmss.ss,status,lat,N/S,lon,E/W,speed,course,ddmmyy,...
+		if len(fields) < 10 {
+			return m.fix, false
+		}
+		if fields[2] != "A" {
+			return m.setFix(false), true
+		}
+		m.setPosition(fields[3], fields[4], fields[5], fields[6])
+		if len(fields[9]) == 6 {
+			m.fix.Date = fmt.Sprintf("%s-%s-%s", fields[9][0:2], fields[9][2:4], fields[9][4:6])
+		}
+		if len(fields[1]) >= 6 {
+			m.fix.UTC = fmt.Sprintf("%s:%s:%s UTC", fields[1][0:2], fields[1][2:4], fields[1][4:6])
+		}
+		m.fix.Time = time.Now()
+		return m.setFix(true), true
+	case "GGA":
+		// $GxGGA,hhmmss.ss,lat,N/S,lon,E/W,quality,satellites,hdop,altitude,M,...
+		if len(fields) < 10 {
+			return m.fix, false
+		}
+		if satellites, err := strconv.Atoi(fields[7]); err == nil {
+			m.fix.Satellites = satellites
+		}
+		if altitude, err := strconv.ParseFloat(fields[9], 64); err == nil {
+			m.fix.Altitude = altitude
+		}
+	}
+	return m.fix, false
+}
+
+// setPosition stores a position given in NMEA ddmm.mmmm form with its hemispheres
+func (m *ModemMonitor) setPosition(latStr string, latDir string, lonStr string, lonDir string) {
+	if lat, err := nmeaCoordinate(latStr); err == nil {
+		if latDir == "S" {
+			lat = -lat
+		}
+		m.fix.Latitude = lat
+	}
+
+	if lon, err := nmeaCoordinate(lonStr); err == nil {
+		if lonDir == "W" {
+			lon = -lon
+		}
+		m.fix.Longitude = lon
+	}
+}
+
+// setFix records whether there is a fix and returns a copy to publish. Called with the lock held.
+func (m *ModemMonitor) setFix(fix bool) types.GPSFix {
+	m.fix.Fix = fix
+	return m.fix
+}
+
+// publishFix publishes the fix, and the GPS time for the status bar. Called without the lock, a handler may call back in.
+func (m *ModemMonitor) publishFix(fix types.GPSFix) {
+	TopicGPSUpdated.Publish(m.eventBus, fix)
+
+	if fix.Fix && fix.UTC != "" && fix.UTC != "N/A" {
+		TopicUpdateTime.Publish(m.eventBus, types.TimeUpdate{UTC: fix.UTC, Date: fix.Date, Time: fix.Time})
+	}
+}
+
+// nmeaCoordinate converts NMEA format (ddmm.mmmm for latitude, dddmm.mmmm for longitude) to decimal degrees
+func nmeaCoordinate(coord string) (float64, error) {
+	if coord == "" {
+		return 0, fmt.Errorf("empty coordinate")
+	}
+
+	// The minutes are the two digits before the decimal point and what follows, the degrees are in front of them
+	decimalPos := strings.Index(coord, ".")
+	if decimalPos < 0 {
+		return 0, fmt.Errorf("invalid coordinate format")
+	}
+	degreeEndPos := decimalPos - 2
+	if degreeEndPos <= 0 {
+		return 0, fmt.Errorf("invalid coordinate format")
+	}
+
+	degrees, err := strconv.ParseFloat(coord[:degreeEndPos], 64)
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.ParseFloat(coord[degreeEndPos:], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return degrees + (minutes / 60.0), nil
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"atcli/src/types"
+	"testing"
+	"time"
+)
+
+func TestModemMonitorParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		parse  func(m *ModemMonitor)
+		signal *types.SignalSample // Last published, nil when none must be
+		fix    *types.GPSFix
+		time   string // UTC of the last EventUpdateTime, empty when none must be
+	}{
+		{
+			name:   "CSQ",
+			parse:  func(m *ModemMonitor) { m.parseCSQ("+CSQ: 17,99") },
+			signal: &types.SignalSample{CSQ: 17, BER: 99, RSSI: -79},
+		},
+		{
+			name:   "CSQ not known",
+			parse:  func(m *ModemMonitor) { m.parseCSQ("+CSQ: 99,99") },
+			signal: &types.SignalSample{CSQ: 99, BER: 99},
+		},
+		{
+			name: "CESQ keeps the CSQ reading",
+			parse: func(m *ModemMonitor) {
+				m.parseCSQ("+CSQ: 20,0")
+				m.parseCESQ("+CESQ: 99,99,255,255,20,50")
+			},
+			signal: &types.SignalSample{CSQ: 20, BER: 0, RSSI: -73, RSRQ: -10, RSRP: -91},
+		},
+		{
+			name: "CGPSINFO with a fix",
+			parse: func(m *ModemMonitor) {
+				m.parseCGPSINFO("+CGPSINFO: 5230.1234,N,01324.5678,E,170626,123456.0,34.5,0.0,0.0")
+			},
+			fix:  &types.GPSFix{Fix: true, Latitude: 52.50205666666667, Longitude: 13.409463333333333, Altitude: 34.5, UTC: "12:34:56 UTC", Date: "17-06-26"},
+			time: "12:34:56 UTC",
+		},
+		{
+			name:  "CGPSINFO without a fix",
+			parse: func(m *ModemMonitor) { m.parseCGPSINFO("+CGPSINFO: ,,,,,,,,") },
+			fix:   &types.GPSFix{},
+		},
+		{
+			name: "NMEA GGA then RMC",
+			parse: func(m *ModemMonitor) {
+				m.parseNMEA("$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47")
+				m.parseNMEA("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A")
+			},
+			fix:  &types.GPSFix{Fix: true, Latitude: 48.1173, Longitude: 11.516666666666667, Altitude: 545.4, Satellites: 8, UTC: "12:35:19 UTC", Date: "23-03-94"},
+			time: "12:35:19 UTC",
+		},
+		{
+			name: "NMEA with a bad checksum",
+			parse: func(m *ModemMonitor) {
+				m.parseNMEA("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*00")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eventBus := NewEventBus()
+			m := NewModemMonitor(eventBus)
+
+			// Handlers run synchronously and may call back into the monitor
+			var signal *types.SignalSample
+			var fix *types.GPSFix
+			var utc string
+			TopicSignalUpdated.Subscribe(eventBus, func(sample types.SignalSample) {
+				m.Poll(0, false)
+				signal = &sample
+			})
+			TopicGPSUpdated.Subscribe(eventBus, func(update types.GPSFix) {
+				m.Poll(0, false)
+				fix = &update
+			})
+			TopicUpdateTime.Subscribe(eventBus, func(update types.TimeUpdate) {
+				m.Poll(0, false)
+				utc = update.UTC
+			})
+
+			done := make(chan struct{})
+			go func() {
+				test.parse(m)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("parsing deadlocked with a handler calling back into the monitor")
+			}
+
+			if (signal == nil) != (test.signal == nil) {
+				t.Fatalf("signal %+v, want %+v", signal, test.signal)
+			}
+			if signal != nil {
+				signal.Time = time.Time{}
+				if *signal != *test.signal {
+					t.Errorf("signal %+v, want %+v", *signal, *test.signal)
+				}
+			}
+
+			if (fix == nil) != (test.fix == nil) {
+				t.Fatalf("fix %+v, want %+v", fix, test.fix)
+			}
+			if fix != nil {
+				fix.Time = time.Time{}
+				if *fix != *test.fix {
+					t.Errorf("fix %+v, want %+v", *fix, *test.fix)
+				}
+			}
+			if utc != test.time {
+				t.Errorf("time %q, want %q", utc, test.time)
+			}
+		})
+	}
+}
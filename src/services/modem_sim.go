@@ -0,0 +1,512 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimFaultAction is what the simulator does instead of answering a command normally
+type SimFaultAction string
+
+const (
+	SimFaultTimeout SimFaultAction = "timeout" // Swallow the command and never answer
+	SimFaultError   SimFaultAction = "error"   // Answer with a plain ERROR
+	SimFaultCME     SimFaultAction = "cme"     // Answer with +CME ERROR: 100
+	SimFaultReboot  SimFaultAction = "reboot"  // Go silent and replay the boot URCs
+)
+
+// SimFault injects a failure when a command matches
+type SimFault struct {
+	Match  string         // Command prefix, case-insensitive, e.g. AT+CSQ
+	Action SimFaultAction // What to do instead of the normal answer
+	Every  int            // Fire on every Nth matching command, 0 or 1 fires every time
+}
+
+// SimURC is an unsolicited line the simulator emits on a timer
+type SimURC struct {
+	Every time.Duration
+	Text  string
+}
+
+// ModemSimProfile describes the modem being simulated
+type ModemSimProfile struct {
+	Name         string
+	Manufacturer string
+	Model        string
+	Revision     string
+	IMEI         string
+	Echo         bool          // Initial ATE state
+	BootDelay    time.Duration // Silence after a reboot before the boot URCs
+	GNSSReady    time.Duration // Delay between AT+CGNSSPWR=1 and +CGNSSPWR: READY!
+	GNSSFix      time.Duration // Delay between GNSS power on and the first fix
+	Seed         int64         // Seed for the signal random walk, fixed so runs are repeatable
+	Faults       []SimFault
+	URCs         []SimURC
+}
+
+// simProfiles are the built-in profiles selectable with sim://<name> or atcli sim <name>
+var simProfiles = map[string]ModemSimProfile{
+	"simcom": {
+		Name:         "simcom",
+		Manufacturer: "SIMCOM INCORPORATED",
+		Model:        "A7670E-MASA",
+		Revision:     "A131B02A7670M6C_M",
+		IMEI:         "863957070000001",
+		Echo:         true,
+		BootDelay:    3 * time.Second,
+		GNSSReady:    2 * time.Second,
+		GNSSFix:      5 * time.Second,
+		Seed:         1,
+	},
+	"flaky": {
+		Name:         "flaky",
+		Manufacturer: "SIMCOM INCORPORATED",
+		Model:        "A7670E-MASA",
+		Revision:     "A131B02A7670M6C_M",
+		IMEI:         "863957070000002",
+		Echo:         true,
+		BootDelay:    3 * time.Second,
+		GNSSReady:    5 * time.Second,
+		GNSSFix:      15 * time.Second,
+		Seed:         2,
+		Faults: []SimFault{
+			{Match: "AT+CSQ", Action: SimFaultError, Every: 4},
+			{Match: "AT+CGPSINFO", Action: SimFaultTimeout, Every: 5},
+			{Match: "AT+CSQ", Action: SimFaultReboot, Every: 25},
+		},
+		URCs: []SimURC{
+			{Every: 45 * time.Second, Text: "+CMTI: \"SM\",1"},
+			{Every: 60 * time.Second, Text: "RING"},
+		},
+	},
+}
+
+// SimProfileNames lists the built-in simulator profiles
+func SimProfileNames() []string {
+	names := make([]string, 0, len(simProfiles))
+	for name := range simProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseSimFault parses a fault spec in the form COMMAND:ACTION[:EVERY], e.g. AT+CSQ:error:3
+func ParseSimFault(spec string) (SimFault, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return SimFault{}, fmt.Errorf("invalid fault %q, expected COMMAND:ACTION[:EVERY]", spec)
+	}
+
+	fault := SimFault{Match: strings.ToUpper(parts[0]), Action: SimFaultAction(strings.ToLower(parts[1]))}
+	switch fault.Action {
+	case SimFaultTimeout, SimFaultError, SimFaultCME, SimFaultReboot:
+	default:
+		return SimFault{}, fmt.Errorf("invalid fault action %q, expected timeout, error, cme or reboot", parts[1])
+	}
+
+	if len(parts) == 3 {
+		every, err := strconv.Atoi(parts[2])
+		if err != nil || every < 0 {
+			return SimFault{}, fmt.Errorf("invalid fault interval %q", parts[2])
+		}
+		fault.Every = every
+	}
+
+	return fault, nil
+}
+
+// SimProfileFromURL resolves sim://<profile>?fault=AT%2BCSQ:error:3&fault=... into a profile, a + in the query
+// would be a space
+func SimProfileFromURL(target *url.URL) (ModemSimProfile, error) {
+	name := target.Host
+	if name == "" {
+		name = "simcom"
+	}
+
+	profile, ok := simProfiles[name]
+	if !ok {
+		return ModemSimProfile{}, fmt.Errorf("unknown simulator profile %q, expected one of: %s", name, strings.Join(SimProfileNames(), ", "))
+	}
+
+	// Copy so faults added here don't leak into the built-in profile
+	profile.Faults = append([]SimFault{}, profile.Faults...)
+	for _, spec := range target.Query()["fault"] {
+		fault, err := ParseSimFault(spec)
+		if err != nil {
+			return ModemSimProfile{}, err
+		}
+		profile.Faults = append(profile.Faults, fault)
+	}
+
+	return profile, nil
+}
+
+// ModemSim emulates a SIMCom style modem on the far side of a byte stream
+type ModemSim struct {
+	profile ModemSimProfile
+	conn    io.ReadWriter
+	random  *rand.Rand
+
+	lock        sync.Mutex
+	writeLock   sync.Mutex
+	echo        bool
+	booting     bool
+	csq         int
+	gnssOn      bool
+	gnssOnSince time.Time
+	gnssTimer   *time.Timer
+	prompt      func(body string, aborted bool)
+	muxing      bool  // Set by AT+CMUX=0
+	faultCounts []int // Matching commands seen by each of profile.Faults
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// NewModemSim creates a simulator for the profile, call Serve to attach it to a stream
+func NewModemSim(profile ModemSimProfile) *ModemSim {
+	return &ModemSim{
+		profile:     profile,
+		random:      rand.New(rand.NewSource(profile.Seed)),
+		echo:        profile.Echo,
+		csq:         20,
+		faultCounts: make([]int, len(profile.Faults)),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Serve answers commands read from conn until it fails or Stop is called
+func (m *ModemSim) Serve(conn io.ReadWriter) error {
+	m.conn = conn
+
+	for _, urc := range m.profile.URCs {
+		go m.emitEvery(urc)
+	}
+
+	m.boot(0)
+
+	buf := make([]byte, 256)
+	line := []byte{}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			m.Stop()
+			return err
+		}
+
+	chunk:
+		for i, b := range buf[:n] {
+			m.lock.Lock()
+			prompt := m.prompt
+			echo := m.echo
+			m.lock.Unlock()
+
+			// While a > prompt is open everything up to Ctrl-Z (send) or ESC (abort) is payload
+			if prompt != nil {
+				switch b {
+				case '\n':
+					// The LF after the command's CR arrives once the prompt is already open
+					if len(line) > 0 {
+						line = append(line, b)
+					}
+				case 0x1a, 0x1b:
+					m.lock.Lock()
+					m.prompt = nil
+					m.lock.Unlock()
+					prompt(string(line), b == 0x1b)
+					line = line[:0]
+				default:
+					line = append(line, b)
+					if echo {
+						m.write(string(b))
+					}
+				}
+				continue
+			}
+
+			switch b {
+			case '\r':
+				command := strings.TrimSpace(string(line))
+				line = line[:0]
+				if echo {
+					m.write(command + "\r")
+				}
+				if command != "" {
+					m.handle(command)
+				}
+				// After AT+CMUX the rest of the stream is frames until the host closes the multiplexer
+				if m.isMuxing() {
+					if err := m.serveCMUX(io.MultiReader(bytesReader(buf[i+1:n]), conn)); err != nil {
+						m.Stop()
+						return err
+					}
+					break chunk
+				}
+			case '\n':
+				// Commands are terminated by CR, a trailing LF is noise
+			default:
+				line = append(line, b)
+			}
+		}
+	}
+}
+
+// Stop ends the URC timers, Serve returns once the stream is closed
+func (m *ModemSim) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+func (m *ModemSim) write(text string) {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	m.conn.Write([]byte(text))
+}
+
+// reply writes lines in verbose result code format, each wrapped in CR LF
+func (m *ModemSim) reply(lines ...string) {
+	text := ""
+	for _, line := range lines {
+		text += "\r\n" + line + "\r\n"
+	}
+	m.write(text)
+}
+
+func (m *ModemSim) emitEvery(urc SimURC) {
+	ticker := time.NewTicker(urc.Every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.lock.Lock()
+			booting := m.booting
+			m.lock.Unlock()
+			if !booting {
+				m.reply(urc.Text)
+			}
+		}
+	}
+}
+
+// boot replays the startup URCs a SIMCom module prints after power on
+func (m *ModemSim) boot(delay time.Duration) {
+	m.lock.Lock()
+	m.booting = true
+	m.echo = m.profile.Echo
+	m.gnssOn = false
+	if m.gnssTimer != nil {
+		m.gnssTimer.Stop()
+	}
+	m.lock.Unlock()
+
+	time.AfterFunc(delay, func() {
+		m.lock.Lock()
+		m.booting = false
+		m.lock.Unlock()
+		m.reply("RDY", "+CPIN: READY", "SMS DONE", "PB DONE")
+	})
+}
+
+// fault returns the fault to inject for a command, if any. Every matching fault counts the
+// command, so faults on the same command keep their own intervals whichever of them fires.
+func (m *ModemSim) fault(command string) *SimFault {
+	upper := strings.ToUpper(command)
+	var fire *SimFault
+	for i := range m.profile.Faults {
+		fault := &m.profile.Faults[i]
+		if !strings.HasPrefix(upper, fault.Match) {
+			continue
+		}
+		m.faultCounts[i]++
+		if fire == nil && (fault.Every <= 1 || m.faultCounts[i]%fault.Every == 0) {
+			fire = fault
+		}
+	}
+	return fire
+}
+
+func (m *ModemSim) handle(command string) {
+	m.lock.Lock()
+	if m.booting {
+		// A rebooting modem doesn't answer at all
+		m.lock.Unlock()
+		return
+	}
+	fault := m.fault(command)
+	m.lock.Unlock()
+
+	if fault != nil {
+		switch fault.Action {
+		case SimFaultTimeout:
+			return
+		case SimFaultError:
+			m.reply("ERROR")
+			return
+		case SimFaultCME:
+			m.reply("+CME ERROR: 100")
+			return
+		case SimFaultReboot:
+			m.boot(m.profile.BootDelay)
+			return
+		}
+	}
+
+	upper := strings.ToUpper(command)
+	switch {
+	case upper == "AT":
+		m.reply("OK")
+	case upper == "ATE0" || upper == "ATE1":
+		m.lock.Lock()
+		m.echo = upper == "ATE1"
+		m.lock.Unlock()
+		m.reply("OK")
+	case upper == "ATI" || upper == "AT+SIMCOMATI":
+		m.reply(
+			"Manufacturer: "+m.profile.Manufacturer,
+			"Model: "+m.profile.Model,
+			"Revision: "+m.profile.Revision,
+			"IMEI: "+m.profile.IMEI,
+			"OK",
+		)
+	case upper == "AT+CGMI":
+		m.reply(m.profile.Manufacturer, "OK")
+	case upper == "AT+CGMM":
+		m.reply(m.profile.Model, "OK")
+	case upper == "AT+CGMR":
+		m.reply("+CGMR: "+m.profile.Revision, "OK")
+	case upper == "AT+GSN" || upper == "AT+CGSN":
+		m.reply(m.profile.IMEI, "OK")
+	case upper == "AT+CPIN?":
+		m.reply("+CPIN: READY", "OK")
+	case upper == "AT+CREG?":
+		m.reply("+CREG: 0,1", "OK")
+	case upper == "AT+CGREG?":
+		m.reply("+CGREG: 0,1", "OK")
+	case upper == "AT+CEREG?":
+		m.reply("+CEREG: 0,1", "OK")
+	case upper == "AT+COPS?":
+		m.reply("+COPS: 0,0,\"SIMULATED\",7", "OK")
+	case upper == "AT+CGDCONT?":
+		m.reply("+CGDCONT: 1,\"IP\",\"internet\",\"0.0.0.0\",0,0", "OK")
+	case upper == "AT+CPSI?":
+		m.reply("+CPSI: LTE,Online,262-03,0x5607,5506356,266,EUTRAN-BAND1,300,5,5,30,55,52,21", "OK")
+	case upper == "AT+CSQ":
+		m.reply(fmt.Sprintf("+CSQ: %d,99", m.nextCSQ()), "OK")
+	case upper == "AT+CESQ":
+		// Only LTE is reported, RSRP about 20 dB below the RSSI of AT+CSQ
+		m.reply(fmt.Sprintf("+CESQ: 99,99,255,255,20,%d", 8+2*m.nextCSQ()), "OK")
+	case upper == "AT+CRESET":
+		m.reply("OK")
+		m.boot(m.profile.BootDelay)
+	case strings.HasPrefix(upper, "AT+CGNSSPWR="):
+		m.setGNSSPower(strings.TrimPrefix(upper, "AT+CGNSSPWR=") == "1")
+	case upper == "AT+CGNSSPWR?":
+		m.lock.Lock()
+		on := m.gnssOn
+		m.lock.Unlock()
+		state := 0
+		if on {
+			state = 1
+		}
+		m.reply(fmt.Sprintf("+CGNSSPWR: %d", state), "OK")
+	case upper == "AT+CGPSINFO":
+		m.reply(m.gpsInfo(), "OK")
+	case strings.HasPrefix(upper, "AT+CMGS="):
+		m.lock.Lock()
+		m.prompt = func(body string, aborted bool) {
+			if aborted {
+				m.reply("OK")
+				return
+			}
+			m.reply("+CMGS: 1", "OK")
+		}
+		m.lock.Unlock()
+		m.write("\r\n> ")
+	case upper == "AT+CMUX=0":
+		m.reply("OK")
+		m.lock.Lock()
+		m.muxing = true
+		m.lock.Unlock()
+	case strings.HasPrefix(upper, "AT+CGNSSTST="),
+		strings.HasPrefix(upper, "AT+CGNSSPORTSWITCH="),
+		strings.HasPrefix(upper, "AT+CMGF="),
+		strings.HasPrefix(upper, "AT+CMEE="),
+		strings.HasPrefix(upper, "AT+IPR="):
+		m.reply("OK")
+	default:
+		m.reply("ERROR")
+	}
+}
+
+// nextCSQ walks the signal up and down a little on every query
+func (m *ModemSim) nextCSQ() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.csq += m.random.Intn(5) - 2
+	if m.csq < 5 {
+		m.csq = 5
+	}
+	if m.csq > 31 {
+		m.csq = 31
+	}
+	return m.csq
+}
+
+func (m *ModemSim) setGNSSPower(on bool) {
+	m.lock.Lock()
+	if m.gnssTimer != nil {
+		m.gnssTimer.Stop()
+		m.gnssTimer = nil
+	}
+	m.gnssOn = false
+	m.lock.Unlock()
+
+	m.reply("OK")
+	if !on {
+		return
+	}
+
+	// The real module only accepts GNSS commands after it reports ready
+	timer := time.AfterFunc(m.profile.GNSSReady, func() {
+		m.lock.Lock()
+		m.gnssOn = true
+		m.gnssOnSince = time.Now()
+		m.lock.Unlock()
+		m.reply("+CGNSSPWR: READY!")
+	})
+
+	m.lock.Lock()
+	m.gnssTimer = timer
+	m.lock.Unlock()
+}
+
+// gpsInfo returns a +CGPSINFO line, empty until the simulated fix is acquired
+func (m *ModemSim) gpsInfo() string {
+	m.lock.Lock()
+	on := m.gnssOn
+	since := m.gnssOnSince
+	m.lock.Unlock()
+
+	if !on || time.Since(since) < m.profile.GNSSFix {
+		return "+CGPSINFO: ,,,,,,,,"
+	}
+
+	// Drift slowly north-east from a fixed point so every fix is different but predictable
+	drift := time.Since(since).Seconds() / 6000
+	now := time.Now().UTC()
+	return fmt.Sprintf("+CGPSINFO: %.6f,N,%.6f,E,%s,%s.0,34.5,0.0,0.0",
+		5230.123456+drift, 1323.456789+drift, now.Format("020106"), now.Format("150405"))
+}
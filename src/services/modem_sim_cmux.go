@@ -0,0 +1,131 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+func bytesReader(b []byte) io.Reader {
+	return bytes.NewReader(append([]byte{}, b...))
+}
+
+func (m *ModemSim) isMuxing() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.muxing
+}
+
+// simCMUXChannel is the modem end of a DLCI, each one is answered by its own simulator
+type simCMUXChannel struct {
+	dlci   byte
+	input  *io.PipeWriter
+	output *io.PipeReader
+	send   func(data []byte)
+}
+
+func (c *simCMUXChannel) Read(p []byte) (int, error) {
+	return c.output.Read(p)
+}
+
+func (c *simCMUXChannel) Write(p []byte) (int, error) {
+	// Keep to the default frame size like a modem after a plain AT+CMUX=0
+	for start := 0; start < len(p); start += cmuxDefaultFrameSize {
+		end := start + cmuxDefaultFrameSize
+		if end > len(p) {
+			end = len(p)
+		}
+		c.send(p[start:end])
+	}
+	return len(p), nil
+}
+
+// serveCMUX answers 27.010 frames like a modem in multiplexer mode, returns once the host closes the multiplexer
+func (m *ModemSim) serveCMUX(stream io.Reader) error {
+	writeLock := sync.Mutex{}
+	send := func(dlci byte, command bool, control byte, data []byte) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		m.write(string(encodeCMUXFrame(dlci, command, control, data)))
+	}
+
+	channels := map[byte]*simCMUXChannel{}
+	closeChannel := func(dlci byte) {
+		if channel, ok := channels[dlci]; ok {
+			channel.input.Close()
+			delete(channels, dlci)
+		}
+	}
+	defer func() {
+		for dlci := range channels {
+			closeChannel(dlci)
+		}
+		m.lock.Lock()
+		m.muxing = false
+		m.lock.Unlock()
+	}()
+
+	reader := bufio.NewReader(stream)
+	for {
+		frame, err := readCMUXFrame(reader)
+		if errors.Is(err, errCMUXBadFrame) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch frame.control {
+		case cmuxSABM:
+			send(frame.dlci, true, cmuxUA|cmuxPF, nil)
+			if frame.dlci == 0 || channels[frame.dlci] != nil {
+				continue
+			}
+
+			fromHost, toSim := io.Pipe()
+			channel := &simCMUXChannel{dlci: frame.dlci, input: toSim, output: fromHost}
+			dlci := frame.dlci
+			channel.send = func(data []byte) {
+				send(dlci, false, cmuxUIH, data)
+			}
+			channels[dlci] = channel
+
+			sim := NewModemSim(m.profile)
+			sim.profile.URCs = nil
+			go sim.Serve(channel)
+
+			// Report DSR, CTS and DCD up like a real module does once a channel opens
+			signals := byte(cmuxEA | cmuxSignalRTC | cmuxSignalRTR | cmuxSignalDV)
+			send(0, false, cmuxUIH, cmuxControlMessage(cmuxMsgMSC, true, []byte{dlci<<2 | cmuxCR | cmuxEA, signals}))
+		case cmuxDISC:
+			send(frame.dlci, true, cmuxUA|cmuxPF, nil)
+			if frame.dlci == 0 {
+				return nil
+			}
+			closeChannel(frame.dlci)
+		case cmuxUIH, cmuxUI:
+			if frame.dlci != 0 {
+				if channel, ok := channels[frame.dlci]; ok {
+					channel.input.Write(frame.data)
+				}
+				continue
+			}
+
+			for _, message := range cmuxControlMessages(frame.data) {
+				msgType, value := message[0][0], message[1]
+				if msgType&cmuxCR == 0 {
+					continue
+				}
+				switch msgType &^ cmuxCR {
+				case cmuxMsgCLD:
+					send(0, false, cmuxUIH, cmuxControlMessage(cmuxMsgCLD, false, nil))
+					return nil
+				case cmuxMsgMSC, cmuxMsgTest:
+					send(0, false, cmuxUIH, cmuxControlMessage(msgType&^cmuxCR, false, value))
+				}
+			}
+		}
+	}
+}
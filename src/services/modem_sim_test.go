@@ -0,0 +1,279 @@
+package services
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSimFault(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    SimFault
+		wantErr bool
+	}{
+		{spec: "AT+CSQ:error", want: SimFault{Match: "AT+CSQ", Action: SimFaultError}},
+		{spec: "at+cgpsinfo:Timeout:5", want: SimFault{Match: "AT+CGPSINFO", Action: SimFaultTimeout, Every: 5}},
+		{spec: "AT+COPS?:cme:0", want: SimFault{Match: "AT+COPS?", Action: SimFaultCME}},
+		{spec: "AT:reboot:25", want: SimFault{Match: "AT", Action: SimFaultReboot, Every: 25}},
+		{spec: "AT+CSQ", wantErr: true},
+		{spec: "AT+CSQ:error:3:4", wantErr: true},
+		{spec: "AT+CSQ:explode", wantErr: true},
+		{spec: "AT+CSQ:error:often", wantErr: true},
+		{spec: "AT+CSQ:error:-1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			got, err := ParseSimFault(test.spec)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSimProfileFromURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		name    string
+		faults  []SimFault
+		wantErr bool
+	}{
+		{url: "sim://", name: "simcom", faults: []SimFault{}},
+		{url: "sim://simcom?fault=AT%2BCSQ:error:3", name: "simcom", faults: []SimFault{{Match: "AT+CSQ", Action: SimFaultError, Every: 3}}},
+		{
+			url:  "sim://flaky?fault=AT:cme",
+			name: "flaky",
+			faults: append(append([]SimFault{}, simProfiles["flaky"].Faults...),
+				SimFault{Match: "AT", Action: SimFaultCME}),
+		},
+		{url: "sim://nokia", wantErr: true},
+		{url: "sim://simcom?fault=AT%2BCSQ", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			target, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			profile, err := SimProfileFromURL(target)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got profile %s, want an error", profile.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile.Name != test.name {
+				t.Errorf("profile %s, want %s", profile.Name, test.name)
+			}
+			if !reflect.DeepEqual(profile.Faults, test.faults) {
+				t.Errorf("faults %+v, want %+v", profile.Faults, test.faults)
+			}
+		})
+	}
+
+	// Faults from a URL are the profile's own, the built-in one stays as it was
+	if faults := simProfiles["flaky"].Faults; len(faults) != 3 {
+		t.Errorf("built-in flaky profile has %d faults after parsing URLs, want 3", len(faults))
+	}
+}
+
+// simTestModem is a ModemSim served over an in-memory pipe
+type simTestModem struct {
+	conn  net.Conn
+	lines chan string
+}
+
+func startSimTestModem(t *testing.T, faults ...SimFault) *simTestModem {
+	t.Helper()
+
+	profile := simProfiles["simcom"]
+	profile.Echo = false
+	profile.BootDelay = 100 * time.Millisecond
+	profile.Faults = faults
+
+	host, modem := net.Pipe()
+	sim := NewModemSim(profile)
+	go sim.Serve(modem)
+	t.Cleanup(func() {
+		sim.Stop()
+		host.Close()
+		modem.Close()
+	})
+
+	m := &simTestModem{conn: host, lines: make(chan string, 64)}
+	go func() {
+		scanner := bufio.NewScanner(host)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				m.lines <- line
+			}
+		}
+		close(m.lines)
+	}()
+
+	// Commands sent while the modem boots go unanswered
+	m.waitFor(t, "PB DONE", time.Second)
+	return m
+}
+
+// waitFor reads lines until one equals want
+func (m *simTestModem) waitFor(t *testing.T, want string, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line := <-m.lines:
+			if line == want {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no %q from the simulator", want)
+		}
+	}
+}
+
+// send writes a command and returns the final result code, empty if none came within timeout
+func (m *simTestModem) send(t *testing.T, command string, timeout time.Duration) string {
+	t.Helper()
+
+	if _, err := m.conn.Write([]byte(command + "\r")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line := <-m.lines:
+			if line == "OK" || line == "ERROR" || strings.HasPrefix(line, "+CME ERROR:") {
+				return line
+			}
+		case <-deadline:
+			return ""
+		}
+	}
+}
+
+func TestModemSimFaults(t *testing.T) {
+	type exchange struct {
+		command string
+		final   string // Empty when the command must go unanswered
+	}
+
+	tests := []struct {
+		name      string
+		faults    []SimFault
+		exchanges []exchange
+	}{
+		{
+			name:   "no faults",
+			faults: nil,
+			exchanges: []exchange{
+				{"AT", "OK"},
+				{"AT+CSQ", "OK"},
+				{"AT+BOGUS", "ERROR"},
+			},
+		},
+		{
+			name:   "error on every third match",
+			faults: []SimFault{{Match: "AT+CSQ", Action: SimFaultError, Every: 3}},
+			exchanges: []exchange{
+				{"AT+CSQ", "OK"},
+				{"AT+CSQ", "OK"},
+				{"AT+CSQ", "ERROR"},
+				{"AT", "OK"},
+				{"AT+CSQ", "OK"},
+				{"AT+CSQ", "OK"},
+				{"AT+CSQ", "ERROR"},
+			},
+		},
+		{
+			name:   "cme on every match, case-insensitive",
+			faults: []SimFault{{Match: "AT+COPS", Action: SimFaultCME}},
+			exchanges: []exchange{
+				{"at+cops?", "+CME ERROR: 100"},
+				{"AT+COPS?", "+CME ERROR: 100"},
+				{"AT+CSQ", "OK"},
+			},
+		},
+		{
+			name:   "timeout leaves the modem answering other commands",
+			faults: []SimFault{{Match: "AT+CGPSINFO", Action: SimFaultTimeout, Every: 2}},
+			exchanges: []exchange{
+				{"AT+CGPSINFO", "OK"},
+				{"AT+CGPSINFO", ""},
+				{"AT", "OK"},
+			},
+		},
+		{
+			name:   "the first fault that fires wins",
+			faults: []SimFault{{Match: "AT+CSQ", Action: SimFaultError, Every: 2}, {Match: "AT+CSQ", Action: SimFaultCME}},
+			exchanges: []exchange{
+				{"AT+CSQ", "+CME ERROR: 100"},
+				{"AT+CSQ", "ERROR"},
+			},
+		},
+		{
+			name:   "faults on the same command count separately",
+			faults: []SimFault{{Match: "AT+CSQ", Action: SimFaultError, Every: 2}, {Match: "AT+CSQ", Action: SimFaultCME, Every: 3}},
+			exchanges: []exchange{
+				{"AT+CSQ", "OK"},
+				{"AT+CSQ", "ERROR"},
+				{"AT+CSQ", "+CME ERROR: 100"},
+				{"AT+CSQ", "ERROR"},
+				{"AT+CSQ", "OK"},
+				{"AT+CSQ", "ERROR"},
+				{"AT+CSQ", "OK"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			modem := startSimTestModem(t, test.faults...)
+			for i, exchange := range test.exchanges {
+				if got := modem.send(t, exchange.command, 300*time.Millisecond); got != exchange.final {
+					t.Fatalf("command %d %s answered %q, want %q", i+1, exchange.command, got, exchange.final)
+				}
+			}
+		})
+	}
+}
+
+func TestModemSimFaultReboot(t *testing.T) {
+	modem := startSimTestModem(t, SimFault{Match: "AT+CFUN", Action: SimFaultReboot})
+
+	if got := modem.send(t, "AT+CFUN=1,1", 50*time.Millisecond); got != "" {
+		t.Fatalf("rebooting modem answered %q", got)
+	}
+	// Silent until the boot URCs, whatever it is sent
+	if got := modem.send(t, "AT", 50*time.Millisecond); got != "" {
+		t.Fatalf("booting modem answered %q", got)
+	}
+	modem.waitFor(t, "RDY", time.Second)
+	modem.waitFor(t, "PB DONE", time.Second)
+
+	if got := modem.send(t, "AT", 300*time.Millisecond); got != "OK" {
+		t.Fatalf("modem answered %q after the reboot, want OK", got)
+	}
+}
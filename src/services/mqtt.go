@@ -0,0 +1,286 @@
+package services
+
+import (
+	"atcli/src/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttOfflineQueue = 1000 // Messages kept while the broker is away, the oldest go first when it is full
+	mqttQoS          = 1
+	mqttTimeout      = 10 * time.Second
+	mqttMaxBackoff   = time.Minute
+)
+
+// MQTTOptions configures an MQTTPublisher
+type MQTTOptions struct {
+	Broker   string // e.g. tcp://localhost:1883, ssl://broker:8883 or ws://broker:80/mqtt
+	ClientID string
+	Username string
+	Password string
+	Topic    string // Prefix of the topics, e.g. atcli/<hostname>
+}
+
+// MQTTCommand is a command sent to the command topic as JSON, a bare AT command works too
+type MQTTCommand struct {
+	ID string `json:"id,omitempty"` // The result's id is mqtt/<id>
+	HTTPCommand
+}
+
+// MQTTPublisher sends the modem's telemetry to an MQTT broker and takes commands from it. Below Topic:
+//
+//	status        online or offline, retained, offline is also the will for when we vanish
+//	signal        SignalRecord, retained
+//	gps           GPSRecord, retained
+//	registration  RegistrationRecord, retained
+//	connection    StateRecord of the ports, retained
+//	command       subscribed, an MQTTCommand or a bare AT command to run
+//	command/result  the TransactionRecord of each command, or an ErrorRecord
+//
+// While the broker can't be reached messages wait in a queue and go out in order once it is back.
+type MQTTPublisher struct {
+	eventBus *EventBus
+	options  MQTTOptions
+	client   mqtt.Client
+
+	lock  sync.Mutex
+	queue []mqttMessage
+	next  uint64 // Sequence number of the next message queued
+	wake  chan struct{}
+
+	closed  chan struct{}
+	closing sync.Once
+}
+
+// mqttMessage is a message waiting to be published
+type mqttMessage struct {
+	seq      uint64
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+// NewMQTTPublisher starts publishing to the broker of options. It returns straight away, the broker is
+// connected to in the background and reconnected to whenever the connection drops.
+func NewMQTTPublisher(eventBus *EventBus, options MQTTOptions) (*MQTTPublisher, error) {
+	broker, err := url.Parse(options.Broker)
+	if err != nil || broker.Host == "" {
+		return nil, fmt.Errorf("invalid MQTT broker %q, expected e.g. tcp://localhost:1883", options.Broker)
+	}
+	switch broker.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("invalid MQTT broker %q, expected a tcp, ssl, ws or wss URL", options.Broker)
+	}
+	options.Topic = strings.TrimSuffix(options.Topic, "/")
+	if options.Topic == "" {
+		return nil, errors.New("no MQTT topic given")
+	}
+
+	p := &MQTTPublisher{
+		eventBus: eventBus,
+		options:  options,
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+
+	clientOptions := mqtt.NewClientOptions().
+		AddBroker(options.Broker).
+		SetClientID(options.ClientID).
+		SetUsername(options.Username).
+		SetPassword(options.Password).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttMaxBackoff).
+		SetConnectTimeout(mqttTimeout).
+		SetOrderMatters(false). // Commands run in their own goroutines, a slow one doesn't hold up the others
+		SetBinaryWill(p.topic("status"), []byte("offline"), mqttQoS, true).
+		SetOnConnectHandler(p.handleConnect).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			LogMessage(fmt.Sprintf("[yellow]Lost the MQTT broker %s: %v, reconnecting[white]", options.Broker, err))
+		})
+	p.client = mqtt.NewClient(clientOptions)
+
+	TopicSignalUpdated.Subscribe(eventBus, func(sample types.SignalSample) {
+		p.send("signal", true, NewSignalRecord(sample))
+	})
+	TopicGPSUpdated.Subscribe(eventBus, func(fix types.GPSFix) {
+		p.send("gps", true, NewGPSRecord(fix))
+	})
+	TopicRegistrationUpdated.Subscribe(eventBus, func(registration types.Registration) {
+		p.send("registration", true, NewRegistrationRecord(registration))
+	})
+	eventBus.Subscribe(types.EventConnectionState, func(event types.Event) {
+		if status, ok := event.Payload.(types.ConnectionStatus); ok {
+			p.send("connection", true, NewStateRecord(status))
+		}
+	})
+
+	go p.connect()
+	go p.run()
+
+	return p, nil
+}
+
+// Close says we are going offline and disconnects, what is still queued is lost
+func (p *MQTTPublisher) Close() {
+	p.closing.Do(func() {
+		close(p.closed)
+		if p.client.IsConnectionOpen() {
+			p.client.Publish(p.topic("status"), mqttQoS, true, "offline").WaitTimeout(time.Second)
+		}
+		p.client.Disconnect(250)
+	})
+}
+
+// connect makes the first connection, waiting longer after each failure. Paho reconnects by itself after that.
+func (p *MQTTPublisher) connect() {
+	backoff := time.Second
+	for {
+		token := p.client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+		LogMessage(fmt.Sprintf("[yellow]Cannot reach the MQTT broker %s: %v, retrying in %s[white]", p.options.Broker, token.Error(), backoff))
+
+		select {
+		case <-time.After(backoff):
+		case <-p.closed:
+			return
+		}
+		backoff = min(backoff*2, mqttMaxBackoff)
+	}
+}
+
+// handleConnect runs on every connection, a clean session has forgotten our subscription
+func (p *MQTTPublisher) handleConnect(client mqtt.Client) {
+	LogMessage(fmt.Sprintf("Connected to the MQTT broker %s, publishing to %s/#", p.options.Broker, p.options.Topic))
+
+	client.Publish(p.topic("status"), mqttQoS, true, "online")
+	token := client.Subscribe(p.topic("command"), mqttQoS, p.handleCommand)
+	go func() {
+		if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+			LogMessage(fmt.Sprintf("[red]Cannot subscribe to %s: %v[white]", p.topic("command"), token.Error()))
+		}
+	}()
+
+	p.signal()
+}
+
+// handleCommand runs a command from the command topic and publishes its result once the modem has answered
+func (p *MQTTPublisher) handleCommand(client mqtt.Client, message mqtt.Message) {
+	text := strings.TrimSpace(string(message.Payload()))
+
+	var command MQTTCommand
+	if strings.HasPrefix(text, "{") {
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&command); err != nil {
+			p.send("command/result", false, NewErrorRecord(fmt.Errorf("invalid command: %w", err)))
+			return
+		}
+	} else {
+		command.Command = text
+	}
+	if command.Command == "" {
+		p.send("command/result", false, NewErrorRecord(errors.New("no command given")))
+		return
+	}
+	priority, ok := daemonPriorities[command.Priority]
+	if !ok {
+		p.send("command/result", false, NewErrorRecord(fmt.Errorf("invalid priority %q, expected user, flow or background", command.Priority)))
+		return
+	}
+
+	payload := types.ATCommandPayload{
+		Command:  command.Command,
+		OwnerID:  "mqtt",
+		Role:     command.Role,
+		Priority: priority,
+		Timeout:  time.Duration(command.TimeoutMS) * time.Millisecond,
+		Body:     command.Body,
+	}
+	if command.ID != "" {
+		payload.ID = "mqtt/" + command.ID
+	}
+	p.send("command/result", false, NewTransactionRecord(SendAT(p.eventBus, payload)))
+}
+
+// send queues a record for a topic below ours, when the queue is full the oldest message makes room
+func (p *MQTTPublisher) send(topic string, retained bool, record any) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	p.lock.Lock()
+	if len(p.queue) >= mqttOfflineQueue {
+		p.queue = p.queue[1:]
+	}
+	p.next++
+	p.queue = append(p.queue, mqttMessage{seq: p.next, topic: p.topic(topic), retained: retained, payload: payload})
+	p.lock.Unlock()
+
+	p.signal()
+}
+
+// run publishes the queue in order, a message stays at the front until the broker has it
+func (p *MQTTPublisher) run() {
+	for {
+		p.lock.Lock()
+		var message mqttMessage
+		waiting := len(p.queue) > 0
+		if waiting {
+			message = p.queue[0]
+		}
+		p.lock.Unlock()
+
+		if !waiting || !p.client.IsConnectionOpen() {
+			// Woken by a new message or a connection, the timer covers a connection that came back unnoticed
+			select {
+			case <-p.wake:
+			case <-time.After(time.Second):
+			case <-p.closed:
+				return
+			}
+			continue
+		}
+
+		token := p.client.Publish(message.topic, mqttQoS, message.retained, message.payload)
+		if !token.WaitTimeout(mqttTimeout) || token.Error() != nil {
+			select {
+			case <-time.After(time.Second):
+			case <-p.closed:
+				return
+			}
+			continue
+		}
+
+		// It may have made room for newer ones while it went out
+		p.lock.Lock()
+		if len(p.queue) > 0 && p.queue[0].seq == message.seq {
+			p.queue = p.queue[1:]
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (p *MQTTPublisher) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *MQTTPublisher) topic(name string) string {
+	return p.options.Topic + "/" + name
+}
@@ -0,0 +1,262 @@
+package services
+
+import (
+	"atcli/src/types"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const mqttTestTopic = "atcli/test"
+
+// mqttTestMessage is a message the test broker saw below mqttTestTopic
+type mqttTestMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+// mqttTestBroker is an in-process broker that records what is published below mqttTestTopic
+type mqttTestBroker struct {
+	server   *mochi.Server
+	messages chan mqttTestMessage
+}
+
+// freeTCPAddress returns a local address nothing listens on
+func freeTCPAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func startMQTTTestBroker(t *testing.T, address string) *mqttTestBroker {
+	t.Helper()
+
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &mqttTestBroker{server: server, messages: make(chan mqttTestMessage, 100)}
+	err := server.Subscribe(mqttTestTopic+"/#", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		b.messages <- mqttTestMessage{topic: pk.TopicName, payload: string(pk.Payload), retained: pk.FixedHeader.Retain}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return b
+}
+
+// next returns the next message on topic, skipping those on other topics
+func (b *mqttTestBroker) next(t *testing.T, topic string) mqttTestMessage {
+	t.Helper()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-b.messages:
+			if message.topic == mqttTestTopic+"/"+topic {
+				return message
+			}
+		case <-deadline:
+			t.Fatalf("nothing published to %s/%s", mqttTestTopic, topic)
+		}
+	}
+}
+
+// waitForSubscriber waits until a client other than the broker's own subscribed to topic
+func (b *mqttTestBroker) waitForSubscriber(t *testing.T, topic string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.server.Topics.Subscribers(mqttTestTopic+"/"+topic).Subscriptions) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("nobody subscribed to %s/%s", mqttTestTopic, topic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startMQTTTestPublisher(t *testing.T, eventBus *EventBus, address string) *MQTTPublisher {
+	t.Helper()
+
+	publisher, err := NewMQTTPublisher(eventBus, MQTTOptions{
+		Broker:   "tcp://" + address,
+		ClientID: "atcli-test",
+		Topic:    mqttTestTopic + "/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(publisher.Close)
+	return publisher
+}
+
+// answerCommands stands in for the port, every command ends with OK
+func answerCommands(eventBus *EventBus) {
+	eventBus.Subscribe(types.EventATModemCommand, func(event types.Event) {
+		payload, ok := event.Payload.(types.ATCommandPayload)
+		if !ok || payload.Result == nil {
+			return
+		}
+		payload.Result <- types.ATResult{ID: payload.ID, Port: "test", Command: payload.Command, Final: "OK"}
+	})
+}
+
+func TestNewMQTTPublisherOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options MQTTOptions
+		wantErr string
+	}{
+		{"no broker", MQTTOptions{Topic: "atcli"}, "invalid MQTT broker"},
+		{"no host", MQTTOptions{Broker: "tcp://", Topic: "atcli"}, "invalid MQTT broker"},
+		{"unknown scheme", MQTTOptions{Broker: "http://localhost:1883", Topic: "atcli"}, "expected a tcp, ssl, ws or wss URL"},
+		{"no topic", MQTTOptions{Broker: "tcp://localhost:1883", Topic: "/"}, "no MQTT topic given"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewMQTTPublisher(NewEventBus(), test.options)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMQTTPublisherTelemetry(t *testing.T) {
+	address := freeTCPAddress(t)
+	broker := startMQTTTestBroker(t, address)
+	eventBus := NewEventBus()
+	publisher := startMQTTTestPublisher(t, eventBus, address)
+
+	if status := broker.next(t, "status"); status.payload != "online" || !status.retained {
+		t.Fatalf("status %+v, want a retained online", status)
+	}
+
+	TopicSignalUpdated.Publish(eventBus, types.SignalSample{CSQ: 17, BER: 99, RSSI: -79})
+	signal := broker.next(t, "signal")
+	var record SignalRecord
+	if err := json.Unmarshal([]byte(signal.payload), &record); err != nil {
+		t.Fatal(err)
+	}
+	if !signal.retained || record.Type != "signal" || record.CSQ != 17 || record.RSSI != -79 {
+		t.Errorf("signal %+v retained %v, want the sample as a retained record", record, signal.retained)
+	}
+
+	publisher.Close()
+	if status := broker.next(t, "status"); status.payload != "offline" || !status.retained {
+		t.Errorf("status %+v after Close, want a retained offline", status)
+	}
+}
+
+func TestMQTTPublisherCommands(t *testing.T) {
+	address := freeTCPAddress(t)
+	broker := startMQTTTestBroker(t, address)
+	eventBus := NewEventBus()
+	answerCommands(eventBus)
+	startMQTTTestPublisher(t, eventBus, address)
+	broker.waitForSubscriber(t, "command")
+
+	tests := []struct {
+		name    string
+		payload string
+		want    map[string]any // Fields the record on command/result must have
+	}{
+		{
+			name:    "bare command",
+			payload: " AT+CSQ\n",
+			want:    map[string]any{"type": "transaction", "command": "AT+CSQ", "final": "OK", "ok": true},
+		},
+		{
+			name:    "JSON command with an id",
+			payload: `{"id":"7","command":"AT+COPS?","priority":"background"}`,
+			want:    map[string]any{"type": "transaction", "id": "mqtt/7", "command": "AT+COPS?"},
+		},
+		{
+			name:    "invalid JSON",
+			payload: `{"command":"AT","bogus":1}`,
+			want:    map[string]any{"type": "error", "error": `invalid command: json: unknown field "bogus"`},
+		},
+		{
+			name:    "no command",
+			payload: `{"id":"8"}`,
+			want:    map[string]any{"type": "error", "error": "no command given"},
+		},
+		{
+			name:    "invalid priority",
+			payload: `{"command":"AT","priority":"urgent"}`,
+			want:    map[string]any{"type": "error", "error": `invalid priority "urgent", expected user, flow or background`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := broker.server.Publish(mqttTestTopic+"/command", []byte(test.payload), false, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			result := broker.next(t, "command/result")
+			if result.retained {
+				t.Error("command result is retained")
+			}
+			record := map[string]any{}
+			if err := json.Unmarshal([]byte(result.payload), &record); err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range test.want {
+				if record[key] != want {
+					t.Errorf("%s is %v, want %v in %s", key, record[key], want, result.payload)
+				}
+			}
+		})
+	}
+}
+
+func TestMQTTPublisherOfflineQueue(t *testing.T) {
+	// The broker only starts once the records are queued, they go out in order when it is reached
+	address := freeTCPAddress(t)
+	eventBus := NewEventBus()
+	startMQTTTestPublisher(t, eventBus, address)
+
+	for csq := 10; csq < 15; csq++ {
+		TopicSignalUpdated.Publish(eventBus, types.SignalSample{CSQ: csq})
+	}
+
+	broker := startMQTTTestBroker(t, address)
+	for csq := 10; csq < 15; csq++ {
+		var record SignalRecord
+		if err := json.Unmarshal([]byte(broker.next(t, "signal").payload), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.CSQ != csq {
+			t.Fatalf("got CSQ %d, want %d", record.CSQ, csq)
+		}
+	}
+}
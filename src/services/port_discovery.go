@@ -0,0 +1,251 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// PortClass is what a probed port turned out to be
+type PortClass string
+
+const (
+	PortClassAT      PortClass = "at"      // Answers AT commands
+	PortClassPPP     PortClass = "ppp"     // Answers AT and accepts PDP context commands, usable for pppd
+	PortClassNMEA    PortClass = "nmea"    // Streams NMEA sentences
+	PortClassDiag    PortClass = "diag"    // Binary vendor diagnostics, not for us
+	PortClassUnknown PortClass = "unknown" // Silent or could not be opened
+)
+
+// usbVendors maps the USB vendor IDs of common modem makers to a readable name
+var usbVendors = map[string]string{
+	"1e0e": "SIMCom",
+	"2c7c": "Quectel",
+	"1199": "Sierra Wireless",
+	"1bc7": "Telit",
+	"1546": "u-blox",
+	"05c6": "Qualcomm",
+	"12d1": "Huawei",
+}
+
+// PortCandidate is a port found by DiscoverPorts together with what the probe learned
+type PortCandidate struct {
+	Name    string
+	IsUSB   bool
+	VID     string
+	PID     string
+	Vendor  string
+	Product string
+	Classes []PortClass
+	Info    string // First line of the ATI answer, if any
+	Err     error  // Why the port could not be probed
+}
+
+// Is reports whether the probe put the port in the given class
+func (c PortCandidate) Is(class PortClass) bool {
+	for _, have := range c.Classes {
+		if have == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe returns a one line summary for pickers and logs
+func (c PortCandidate) Describe() string {
+	classes := []string{}
+	for _, class := range c.Classes {
+		classes = append(classes, string(class))
+	}
+
+	text := fmt.Sprintf("%s [%s]", c.Name, strings.Join(classes, ","))
+	if c.IsUSB {
+		vendor := c.Vendor
+		if vendor == "" {
+			vendor = c.VID
+		}
+		text += fmt.Sprintf(" %s %s:%s", vendor, c.VID, c.PID)
+	}
+	if c.Info != "" {
+		text += " " + c.Info
+	} else if c.Product != "" {
+		text += " " + c.Product
+	}
+	return text
+}
+
+// portDetail is what the OS told us about a port before probing it
+type portDetail struct {
+	Name    string
+	IsUSB   bool
+	VID     string
+	PID     string
+	Product string
+}
+
+// DiscoverPorts enumerates the serial ports on this machine and probes them all in parallel
+func DiscoverPorts(baudRate int, timeout time.Duration) ([]PortCandidate, error) {
+	details, err := listPortDetails()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]PortCandidate, len(details))
+	wg := sync.WaitGroup{}
+	for i, detail := range details {
+		candidates[i] = PortCandidate{
+			Name:    detail.Name,
+			IsUSB:   detail.IsUSB,
+			VID:     strings.ToLower(detail.VID),
+			PID:     strings.ToLower(detail.PID),
+			Product: detail.Product,
+		}
+		candidates[i].Vendor = usbVendors[candidates[i].VID]
+
+		wg.Add(1)
+		go func(candidate *PortCandidate) {
+			defer wg.Done()
+			probePort(candidate, baudRate, timeout)
+		}(&candidates[i])
+	}
+	wg.Wait()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	return candidates, nil
+}
+
+// SelectATPort picks the port to talk AT on. A plain AT port is preferred over one that is
+// also PPP capable so the data port stays free for pppd. When the choice is ambiguous all
+// the equally good ports are returned and the caller should ask the user.
+func SelectATPort(candidates []PortCandidate) (selected *PortCandidate, choices []PortCandidate) {
+	plain := []PortCandidate{}
+	ppp := []PortCandidate{}
+	for _, candidate := range candidates {
+		if !candidate.Is(PortClassAT) {
+			continue
+		}
+		if candidate.Is(PortClassPPP) {
+			ppp = append(ppp, candidate)
+		} else {
+			plain = append(plain, candidate)
+		}
+	}
+
+	best := plain
+	if len(best) == 0 {
+		best = ppp
+	}
+
+	if len(best) == 1 {
+		return &best[0], nil
+	}
+
+	return nil, append(plain, ppp...)
+}
+
+// probePort opens a port, listens for NMEA, then tries AT, ATI and a PDP context query
+func probePort(candidate *PortCandidate, baudRate int, timeout time.Duration) {
+	port, err := serial.Open(candidate.Name, &serial.Mode{BaudRate: baudRate})
+	if err != nil {
+		candidate.Err = err
+		candidate.Classes = []PortClass{PortClassUnknown}
+		return
+	}
+	defer port.Close()
+
+	port.SetReadTimeout(50 * time.Millisecond)
+	port.ResetInputBuffer()
+
+	// GNSS ports stream on their own, listen before sending anything
+	heard := probeRead(port, timeout/2, nil)
+	if isNMEA(heard) {
+		candidate.Classes = []PortClass{PortClassNMEA}
+		return
+	}
+
+	answer := probeCommand(port, "AT", timeout)
+	if !strings.Contains(answer, "OK") {
+		if isBinary(heard + answer) {
+			candidate.Classes = []PortClass{PortClassDiag}
+		} else {
+			candidate.Classes = []PortClass{PortClassUnknown}
+		}
+		return
+	}
+	candidate.Classes = []PortClass{PortClassAT}
+
+	for _, line := range strings.Split(probeCommand(port, "ATI", timeout), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "ATI" && line != "OK" {
+			candidate.Info = line
+			break
+		}
+	}
+
+	if strings.Contains(probeCommand(port, "AT+CGDCONT?", timeout), "OK") {
+		candidate.Classes = append(candidate.Classes, PortClassPPP)
+	}
+}
+
+// probeCommand sends a command and collects the answer until a final result or the timeout
+func probeCommand(port Transport, command string, timeout time.Duration) string {
+	if _, err := port.Write([]byte(command + "\r")); err != nil {
+		return ""
+	}
+
+	return probeRead(port, timeout, func(text string) bool {
+		return strings.Contains(text, "OK\r") || strings.Contains(text, "ERROR")
+	})
+}
+
+// probeRead reads for up to timeout, stopping early once done reports the text is complete
+func probeRead(port Transport, timeout time.Duration, done func(string) bool) string {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 256)
+	text := ""
+
+	for time.Now().Before(deadline) {
+		n, err := port.Read(buf)
+		if err != nil {
+			break
+		}
+		text += string(buf[:n])
+		if done != nil && done(text) {
+			break
+		}
+	}
+
+	return text
+}
+
+func isNMEA(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 6 && line[0] == '$' && strings.Contains(line, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func isBinary(text string) bool {
+	if text == "" {
+		return false
+	}
+
+	binary := 0
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		if (b < 0x20 && b != '\r' && b != '\n' && b != '\t') || b > 0x7e {
+			binary++
+		}
+	}
+	return binary*4 > len(text)
+}
@@ -0,0 +1,37 @@
+//go:build !darwin || cgo
+
+package services
+
+import (
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// listPortDetails returns every serial port with its USB details where the OS provides them
+func listPortDetails() ([]portDetail, error) {
+	details := []portDetail{}
+
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		// Not every platform has the detailed enumerator, fall back to plain names
+		names, err := serial.GetPortsList()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			details = append(details, portDetail{Name: name})
+		}
+		return details, nil
+	}
+
+	for _, port := range ports {
+		details = append(details, portDetail{
+			Name:    port.Name,
+			IsUSB:   port.IsUSB,
+			VID:     port.VID,
+			PID:     port.PID,
+			Product: port.Product,
+		})
+	}
+	return details, nil
+}
@@ -0,0 +1,21 @@
+//go:build darwin && !cgo
+
+package services
+
+import (
+	"go.bug.st/serial"
+)
+
+// listPortDetails only has port names on macOS builds without cgo, the USB details come from IOKit
+func listPortDetails() ([]portDetail, error) {
+	names, err := serial.GetPortsList()
+	if err != nil {
+		return nil, err
+	}
+
+	details := []portDetail{}
+	for _, name := range names {
+		details = append(details, portDetail{Name: name})
+	}
+	return details, nil
+}
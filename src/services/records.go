@@ -0,0 +1,437 @@
+package services
+
+import (
+	"atcli/src/types"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TransactionRecord is a finished command in machine-readable output
+type TransactionRecord struct {
+	Type     string         `json:"type"` // Always "transaction"
+	ID       string         `json:"id"`
+	Port     string         `json:"port"`
+	Role     types.PortRole `json:"role"`
+	Command  string         `json:"command"`
+	Lines    []string       `json:"lines"`
+	Final    string         `json:"final"`
+	OK       bool           `json:"ok"`
+	Error    string         `json:"error,omitempty"`
+	Sent     time.Time      `json:"sent"`
+	Duration float64        `json:"duration_ms"`
+}
+
+// URCRecord is an unsolicited line in machine-readable output
+type URCRecord struct {
+	Type string         `json:"type"` // Always "urc"
+	Port string         `json:"port"`
+	Role types.PortRole `json:"role"`
+	Text string         `json:"text"`
+	Time time.Time      `json:"time"`
+}
+
+// FlowRecord is a finished flow in machine-readable output, its commands show up as transactions before it
+type FlowRecord struct {
+	Type     string            `json:"type"` // Always "flow"
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	OK       bool              `json:"ok"`
+	Error    string            `json:"error,omitempty"`
+	Steps    int               `json:"steps"`
+	Vars     map[string]string `json:"vars"`
+	Duration float64           `json:"duration_ms"`
+}
+
+// LineRecord is a line of traffic from the modem, what the replies panel shows
+type LineRecord struct {
+	Type string         `json:"type"` // Always "line"
+	Port string         `json:"port"`
+	Role types.PortRole `json:"role"`
+	Text string         `json:"text"`
+	Time time.Time      `json:"time"`
+}
+
+// PromptRecord is a > prompt waiting for text
+type PromptRecord struct {
+	Type string         `json:"type"` // Always "prompt"
+	ID   string         `json:"id"`   // Of the transaction whose command opened it
+	Port string         `json:"port"`
+	Role types.PortRole `json:"role"`
+}
+
+// QueueRecord is the state of a port's command queue
+type QueueRecord struct {
+	Type     string         `json:"type"` // Always "queue"
+	Port     string         `json:"port"`
+	Role     types.PortRole `json:"role"`
+	Depth    int            `json:"depth"`
+	InFlight string         `json:"in_flight"`
+}
+
+// ErrorRecord is a serial error
+type ErrorRecord struct {
+	Type  string    `json:"type"` // Always "error"
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// StateRecord is a change of the connection to the modem
+type StateRecord struct {
+	Type    string                `json:"type"` // Always "state"
+	Port    string                `json:"port"`
+	Role    types.PortRole        `json:"role"`
+	State   types.ConnectionState `json:"state"`
+	Attempt int                   `json:"attempt,omitempty"`
+	Error   string                `json:"error,omitempty"`
+}
+
+// ModemLinesRecord is the state of the control lines of a port
+type ModemLinesRecord struct {
+	Type string         `json:"type"` // Always "modem_lines"
+	Port string         `json:"port"`
+	Role types.PortRole `json:"role"`
+	DTR  bool           `json:"dtr"`
+	RTS  bool           `json:"rts"`
+	CTS  bool           `json:"cts"`
+	DSR  bool           `json:"dsr"`
+	RI   bool           `json:"ri"`
+	DCD  bool           `json:"dcd"`
+}
+
+// LineModeRecord is a change of the line settings of a port
+type LineModeRecord struct {
+	Type string         `json:"type"` // Always "line_mode"
+	Port string         `json:"port"`
+	Role types.PortRole `json:"role"`
+	Mode string         `json:"mode"`
+}
+
+// StepRecord is a finished step of a flow
+type StepRecord struct {
+	Type     string `json:"type"` // Always "step"
+	ID       string `json:"id"`   // Of the flow
+	Flow     string `json:"flow"`
+	Index    int    `json:"index"`
+	Total    int    `json:"total"`
+	Name     string `json:"name,omitempty"`
+	Command  string `json:"command"`
+	Attempts int    `json:"attempts"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SignalRecord is a signal strength reading
+type SignalRecord struct {
+	Type string    `json:"type"` // Always "signal"
+	CSQ  int       `json:"csq"`
+	BER  int       `json:"ber"`
+	RSSI int       `json:"rssi_dbm,omitempty"`
+	RSRP int       `json:"rsrp_dbm,omitempty"`
+	RSRQ float64   `json:"rsrq_db,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// GPSRecord is a GNSS position
+type GPSRecord struct {
+	Type       string    `json:"type"` // Always "gps"
+	Fix        bool      `json:"fix"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Altitude   float64   `json:"altitude"`
+	Satellites int       `json:"satellites"`
+	UTC        string    `json:"utc,omitempty"`
+	Date       string    `json:"date,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// RegistrationRecord is the network registration of the modem
+type RegistrationRecord struct {
+	Type       string    `json:"type"` // Always "registration"
+	Port       string    `json:"port"`
+	Domain     string    `json:"domain"`
+	Stat       int       `json:"stat"`
+	Status     string    `json:"status"`
+	Registered bool      `json:"registered"`
+	Area       string    `json:"area,omitempty"`
+	CellID     string    `json:"cell_id,omitempty"`
+	AccessTech *int      `json:"access_tech,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// EventRecord is an event traced on the bus, what the /events panel exports
+type EventRecord struct {
+	Type      string          `json:"type"` // Always "event"
+	Seq       uint64          `json:"seq"`
+	Event     types.EventType `json:"event"`
+	Payload   string          `json:"payload,omitempty"`
+	Publisher string          `json:"publisher"`
+	Handlers  []HandlerRecord `json:"handlers"`
+	Queued    int             `json:"queued"`
+	Duration  float64         `json:"duration_ms"`
+	Time      time.Time       `json:"time"`
+}
+
+// HandlerRecord is how one subscriber took a traced event
+type HandlerRecord struct {
+	Name     string  `json:"name"`
+	Queued   bool    `json:"queued"`
+	Duration float64 `json:"duration_ms"`
+}
+
+// NewTransactionRecord describes an ATResult
+func NewTransactionRecord(result types.ATResult) TransactionRecord {
+	lines := result.Lines
+	if lines == nil {
+		lines = []string{}
+	}
+
+	return TransactionRecord{
+		Type:     "transaction",
+		ID:       result.ID,
+		Port:     result.Port,
+		Role:     result.Role,
+		Command:  result.Command,
+		Lines:    lines,
+		Final:    result.Final,
+		OK:       result.OK(),
+		Error:    errorText(result.Err),
+		Sent:     result.Sent,
+		Duration: milliseconds(result.Duration),
+	}
+}
+
+// NewURCRecord describes a URC, stamped with the time it is recorded
+func NewURCRecord(line types.SerialLine) URCRecord {
+	return URCRecord{Type: "urc", Port: line.Port, Role: line.Role, Text: line.Text, Time: time.Now()}
+}
+
+// NewFlowRecord describes an ATFlowResult
+func NewFlowRecord(result types.ATFlowResult) FlowRecord {
+	return FlowRecord{
+		Type:     "flow",
+		ID:       result.ID,
+		Name:     result.Name,
+		OK:       result.OK(),
+		Error:    errorText(result.Err),
+		Steps:    len(result.Steps),
+		Vars:     result.Vars,
+		Duration: milliseconds(result.Duration),
+	}
+}
+
+// NewLineRecord describes a line of traffic, stamped with the time it is recorded
+func NewLineRecord(line types.SerialLine) LineRecord {
+	return LineRecord{Type: "line", Port: line.Port, Role: line.Role, Text: line.Text, Time: time.Now()}
+}
+
+// NewPromptRecord describes the > prompt of EventPrompt
+func NewPromptRecord(prompt types.Prompt) PromptRecord {
+	return PromptRecord{Type: "prompt", ID: prompt.ID, Port: prompt.Port, Role: prompt.Role}
+}
+
+// NewQueueRecord describes an ATQueueStatus
+func NewQueueRecord(status types.ATQueueStatus) QueueRecord {
+	return QueueRecord{Type: "queue", Port: status.Port, Role: status.Role, Depth: status.Depth, InFlight: status.InFlight}
+}
+
+// NewErrorRecord describes the error of EventSerialError
+func NewErrorRecord(err error) ErrorRecord {
+	return ErrorRecord{Type: "error", Error: errorText(err), Time: time.Now()}
+}
+
+// NewStateRecord describes a ConnectionStatus
+func NewStateRecord(status types.ConnectionStatus) StateRecord {
+	return StateRecord{
+		Type:    "state",
+		Port:    status.Port,
+		Role:    status.Role,
+		State:   status.State,
+		Attempt: status.Attempt,
+		Error:   errorText(status.Err),
+	}
+}
+
+// NewModemLinesRecord describes ModemLines
+func NewModemLinesRecord(lines types.ModemLines) ModemLinesRecord {
+	return ModemLinesRecord{
+		Type: "modem_lines",
+		Port: lines.Port,
+		Role: lines.Role,
+		DTR:  lines.DTR,
+		RTS:  lines.RTS,
+		CTS:  lines.CTS,
+		DSR:  lines.DSR,
+		RI:   lines.RI,
+		DCD:  lines.DCD,
+	}
+}
+
+// NewLineModeRecord describes a LineMode
+func NewLineModeRecord(mode types.LineMode) LineModeRecord {
+	return LineModeRecord{Type: "line_mode", Port: mode.Port, Role: mode.Role, Mode: mode.Mode}
+}
+
+// NewStepRecord describes an ATFlowProgress
+func NewStepRecord(progress types.ATFlowProgress) StepRecord {
+	step := progress.Step
+	return StepRecord{
+		Type:     "step",
+		ID:       progress.ID,
+		Flow:     progress.Name,
+		Index:    progress.Index,
+		Total:    progress.Total,
+		Name:     step.Name,
+		Command:  step.Command,
+		Attempts: step.Attempts,
+		Skipped:  step.Skipped,
+		OK:       step.Err == nil,
+		Error:    errorText(step.Err),
+	}
+}
+
+// NewSignalRecord describes a SignalSample
+func NewSignalRecord(sample types.SignalSample) SignalRecord {
+	return SignalRecord{
+		Type: "signal",
+		CSQ:  sample.CSQ,
+		BER:  sample.BER,
+		RSSI: sample.RSSI,
+		RSRP: sample.RSRP,
+		RSRQ: sample.RSRQ,
+		Time: sample.Time,
+	}
+}
+
+// NewGPSRecord describes a GPSFix
+func NewGPSRecord(fix types.GPSFix) GPSRecord {
+	return GPSRecord{
+		Type:       "gps",
+		Fix:        fix.Fix,
+		Latitude:   fix.Latitude,
+		Longitude:  fix.Longitude,
+		Altitude:   fix.Altitude,
+		Satellites: fix.Satellites,
+		UTC:        fix.UTC,
+		Date:       fix.Date,
+		Time:       fix.Time,
+	}
+}
+
+// NewRegistrationRecord describes a Registration
+func NewRegistrationRecord(registration types.Registration) RegistrationRecord {
+	record := RegistrationRecord{
+		Type:       "registration",
+		Port:       registration.Port,
+		Domain:     registration.Domain,
+		Stat:       registration.Stat,
+		Status:     registration.Status,
+		Registered: registration.Registered,
+		Area:       registration.Area,
+		CellID:     registration.CellID,
+		Time:       registration.Time,
+	}
+	if registration.AccessTech >= 0 {
+		record.AccessTech = &registration.AccessTech
+	}
+	return record
+}
+
+// NewEventRecord describes an EventTrace
+func NewEventRecord(trace EventTrace) EventRecord {
+	handlers := make([]HandlerRecord, 0, len(trace.Handlers))
+	for _, handler := range trace.Handlers {
+		handlers = append(handlers, HandlerRecord{Name: handler.Name, Queued: handler.Queued, Duration: milliseconds(handler.Duration)})
+	}
+
+	return EventRecord{
+		Type:      "event",
+		Seq:       trace.Seq,
+		Event:     trace.Event.Type,
+		Payload:   SummarizePayload(trace.Event.Payload),
+		Publisher: trace.Publisher,
+		Handlers:  handlers,
+		Queued:    trace.Queued,
+		Duration:  milliseconds(trace.Duration),
+		Time:      trace.Time,
+	}
+}
+
+// The records turned back into event payloads, for clients that feed them to the views
+
+// ATResult is the result the record describes
+func (r TransactionRecord) ATResult() types.ATResult {
+	return types.ATResult{
+		ID:       r.ID,
+		Port:     r.Port,
+		Role:     r.Role,
+		Command:  r.Command,
+		Lines:    r.Lines,
+		Final:    r.Final,
+		Err:      errorFromText(r.Error),
+		Sent:     r.Sent,
+		Duration: duration(r.Duration),
+	}
+}
+
+// ATFlowResult is the result the record describes, without the steps
+func (r FlowRecord) ATFlowResult() types.ATFlowResult {
+	return types.ATFlowResult{ID: r.ID, Name: r.Name, Vars: r.Vars, Err: errorFromText(r.Error), Duration: duration(r.Duration)}
+}
+
+// ATFlowProgress is the progress the record describes, without the step's answer
+func (r StepRecord) ATFlowProgress() types.ATFlowProgress {
+	return types.ATFlowProgress{
+		ID:    r.ID,
+		Name:  r.Flow,
+		Index: r.Index,
+		Total: r.Total,
+		Step: types.ATFlowStepResult{
+			Name:     r.Name,
+			Command:  r.Command,
+			Attempts: r.Attempts,
+			Skipped:  r.Skipped,
+			Err:      errorFromText(r.Error),
+		},
+	}
+}
+
+// ConnectionStatus is the status the record describes
+func (r StateRecord) ConnectionStatus() types.ConnectionStatus {
+	return types.ConnectionStatus{Port: r.Port, Role: r.Role, State: r.State, Attempt: r.Attempt, Err: errorFromText(r.Error)}
+}
+
+// ModemLines are the lines the record describes
+func (r ModemLinesRecord) ModemLines() types.ModemLines {
+	return types.ModemLines{Port: r.Port, Role: r.Role, DTR: r.DTR, RTS: r.RTS, CTS: r.CTS, DSR: r.DSR, RI: r.RI, DCD: r.DCD}
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func errorFromText(text string) error {
+	if text == "" {
+		return nil
+	}
+	// Keep errors.Is working for the errors callers check for
+	for _, known := range []error{ErrCancelled, ErrTimeout} {
+		if rest, ok := strings.CutPrefix(text, known.Error()+" "); ok {
+			return fmt.Errorf("%w %s", known, rest)
+		}
+	}
+	return errors.New(text)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func duration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
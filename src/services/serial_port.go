@@ -4,72 +4,280 @@ import (
 	"atcli/src/types"
 	"fmt"
 	"os"
-	"os/signal"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
-
-	"github.com/rivo/tview"
-	"go.bug.st/serial"
 )
 
+// reconnectInterval is how long to wait between attempts to reopen a lost port
+const reconnectInterval = 1 * time.Second
+
 type SerialPort struct {
-	port     serial.Port
+	port     Transport
+	portName string
+	role     types.PortRole
+	config   LineConfig
 	eventBus *EventBus
 
-	flowLock  sync.Mutex // Ensures only one flow or command at a time
-	flowOwner string     // Owner ID for re-entrant lock
-	flowCond  *sync.Cond // For waiting on flow lock
+	connLock sync.Mutex // Guards port, config and state while reconnecting
+	state    types.ConnectionState
+	closed   chan struct{}
+	closing  sync.Once
+
+	queue       *commandQueue // Every command goes through here so they don't interleave
+	txStateLock sync.Mutex    // Guards inflight
+	inflight    *atTransaction
+
+	linesLock sync.Mutex // Guards lines
+	lines     types.ModemLines
 }
 
-func NewSerialPort(eventBus *EventBus, app *tview.Application, portName string, baudRate int) *SerialPort {
-	mode := serial.Mode{
-		BaudRate: baudRate,
-		Parity:   serial.NoParity,
-		StopBits: serial.OneStopBit,
+// NewSerialPort opens a port for the given role. Only AT capable roles take commands,
+// an NMEA port just publishes what it reads.
+func NewSerialPort(eventBus *EventBus, portName string, config LineConfig, role types.PortRole) (*SerialPort, error) {
+	// Settings in the port URL query win over the command line ones
+	config, err := config.WithPortOverrides(portName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid line settings: %w", err)
 	}
 
-	port, err := serial.Open(portName, &mode)
+	// portName is a URL such as serial:///dev/ttyUSB2 or tcp://host:port, plain device paths still work
+	port, err := openWithConfig(portName, config)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open serial port %s: %v\n", portName, err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to open serial port %s: %w", portName, err)
 	}
 
-	// Handle Ctrl+C gracefully
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		<-c
-		app.Stop()
-		os.Exit(0)
-	}()
-
 	self := &SerialPort{
 		port:     port,
+		portName: portName,
+		role:     role,
+		config:   config,
 		eventBus: eventBus,
+		state:    types.ConnectionConnected,
+		closed:   make(chan struct{}),
+		queue:    newCommandQueue(),
 	}
-	self.flowCond = sync.NewCond(&self.flowLock)
+	self.lines = types.ModemLines{Port: portName, Role: role, DTR: config.DTR, RTS: config.RTS}
+
+	self.setState(types.ConnectionConnected, 0, nil)
 
 	// Goroutine to read from serial and update repliesView
 	go self.Read()
+	go self.monitorLines()
+	go self.runQueue()
+	go self.watchQueue()
+
+	if role == types.RoleNMEA {
+		return self, nil
+	}
+
+	eventBus.Subscribe(types.EventSetModemLine, func(event types.Event) {
+		request, ok := event.Payload.(types.ModemLineRequest)
+		if !ok {
+			return
+		}
+		go func() {
+			if err := self.SetModemLine(request); err != nil {
+				TopicSerialError.Publish(eventBus, err)
+			}
+		}()
+	})
 
-	// The caller is responsible for acquiring the flow lock and setting OwnerID in the payload for flows.
-	// For single commands, lock acquisition should be done by the caller as well if needed.
 	eventBus.Subscribe(types.EventATModemCommand, self.Write)
 
+	eventBus.Subscribe(types.EventPromptReply, func(event types.Event) {
+		reply, ok := event.Payload.(types.PromptReply)
+		if !ok {
+			return
+		}
+		// Replies without a role are for the main AT port
+		if reply.Role == "" {
+			reply.Role = types.RoleAT
+		}
+		if reply.Role != self.role {
+			return
+		}
+		go func() {
+			if err := self.AnswerPrompt(reply); err != nil {
+				TopicSerialError.Publish(eventBus, err)
+			}
+		}()
+	})
+
+	eventBus.Subscribe(types.EventCancelAT, func(event types.Event) {
+		id, _ := event.Payload.(string)
+		go func() {
+			if n := self.Cancel(id); n > 0 {
+				LogMessage(fmt.Sprintf("[yellow]Cancelled %d command(s) on %s[white]", n, self.portName))
+			}
+		}()
+	})
+
+	// Flows only run on the main AT port
+	if role != types.RoleAT {
+		return self, nil
+	}
+
 	// Subscribe to EventATModemFlow for running multi-step flows
-	// The payload is expected to be []services.ATFlowStep for now
-	// In the future, this can be extended to a struct with more metadata
 	eventBus.Subscribe(types.EventATModemFlow, func(event types.Event) {
 		go self.RunFlow(event)
 	})
 
-	return self
+	eventBus.Subscribe(types.EventChangeBaudRate, func(event types.Event) {
+		rate, ok := event.Payload.(int)
+		if !ok {
+			return
+		}
+		go func() {
+			if err := self.ChangeBaudRate(rate); err != nil {
+				TopicSerialError.Publish(eventBus, err)
+			}
+		}()
+	})
+
+	return self, nil
+}
+
+// openWithConfig opens the transport and puts the full line config on it
+func openWithConfig(portName string, config LineConfig) (Transport, error) {
+	mode := config.Mode()
+	port, err := OpenTransport(portName, &mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ApplyLineConfig(port, config); err != nil {
+		port.Close()
+		return nil, err
+	}
+
+	return port, nil
+}
+
+// LineConfig returns the line settings in effect for this port
+func (s *SerialPort) LineConfig() LineConfig {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return s.config
+}
+
+// PortName returns the name the port was opened with, e.g. /dev/ttyUSB2 or cmux://1
+func (s *SerialPort) PortName() string {
+	return s.portName
 }
 
 func (s *SerialPort) Close() {
-	s.port.Close()
+	s.closing.Do(func() {
+		close(s.closed)
+	})
+
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.port != nil {
+		s.port.Close()
+	}
+}
+
+// currentPort returns the open transport, or nil while the connection is down
+func (s *SerialPort) currentPort() Transport {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.state == types.ConnectionLost || s.state == types.ConnectionReconnecting {
+		return nil
+	}
+	return s.port
+}
+
+func (s *SerialPort) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// setState records the connection state and lets the rest of the app know about it
+func (s *SerialPort) setState(state types.ConnectionState, attempt int, err error) {
+	s.connLock.Lock()
+	s.state = state
+	s.connLock.Unlock()
+
+	s.eventBus.Publish(types.Event{
+		Type: types.EventConnectionState,
+		Payload: types.ConnectionStatus{
+			Port:    s.portName,
+			Role:    s.role,
+			State:   state,
+			Attempt: attempt,
+			Err:     err,
+		},
+	})
+}
+
+// reconnect drops the dead handle and keeps reopening the port with the same line config until it comes back.
+// Returns false if the port was closed while waiting, or it was a CMUX channel and the multiplexer is gone.
+func (s *SerialPort) reconnect(cause error) bool {
+	// A channel can be opened again while its multiplexer runs, once that has closed it never comes back
+	var muxDone <-chan struct{}
+	s.connLock.Lock()
+	if channel, ok := s.port.(*CMUXChannel); ok {
+		muxDone = channel.mux.Done()
+	}
+	if s.port != nil {
+		s.port.Close()
+		s.port = nil
+	}
+	s.connLock.Unlock()
+
+	s.setState(types.ConnectionLost, 0, cause)
+	LogMessage(fmt.Sprintf("[red]Lost connection to %s: %v[white]", s.portName, cause))
+
+	target, err := ParsePortURL(s.portName)
+	if err != nil {
+		return false
+	}
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-s.closed:
+			return false
+		case <-muxDone:
+			LogMessage(fmt.Sprintf("[red]The multiplexer under %s has closed, not reconnecting[white]", s.portName))
+			return false
+		case <-time.After(reconnectInterval):
+		}
+
+		// A USB modem that reset has no device node until it re-enumerates, no point trying to open it before then
+		if target.Scheme == "serial" {
+			if _, err := os.Stat(devicePath(target)); err != nil {
+				continue
+			}
+		}
+
+		s.setState(types.ConnectionReconnecting, attempt, nil)
+
+		port, err := openWithConfig(s.portName, s.LineConfig())
+		if err != nil {
+			LogMessage(fmt.Sprintf("[yellow]Reconnect attempt %d to %s failed: %v[white]", attempt, s.portName, err))
+			continue
+		}
+
+		s.connLock.Lock()
+		s.port = port
+		s.connLock.Unlock()
+
+		// The port may have been closed while we were opening it
+		if s.isClosed() {
+			port.Close()
+			return false
+		}
+
+		s.setState(types.ConnectionReconnected, attempt, nil)
+		LogMessage(fmt.Sprintf("[green]Reconnected to %s after %d attempt(s)[white]", s.portName, attempt))
+		return true
+	}
 }
 
 func (s *SerialPort) Read() {
@@ -79,12 +287,26 @@ func (s *SerialPort) Read() {
 	buf := make([]byte, 256)
 	partial := ""
 	for {
-		n, err := s.port.Read(buf)
+		port := s.currentPort()
+		if port == nil {
+			return
+		}
+
+		n, err := port.Read(buf)
 		if err != nil {
+			if s.isClosed() {
+				return
+			}
+
+			// Report the failure once, then stay quiet until the port is back
 			mu.Lock()
-			s.eventBus.Publish(types.Event{Type: types.EventSerialError, Payload: err})
+			TopicSerialError.Publish(s.eventBus, err)
 			mu.Unlock()
-			time.Sleep(1 * time.Second)
+
+			partial = ""
+			if !s.reconnect(err) {
+				return
+			}
 			continue
 		}
 		if n > 0 {
@@ -97,7 +319,14 @@ func (s *SerialPort) Read() {
 					break
 				}
 
-				s.eventBus.Publish(types.Event{Type: types.EventSerialResponse, Payload: strings.TrimSpace(line)})
+				TopicSerialResponse.Publish(s.eventBus, s.line(line))
+				s.classifyLine(strings.TrimSpace(line))
+				partial = ""
+			}
+
+			// A > prompt has no line ending, the modem waits for the text of e.g. AT+CMGS after it
+			if strings.TrimSpace(partial) == ">" && s.openPrompt() {
+				TopicSerialResponse.Publish(s.eventBus, s.line(partial))
 				partial = ""
 			}
 			mu.Unlock()
@@ -105,151 +334,113 @@ func (s *SerialPort) Read() {
 	}
 }
 
-// Write writes to the serial port. The event.Payload should be ATCommandPayload, with Command and OwnerID fields.
+// line tags a line of traffic with this port
+func (s *SerialPort) line(text string) types.SerialLine {
+	return types.SerialLine{Port: s.portName, Role: s.role, Text: strings.TrimSpace(text)}
+}
+
+// Write queues a command from the event bus. The event.Payload should be ATCommandPayload, plain strings are taken as typed by the user.
+// The result is published as EventATResult, and sent on payload.Result if set.
 func (s *SerialPort) Write(event types.Event) {
-	mu := sync.Mutex{}
 	payload, ok := event.Payload.(types.ATCommandPayload)
 	if !ok {
 		// fallback for legacy string payloads
 		command, ok := event.Payload.(string)
 		if !ok {
-			s.eventBus.Publish(types.Event{Type: types.EventSerialError, Payload: fmt.Errorf("invalid AT command payload")})
+			TopicSerialError.Publish(s.eventBus, fmt.Errorf("invalid AT command payload"))
 			return
 		}
-		payload = types.ATCommandPayload{Command: command, OwnerID: ""}
-	}
-	ownerID := payload.OwnerID
-	command := payload.Command
-
-	// Check flow lock ownership
-	s.flowLock.Lock()
-	if s.flowOwner != "" && s.flowOwner != ownerID {
-		s.flowLock.Unlock()
-		mu.Lock()
-		s.eventBus.Publish(types.Event{Type: types.EventSerialError, Payload: fmt.Errorf("flow lock held by another owner: ownerId=%s", s.flowOwner)})
-		mu.Unlock()
-		return
+		payload = types.ATCommandPayload{Command: command, Priority: types.PriorityUser}
 	}
-	s.flowLock.Unlock()
 
-	// Send the command to the serial port
-	_, err := s.port.Write([]byte(command + "\r\n"))
-
-	// If you want to debug your requests uncomment this
-	LogMessage(fmt.Sprintf("-> %s", command))
-
-	if err != nil {
-		mu.Lock()
-		s.eventBus.Publish(types.Event{Type: types.EventSerialError, Payload: err})
-		mu.Unlock()
-	} else {
-		mu.Lock()
-		// Echo the command with the prefix to the command view
-		s.eventBus.Publish(types.Event{Type: types.EventSerialResponse, Payload: strings.TrimSpace(command)})
-		mu.Unlock()
+	// Commands without a role are for the main AT port
+	role := payload.Role
+	if role == "" {
+		role = types.RoleAT
 	}
-}
-
-// RunFlow executes a multi-step AT command flow with flow lock management.
-// The event.Payload must be []services.ATFlowStep.
-func (s *SerialPort) RunFlow(event types.Event) {
-	ownerID := fmt.Sprintf("flow-%d", time.Now().UnixNano())
-	if err := s.AcquireFlowLock(ownerID, 120*time.Second); err != nil {
-		s.eventBus.Publish(types.Event{Type: types.EventSerialError, Payload: fmt.Errorf("could not acquire flow lock for flow: %w", err)})
+	if role != s.role {
 		return
 	}
-	defer s.ReleaseFlowLock(ownerID)
 
-	steps, ok := event.Payload.([]types.ATFlowStep)
-	if !ok {
-		s.eventBus.Publish(types.Event{Type: types.EventSerialError, Payload: fmt.Errorf("invalid flow payload: expected []ATFlowStep")})
+	if strings.TrimSpace(payload.Command) == "" {
 		return
 	}
 
-	// FIXME: This is not working logic, but it actually does work
-	// FIXME: However, stepping through the logic, I can clearly see how it's
-	// FIXME: Pretty awful and doesn't really work. It just accidentally works
+	// The publisher shouldn't wait for the modem, queueing here keeps commands from one publisher in order
+	s.submit(payload, nil)
+}
 
-	for _, step := range steps {
-		responsesCh := make(chan string, len(step.ExpectedResponses))
-		received := make(map[string]bool)
+// RunFlow runs a flow from the event bus. The event.Payload must be types.ATFlow or []types.ATFlowStep.
+// The ATFlowResult is published as EventATFlowResult, and sent on the flow's Result if set.
+func (s *SerialPort) RunFlow(event types.Event) {
+	var flow types.ATFlow
+	switch payload := event.Payload.(type) {
+	case types.ATFlow:
+		flow = payload
+	case []types.ATFlowStep:
+		flow = types.ATFlow{Steps: payload}
+	default:
+		TopicSerialError.Publish(s.eventBus, fmt.Errorf("invalid flow payload: expected ATFlow or []ATFlowStep"))
+		return
+	}
 
-		// Handler for serial responses
-		handler := func(ev types.Event) {
-			resp, ok := ev.Payload.(string)
-			if !ok {
-				return
-			}
-			// Ignore command echo
-			if strings.HasPrefix(resp, "-> ") {
-				return
-			}
-			if len(resp) == 0 {
-				return
-			}
-			for _, expected := range step.ExpectedResponses {
-				LogMessage("expected: '" + expected + "', resp: '" + resp + "'")
-				if resp != expected {
-					return
-				}
+	result := NewATFlowRunner(s, flow).Run()
 
-				responsesCh <- expected
-				received[expected] = true
-			}
+	s.eventBus.Publish(types.Event{Type: types.EventATFlowResult, Payload: result})
+	if flow.Result != nil {
+		select {
+		case flow.Result <- result:
+		default:
 		}
+	}
+}
 
-		// Subscribe
-		s.eventBus.Subscribe(types.EventSerialResponse, handler)
-
-		payload := types.ATCommandPayload{Command: step.Command, OwnerID: ownerID}
-		s.Write(types.Event{Type: types.EventATModemCommand, Payload: payload})
-
-		// Wait for all expected responses or timeout
-		allReceived := false
-		waitTimeout := time.After(3 * time.Second)
-		for count := 0; count < len(step.ExpectedResponses); {
-			select {
-			case <-responsesCh:
-				count++
-			case <-waitTimeout:
-				s.eventBus.Publish(types.Event{Type: types.EventSerialError, Payload: fmt.Errorf("timeout waiting for response to '%s'", step.Command)})
-				allReceived = false
-				goto unsubscribe
-			}
-		}
-		allReceived = true
+// ChangeBaudRate asks the modem to move to a new rate with AT+IPR, then follows it on our side of the line
+func (s *SerialPort) ChangeBaudRate(rate int) error {
+	port := s.currentPort()
+	if port == nil {
+		return fmt.Errorf("not connected to %s", s.portName)
+	}
 
-	unsubscribe:
-		// Unsubscribe handler
-		s.eventBus.Unsubscribe(types.EventSerialResponse, handler)
-		if !allReceived {
-			break // abort flow on timeout
-		}
+	// Make sure our side can follow before the modem moves away from us
+	config := s.LineConfig()
+	mode := config.Mode()
+	if err := port.SetMode(&mode); err != nil {
+		return fmt.Errorf("cannot change the baud rate of %s: %w", s.portName, err)
 	}
-}
 
-// AcquireFlowLock tries to acquire the flow lock for the given ownerID, with a timeout. Returns error if not acquired.
-func (s *SerialPort) AcquireFlowLock(ownerID string, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	s.flowLock.Lock()
-	defer s.flowLock.Unlock()
-	for s.flowOwner != "" && s.flowOwner != ownerID {
-		remaining := time.Until(deadline)
-		if remaining <= 0 {
-			return fmt.Errorf("timeout acquiring flow lock")
+	// The modem answers at the old rate and switches straight after, so follow it before the next command goes out
+	command := fmt.Sprintf("AT+IPR=%d", rate)
+	var followErr error
+	cmd := s.submit(types.ATCommandPayload{Command: command, Priority: types.PriorityUser}, func(result types.ATResult) {
+		if !result.OK() {
+			return
 		}
-		s.flowCond.Wait()
-	}
-	s.flowOwner = ownerID
-	return nil
-}
+		config.BaudRate = rate
+		mode = config.Mode()
+		followErr = port.SetMode(&mode)
+	})
 
-// ReleaseFlowLock releases the flow lock if held by the given ownerID.
-func (s *SerialPort) ReleaseFlowLock(ownerID string) {
-	s.flowLock.Lock()
-	if s.flowOwner == ownerID {
-		s.flowOwner = ""
-		s.flowCond.Broadcast()
+	result := <-cmd.result
+	if result.Err != nil {
+		return result.Err
+	}
+	if !result.OK() {
+		return fmt.Errorf("modem refused %s: %s", command, result.Final)
 	}
-	s.flowLock.Unlock()
+	if followErr != nil {
+		return fmt.Errorf("modem moved to %d baud but %s could not follow: %w", rate, s.portName, followErr)
+	}
+
+	s.connLock.Lock()
+	s.config = config
+	s.connLock.Unlock()
+
+	LogMessage(fmt.Sprintf("[green]%s now at %s[white]", s.portName, config))
+	s.eventBus.Publish(types.Event{
+		Type:    types.EventLineModeChanged,
+		Payload: types.LineMode{Port: s.portName, Role: s.role, Mode: config.String()},
+	})
+
+	return nil
 }
@@ -0,0 +1,49 @@
+package services
+
+import "atcli/src/types"
+
+// Topic is an event type along with the type of its payload. Publishing or subscribing through it checks the
+// payload when compiling, rather than in a type assertion in every handler.
+//
+// The events are still plain types.Event on the bus, with Type as their EventType, so code that subscribes or
+// publishes with the EventType constants keeps working and can move over one handler at a time. A payload of
+// any other type, published that way, doesn't reach the handlers of the topic.
+type Topic[T any] struct {
+	Type types.EventType
+}
+
+// Topics of the events the modem's answers, errors and readings go out as
+var (
+	TopicSerialResponse      = NewTopic[types.SerialLine](types.EventSerialResponse)
+	TopicURC                 = NewTopic[types.SerialLine](types.EventURC)
+	TopicPrompt              = NewTopic[types.Prompt](types.EventPrompt)
+	TopicSerialError         = NewTopic[error](types.EventSerialError)
+	TopicSignalUpdated       = NewTopic[types.SignalSample](types.EventSignalUpdated)
+	TopicGPSUpdated          = NewTopic[types.GPSFix](types.EventGPSUpdated)
+	TopicUpdateTime          = NewTopic[types.TimeUpdate](types.EventUpdateTime)
+	TopicRegistrationUpdated = NewTopic[types.Registration](types.EventRegistrationUpdated)
+)
+
+// NewTopic gives eventType the payload type T
+func NewTopic[T any](eventType types.EventType) Topic[T] {
+	return Topic[T]{Type: eventType}
+}
+
+// Publish sends payload to the subscribers of the topic, and of its EventType
+func (t Topic[T]) Publish(eventBus *EventBus, payload T) {
+	eventBus.Publish(types.Event{Type: t.Type, Payload: payload})
+}
+
+// Subscribe registers a handler for the payloads of the topic, it is called from inside Publish
+func (t Topic[T]) Subscribe(eventBus *EventBus, handler func(T)) *Subscription {
+	return t.SubscribeWith(eventBus, handler, SubscribeOptions{})
+}
+
+// SubscribeWith registers a handler for the payloads of the topic, delivered as opts says
+func (t Topic[T]) SubscribeWith(eventBus *EventBus, handler func(T), opts SubscribeOptions) *Subscription {
+	return eventBus.subscribe(t.Type, handlerName(handler), func(event types.Event) {
+		if payload, ok := event.Payload.(T); ok {
+			handler(payload)
+		}
+	}, opts)
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// ErrNotSupported is returned by a transport for operations its link cannot perform,
+// e.g. changing the baud rate of a raw TCP socket
+var ErrNotSupported = errors.New("operation not supported by transport")
+
+// Transport is the byte stream SerialPort talks to the modem over.
+// The go.bug.st/serial backend is one implementation, network and pseudo-terminal links are others.
+type Transport interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	Close() error
+
+	// SetMode applies the line settings (baud rate, parity, etc)
+	SetMode(mode *serial.Mode) error
+
+	// SetReadTimeout makes Read return (0, nil) when nothing arrives within the timeout,
+	// serial.NoTimeout blocks forever
+	SetReadTimeout(timeout time.Duration) error
+
+	// Line control
+	SetDTR(dtr bool) error
+	SetRTS(rts bool) error
+	GetModemStatusBits() (*serial.ModemStatusBits, error)
+}
+
+// TransportOpener opens a transport for a parsed --port URL
+type TransportOpener func(target *url.URL, mode *serial.Mode) (Transport, error)
+
+var (
+	transportLock sync.RWMutex
+	transports    = map[string]TransportOpener{}
+)
+
+// RegisterTransport makes a transport available under the given URL scheme
+func RegisterTransport(scheme string, opener TransportOpener) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+
+	transports[scheme] = opener
+}
+
+// TransportSchemes returns the registered URL schemes in sorted order
+func TransportSchemes() []string {
+	transportLock.RLock()
+	defer transportLock.RUnlock()
+
+	schemes := make([]string, 0, len(transports))
+	for scheme := range transports {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// ParsePortURL parses a --port value. Plain device names like /dev/ttyUSB2 or COM3
+// are treated as serial:// URLs so existing command lines keep working.
+func ParsePortURL(port string) (*url.URL, error) {
+	if !strings.Contains(port, "://") {
+		return &url.URL{Scheme: "serial", Path: port}, nil
+	}
+
+	target, err := url.Parse(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", port, err)
+	}
+
+	return target, nil
+}
+
+// OpenTransport parses the port URL and opens it with the transport registered for its scheme
+func OpenTransport(port string, mode *serial.Mode) (Transport, error) {
+	target, err := ParsePortURL(port)
+	if err != nil {
+		return nil, err
+	}
+
+	transportLock.RLock()
+	opener, ok := transports[target.Scheme]
+	transportLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown port scheme %q, expected one of: %s", target.Scheme, strings.Join(TransportSchemes(), ", "))
+	}
+
+	return opener(target, mode)
+}
+
+// devicePath returns the local device or file name a URL refers to,
+// serial:///dev/ttyUSB2 gives /dev/ttyUSB2 and serial://COM3 gives COM3
+func devicePath(target *url.URL) string {
+	return target.Host + target.Path
+}
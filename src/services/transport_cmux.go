@@ -0,0 +1,325 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// CMUXChannel is one DLCI of a multiplexer, a Transport that frames its writes onto the shared port
+type CMUXChannel struct {
+	mux  *CMUX
+	dlci byte
+
+	data        chan []byte
+	dropped     atomic.Uint64 // Chunks the data buffer had no room for
+	overflowing bool          // The last chunk was dropped, only the receive loop uses it
+	pending     []byte
+	readTimeout time.Duration
+	closed      chan struct{}
+	closeOnce   sync.Once
+	readErr     error
+
+	stateLock     sync.Mutex
+	dtr           bool
+	rts           bool
+	remoteSignals byte
+}
+
+// activeCMUX is the multiplexer cmux://<dlci> ports open their channel on
+var (
+	activeCMUX     *CMUX
+	activeCMUXLock sync.Mutex
+)
+
+func init() {
+	RegisterTransport("cmux", openCMUXTransport)
+}
+
+// SetActiveCMUX makes cmux://<dlci> port URLs open channels on mux, pass nil once it is closed
+func SetActiveCMUX(mux *CMUX) {
+	activeCMUXLock.Lock()
+	defer activeCMUXLock.Unlock()
+	activeCMUX = mux
+}
+
+// openCMUXTransport handles cmux://<dlci>, e.g. cmux://1 for the first channel
+func openCMUXTransport(target *url.URL, mode *serial.Mode) (Transport, error) {
+	dlci, err := strconv.Atoi(target.Host)
+	if err != nil {
+		return nil, fmt.Errorf("cmux port URL %q needs a channel number, e.g. cmux://1", target.String())
+	}
+
+	activeCMUXLock.Lock()
+	mux := activeCMUX
+	activeCMUXLock.Unlock()
+	if mux == nil {
+		return nil, fmt.Errorf("%s needs the multiplexer running, start atcli with --cmux", target.String())
+	}
+
+	return mux.OpenChannel(byte(dlci))
+}
+
+func newCMUXChannel(mux *CMUX, dlci byte) *CMUXChannel {
+	return &CMUXChannel{
+		mux:         mux,
+		dlci:        dlci,
+		data:        make(chan []byte, 64),
+		readTimeout: serial.NoTimeout,
+		closed:      make(chan struct{}),
+		dtr:         true,
+		rts:         true,
+	}
+}
+
+// DLCI returns the channel number
+func (c *CMUXChannel) DLCI() byte {
+	return c.dlci
+}
+
+// Dropped counts the chunks received for the channel while its reader was too far behind to take them
+func (c *CMUXChannel) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// deliver hands received data to the reader of the channel. It never waits, one channel's slow reader
+// must not hold up the receive loop and with it every other channel, data the buffer has no room for is dropped.
+func (c *CMUXChannel) deliver(data []byte) {
+	select {
+	case c.data <- data:
+		c.overflowing = false
+	case <-c.closed:
+	default:
+		c.dropped.Add(1)
+		if !c.overflowing {
+			c.overflowing = true
+			go LogMessage(fmt.Sprintf("[yellow]CMUX channel %d is not read fast enough, dropping data[white]", c.dlci))
+		}
+	}
+}
+
+func (c *CMUXChannel) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		c.readErr = err
+		close(c.closed)
+	})
+}
+
+func (c *CMUXChannel) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var timeout <-chan time.Time
+		if c.readTimeout >= 0 {
+			timeout = time.After(c.readTimeout)
+		}
+
+		select {
+		case chunk := <-c.data:
+			c.pending = chunk
+		case <-timeout:
+			return 0, nil
+		case <-c.closed:
+			// Drain anything received before the channel closed
+			select {
+			case chunk := <-c.data:
+				c.pending = chunk
+			default:
+				return 0, c.readErr
+			}
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write splits p into frames no larger than the negotiated frame size
+func (c *CMUXChannel) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.readErr
+	default:
+	}
+
+	written := 0
+	for written < len(p) {
+		end := written + c.mux.frameSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := c.mux.send(c.dlci, true, cmuxUIH, p[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Close sends DISC for the channel, the multiplexer and the other channels stay up
+func (c *CMUXChannel) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		c.mux.exchange(c.dlci, cmuxDISC)
+	}
+
+	c.shutdown(io.EOF)
+	c.mux.removeChannel(c.dlci)
+	return nil
+}
+
+// SetMode only accepts the mode the multiplexed line already runs at, a channel has no line of its own
+func (c *CMUXChannel) SetMode(mode *serial.Mode) error {
+	line := c.mux.config
+	if mode.BaudRate != line.BaudRate || mode.DataBits != line.DataBits || mode.Parity != line.Parity || mode.StopBits != line.StopBits {
+		return fmt.Errorf("CMUX channel %d shares the line with every other channel, it runs at %s", c.dlci, line)
+	}
+	return nil
+}
+
+// SetFlowControl only accepts the flow control the multiplexed line already uses
+func (c *CMUXChannel) SetFlowControl(flow FlowControl) error {
+	if flow != c.mux.config.FlowControl {
+		return fmt.Errorf("CMUX channel %d shares the line with every other channel, it runs at %s", c.dlci, c.mux.config)
+	}
+	return nil
+}
+
+func (c *CMUXChannel) SetReadTimeout(timeout time.Duration) error {
+	c.readTimeout = timeout
+	return nil
+}
+
+// SetDTR is carried to the modem as the RTC signal of an MSC message
+func (c *CMUXChannel) SetDTR(dtr bool) error {
+	c.stateLock.Lock()
+	c.dtr = dtr
+	c.stateLock.Unlock()
+	return c.sendSignals()
+}
+
+// SetRTS is carried to the modem as the RTR signal of an MSC message
+func (c *CMUXChannel) SetRTS(rts bool) error {
+	c.stateLock.Lock()
+	c.rts = rts
+	c.stateLock.Unlock()
+	return c.sendSignals()
+}
+
+// GetModemStatusBits reports the signals from the last MSC the modem sent for this channel
+func (c *CMUXChannel) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	c.stateLock.Lock()
+	signals := c.remoteSignals
+	c.stateLock.Unlock()
+
+	return &serial.ModemStatusBits{
+		CTS: signals&cmuxSignalRTR != 0,
+		DSR: signals&cmuxSignalRTC != 0,
+		RI:  signals&cmuxSignalIC != 0,
+		DCD: signals&cmuxSignalDV != 0,
+	}, nil
+}
+
+func (c *CMUXChannel) setRemoteSignals(signals byte) {
+	c.stateLock.Lock()
+	c.remoteSignals = signals
+	c.stateLock.Unlock()
+}
+
+// sendSignals tells the modem our V.24 signals for the channel
+func (c *CMUXChannel) sendSignals() error {
+	c.stateLock.Lock()
+	signals := byte(cmuxEA | cmuxSignalDV)
+	if c.dtr {
+		signals |= cmuxSignalRTC
+	}
+	if c.rts {
+		signals |= cmuxSignalRTR
+	}
+	c.stateLock.Unlock()
+
+	address := c.dlci<<2 | cmuxCR | cmuxEA
+	return c.mux.send(0, true, cmuxUIH, cmuxControlMessage(cmuxMsgMSC, true, []byte{address, signals}))
+}
+
+// CMUXBridge copies between a channel and a pty so another program, e.g. pppd or a GNSS reader, can use the channel
+type CMUXBridge struct {
+	channel *CMUXChannel
+	pty     Transport
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// BridgeCMUXChannel opens a channel and exposes it as a pty, optionally symlinked to link
+func BridgeCMUXChannel(mux *CMUX, dlci byte, link string) (*CMUXBridge, error) {
+	channel, err := mux.OpenChannel(dlci)
+	if err != nil {
+		return nil, err
+	}
+
+	pty, err := OpenTransport("pty://"+link, nil)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	bridge := &CMUXBridge{channel: channel, pty: pty, closed: make(chan struct{})}
+	channel.SetReadTimeout(100 * time.Millisecond)
+	pty.SetReadTimeout(100 * time.Millisecond)
+
+	go bridge.copy(channel, pty)
+	go bridge.copy(pty, channel)
+
+	return bridge, nil
+}
+
+// Path returns the pty device programs should open
+func (b *CMUXBridge) Path() string {
+	if pty, ok := b.pty.(*ptyTransport); ok {
+		return pty.SlavePath()
+	}
+	return ""
+}
+
+func (b *CMUXBridge) copy(from Transport, to Transport) {
+	buf := make([]byte, 1024)
+	for {
+		select {
+		case <-b.closed:
+			return
+		default:
+		}
+
+		n, err := from.Read(buf)
+		if err != nil {
+			b.Close()
+			return
+		}
+		if n > 0 {
+			if _, err := to.Write(buf[:n]); err != nil {
+				b.Close()
+				return
+			}
+		}
+	}
+}
+
+func (b *CMUXBridge) Close() {
+	b.once.Do(func() {
+		close(b.closed)
+		b.channel.Close()
+		b.pty.Close()
+	})
+}
+
+var _ Transport = (*CMUXChannel)(nil)
+var _ FlowController = (*CMUXChannel)(nil)
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/creack/pty"
+	"go.bug.st/serial"
+	"golang.org/x/term"
+)
+
+// ptyTransport creates a pseudo-terminal pair and talks to the master side.
+// Whatever attaches to the slave (a simulator, socat bridging a remote link, etc) becomes the modem.
+type ptyTransport struct {
+	master      *os.File
+	slave       *os.File
+	link        string
+	readTimeout time.Duration
+}
+
+func init() {
+	RegisterTransport("pty", openPTYTransport)
+}
+
+// openPTYTransport handles pty:// and pty:///some/path, the latter symlinks the slave
+// to a stable path so other programs can be configured once
+func openPTYTransport(target *url.URL, mode *serial.Mode) (Transport, error) {
+	blocking, slave, err := pty.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not create pty: %w", err)
+	}
+
+	master, err := pollableFile(blocking)
+	if err != nil {
+		blocking.Close()
+		slave.Close()
+		return nil, fmt.Errorf("could not create pty: %w", err)
+	}
+
+	// Raw mode so the line discipline does not echo or translate what the modem side sends
+	if _, err := term.MakeRaw(int(slave.Fd())); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, fmt.Errorf("could not set pty to raw mode: %w", err)
+	}
+
+	t := &ptyTransport{
+		master:      master,
+		slave:       slave,
+		readTimeout: serial.NoTimeout,
+	}
+
+	if link := devicePath(target); link != "" {
+		if err := linkPTY(slave.Name(), link); err != nil {
+			t.Close()
+			return nil, fmt.Errorf("could not link pty to %s: %w", link, err)
+		}
+		t.link = link
+	}
+
+	LogMessage(fmt.Sprintf("[yellow]PTY transport waiting on %s[white]", t.SlavePath()))
+
+	return t, nil
+}
+
+// SlavePath returns the path other programs should open to reach this transport
+func (t *ptyTransport) SlavePath() string {
+	if t.link != "" {
+		return t.link
+	}
+	return t.slave.Name()
+}
+
+func (t *ptyTransport) Read(p []byte) (int, error) {
+	deadline := time.Time{}
+	if t.readTimeout >= 0 {
+		deadline = time.Now().Add(t.readTimeout)
+	}
+	t.master.SetReadDeadline(deadline)
+
+	n, err := t.master.Read(p)
+	if os.IsTimeout(err) {
+		// Match the serial backend, a timeout is an empty read rather than an error
+		return n, nil
+	}
+
+	return n, err
+}
+
+func (t *ptyTransport) Write(p []byte) (int, error) {
+	return t.master.Write(p)
+}
+
+func (t *ptyTransport) Close() error {
+	if t.link != "" {
+		unlinkPTY(t.slave.Name(), t.link)
+	}
+	t.slave.Close()
+	return t.master.Close()
+}
+
+func (t *ptyTransport) SetMode(mode *serial.Mode) error {
+	return ErrNotSupported
+}
+
+func (t *ptyTransport) SetReadTimeout(timeout time.Duration) error {
+	t.readTimeout = timeout
+	return nil
+}
+
+func (t *ptyTransport) SetDTR(dtr bool) error {
+	return ErrNotSupported
+}
+
+func (t *ptyTransport) SetRTS(rts bool) error {
+	return ErrNotSupported
+}
+
+func (t *ptyTransport) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return nil, ErrNotSupported
+}
+
+var _ Transport = (*ptyTransport)(nil)
+
+// linkPTY symlinks link to the slave of a pty. Only a symlink already at link is replaced, e.g. one left by a run
+// that crashed, anything else there is somebody's file or device.
+func linkPTY(slave string, link string) error {
+	info, err := os.Lstat(link)
+	switch {
+	case err == nil && info.Mode()&os.ModeSymlink == 0:
+		return fmt.Errorf("%s exists and is not a symlink", link)
+	case err == nil:
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	return os.Symlink(slave, link)
+}
+
+// unlinkPTY removes link as long as it is still the symlink linkPTY made to slave
+func unlinkPTY(slave string, link string) {
+	if target, err := os.Readlink(link); err == nil && target == slave {
+		os.Remove(link)
+	}
+}
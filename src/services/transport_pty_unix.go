@@ -0,0 +1,28 @@
+//go:build !windows
+
+package services
+
+import (
+	"os"
+	"syscall"
+)
+
+// pollableFile re-opens a pty master through the runtime poller. pty.Open hands back a file
+// that has been switched to blocking mode, which ignores read deadlines and cannot be
+// interrupted by Close.
+func pollableFile(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	name := f.Name()
+	f.Close()
+
+	return os.NewFile(uintptr(fd), name), nil
+}
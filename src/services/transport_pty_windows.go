@@ -0,0 +1,10 @@
+//go:build windows
+
+package services
+
+import "os"
+
+// pollableFile is a no-op on Windows, which has no pty support to begin with
+func pollableFile(f *os.File) (*os.File, error) {
+	return f, nil
+}
@@ -0,0 +1,488 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Telnet protocol bytes (RFC 854) and the COM-PORT-OPTION subcommands (RFC 2217)
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	telnetOptBinary  = 0
+	telnetOptSGA     = 3
+	telnetOptComPort = 44
+
+	comPortSetBaudRate       = 1
+	comPortSetDataSize       = 2
+	comPortSetParity         = 3
+	comPortSetStopSize       = 4
+	comPortSetControl        = 5
+	comPortNotifyModemState  = 7
+	comPortSetModemStateMask = 11
+
+	// Server replies use the client subcommand plus this offset
+	comPortServerOffset = 100
+
+	comPortControlNoFlow   = 1
+	comPortControlHardware = 3
+	comPortControlDTROn    = 8
+	comPortControlDTROff   = 9
+	comPortControlRTSOn    = 11
+	comPortControlRTSOff   = 12
+)
+
+// rfc2217NegotiationTimeout bounds how long we wait for the server to accept an option or acknowledge a setting
+const rfc2217NegotiationTimeout = 5 * time.Second
+
+// rfc2217Transport is a Telnet COM-PORT-OPTION client, e.g. for ser2net in telnet mode.
+// A background goroutine strips the Telnet framing so Read only ever sees modem data.
+type rfc2217Transport struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	data        chan []byte
+	pending     []byte
+	readTimeout time.Duration
+	closed      chan struct{}
+	closeOnce   sync.Once
+	readErr     error
+
+	stateLock  sync.Mutex
+	comPortOK  chan struct{}
+	acks       map[byte][]chan []byte // Requests waiting for their acknowledgement by code, oldest first as the server answers in order
+	modemState byte
+}
+
+func init() {
+	RegisterTransport("rfc2217", openRFC2217Transport)
+}
+
+func openRFC2217Transport(target *url.URL, mode *serial.Mode) (Transport, error) {
+	if target.Host == "" {
+		return nil, fmt.Errorf("rfc2217 port URL %q has no host:port", target.String())
+	}
+
+	conn, err := net.DialTimeout("tcp", target.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &rfc2217Transport{
+		conn:        conn,
+		data:        make(chan []byte, 64),
+		readTimeout: serial.NoTimeout,
+		closed:      make(chan struct{}),
+		comPortOK:   make(chan struct{}),
+		acks:        map[byte][]chan []byte{},
+	}
+
+	go t.receive()
+
+	// We want a clean 8 bit stream in both directions and the com port option from the server
+	t.sendRaw(
+		telnetIAC, telnetWILL, telnetOptBinary,
+		telnetIAC, telnetDO, telnetOptBinary,
+		telnetIAC, telnetWILL, telnetOptSGA,
+		telnetIAC, telnetDO, telnetOptSGA,
+		telnetIAC, telnetWILL, telnetOptComPort,
+	)
+
+	select {
+	case <-t.comPortOK:
+	case <-t.closed:
+		t.Close()
+		return nil, fmt.Errorf("rfc2217 server %s closed the connection: %v", target.Host, t.readErr)
+	case <-time.After(rfc2217NegotiationTimeout):
+		t.Close()
+		return nil, fmt.Errorf("rfc2217 server %s did not accept the COM-PORT option", target.Host)
+	}
+
+	// Ask to be told about every modem line change
+	if _, err := t.request(comPortSetModemStateMask, []byte{0xff}); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	if mode != nil {
+		if err := t.SetMode(mode); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// receive runs for the life of the connection, splitting Telnet commands out of the data stream
+func (t *rfc2217Transport) receive() {
+	reader := bufio.NewReader(t.conn)
+	data := []byte{}
+
+	flush := func() {
+		if len(data) > 0 {
+			select {
+			case t.data <- data:
+			case <-t.closed:
+			}
+			data = []byte{}
+		}
+	}
+
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			flush()
+			t.shutdown(err)
+			return
+		}
+
+		if b != telnetIAC {
+			data = append(data, b)
+			if reader.Buffered() == 0 {
+				flush()
+			}
+			continue
+		}
+
+		cmd, err := reader.ReadByte()
+		if err != nil {
+			t.shutdown(err)
+			return
+		}
+
+		switch cmd {
+		case telnetIAC:
+			// Escaped 0xff in the data stream
+			data = append(data, telnetIAC)
+		case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+			option, err := reader.ReadByte()
+			if err != nil {
+				t.shutdown(err)
+				return
+			}
+			t.negotiate(cmd, option)
+		case telnetSB:
+			sub, err := t.readSubnegotiation(reader)
+			if err != nil {
+				t.shutdown(err)
+				return
+			}
+			t.handleSubnegotiation(sub)
+		}
+
+		if reader.Buffered() == 0 {
+			flush()
+		}
+	}
+}
+
+// readSubnegotiation reads up to IAC SE, un-escaping doubled IAC bytes
+func (t *rfc2217Transport) readSubnegotiation(reader *bufio.Reader) ([]byte, error) {
+	sub := []byte{}
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != telnetIAC {
+			sub = append(sub, b)
+			continue
+		}
+
+		next, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if next == telnetSE {
+			return sub, nil
+		}
+		sub = append(sub, next)
+	}
+}
+
+// negotiate answers the server's option requests, we only agree to the options we asked for
+func (t *rfc2217Transport) negotiate(cmd byte, option byte) {
+	supported := option == telnetOptBinary || option == telnetOptSGA || option == telnetOptComPort
+
+	switch cmd {
+	case telnetDO:
+		if option == telnetOptComPort {
+			t.stateLock.Lock()
+			select {
+			case <-t.comPortOK:
+			default:
+				close(t.comPortOK)
+			}
+			t.stateLock.Unlock()
+		}
+		if !supported {
+			t.sendRaw(telnetIAC, telnetWONT, option)
+		}
+	case telnetWILL:
+		if !supported {
+			t.sendRaw(telnetIAC, telnetDONT, option)
+		}
+	case telnetDONT:
+		if option == telnetOptComPort {
+			LogMessage("[red]RFC 2217 server refused the COM-PORT option[white]")
+		}
+	}
+}
+
+func (t *rfc2217Transport) handleSubnegotiation(sub []byte) {
+	if len(sub) < 2 || sub[0] != telnetOptComPort {
+		return
+	}
+
+	code := sub[1]
+	value := sub[2:]
+
+	if code == comPortServerOffset+comPortNotifyModemState && len(value) > 0 {
+		t.stateLock.Lock()
+		t.modemState = value[0]
+		t.stateLock.Unlock()
+		return
+	}
+
+	if code < comPortServerOffset {
+		return
+	}
+
+	t.stateLock.Lock()
+	waiting := t.acks[code-comPortServerOffset]
+	var ack chan []byte
+	if len(waiting) > 0 {
+		ack = waiting[0]
+		t.acks[code-comPortServerOffset] = waiting[1:]
+	}
+	t.stateLock.Unlock()
+
+	if ack != nil {
+		ack <- value
+	}
+}
+
+// request sends a COM-PORT subcommand and waits for the server to acknowledge it
+func (t *rfc2217Transport) request(code byte, value []byte) ([]byte, error) {
+	frame := []byte{telnetIAC, telnetSB, telnetOptComPort, code}
+	for _, b := range value {
+		frame = append(frame, b)
+		if b == telnetIAC {
+			frame = append(frame, telnetIAC)
+		}
+	}
+	frame = append(frame, telnetIAC, telnetSE)
+
+	// Waiters are queued in the order the requests go out, so each acknowledgement finds its own
+	ack := make(chan []byte, 1)
+	t.writeLock.Lock()
+	t.stateLock.Lock()
+	t.acks[code] = append(t.acks[code], ack)
+	t.stateLock.Unlock()
+	_, err := t.conn.Write(frame)
+	t.writeLock.Unlock()
+
+	if err != nil {
+		t.dropAck(code, ack)
+		return nil, err
+	}
+
+	select {
+	case reply := <-ack:
+		return reply, nil
+	case <-t.closed:
+		return nil, t.readErr
+	case <-time.After(rfc2217NegotiationTimeout):
+		t.dropAck(code, ack)
+		return nil, fmt.Errorf("rfc2217 server did not acknowledge subcommand %d", code)
+	}
+}
+
+// dropAck stops waiting for an acknowledgement that won't come
+func (t *rfc2217Transport) dropAck(code byte, ack chan []byte) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	waiting := t.acks[code]
+	for i, w := range waiting {
+		if w == ack {
+			t.acks[code] = append(waiting[:i:i], waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *rfc2217Transport) sendRaw(b ...byte) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	_, err := t.conn.Write(b)
+	return err
+}
+
+func (t *rfc2217Transport) shutdown(err error) {
+	t.closeOnce.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		t.readErr = err
+		close(t.closed)
+	})
+}
+
+func (t *rfc2217Transport) Read(p []byte) (int, error) {
+	if len(t.pending) == 0 {
+		var timeout <-chan time.Time
+		if t.readTimeout >= 0 {
+			timeout = time.After(t.readTimeout)
+		}
+
+		select {
+		case chunk := <-t.data:
+			t.pending = chunk
+		case <-timeout:
+			return 0, nil
+		case <-t.closed:
+			// Drain anything received before the connection dropped
+			select {
+			case chunk := <-t.data:
+				t.pending = chunk
+			default:
+				return 0, t.readErr
+			}
+		}
+	}
+
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+func (t *rfc2217Transport) Write(p []byte) (int, error) {
+	// Escape IAC bytes so binary payloads survive the Telnet framing
+	escaped := make([]byte, 0, len(p))
+	for _, b := range p {
+		escaped = append(escaped, b)
+		if b == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+	}
+
+	if err := t.sendRaw(escaped...); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *rfc2217Transport) Close() error {
+	t.shutdown(io.EOF)
+	return t.conn.Close()
+}
+
+func (t *rfc2217Transport) SetMode(mode *serial.Mode) error {
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, uint32(mode.BaudRate))
+	if _, err := t.request(comPortSetBaudRate, baud); err != nil {
+		return err
+	}
+
+	dataBits := mode.DataBits
+	if dataBits == 0 {
+		dataBits = 8
+	}
+	if _, err := t.request(comPortSetDataSize, []byte{byte(dataBits)}); err != nil {
+		return err
+	}
+
+	// RFC 2217 numbers parity from 1 in the same order as go.bug.st/serial
+	if _, err := t.request(comPortSetParity, []byte{byte(mode.Parity) + 1}); err != nil {
+		return err
+	}
+
+	stopSize := byte(1)
+	switch mode.StopBits {
+	case serial.TwoStopBits:
+		stopSize = 2
+	case serial.OnePointFiveStopBits:
+		stopSize = 3
+	}
+	if _, err := t.request(comPortSetStopSize, []byte{stopSize}); err != nil {
+		return err
+	}
+
+	if mode.InitialStatusBits != nil {
+		if err := t.SetDTR(mode.InitialStatusBits.DTR); err != nil {
+			return err
+		}
+		if err := t.SetRTS(mode.InitialStatusBits.RTS); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *rfc2217Transport) SetReadTimeout(timeout time.Duration) error {
+	t.readTimeout = timeout
+	return nil
+}
+
+func (t *rfc2217Transport) SetDTR(dtr bool) error {
+	value := byte(comPortControlDTROff)
+	if dtr {
+		value = comPortControlDTROn
+	}
+	_, err := t.request(comPortSetControl, []byte{value})
+	return err
+}
+
+func (t *rfc2217Transport) SetRTS(rts bool) error {
+	value := byte(comPortControlRTSOff)
+	if rts {
+		value = comPortControlRTSOn
+	}
+	_, err := t.request(comPortSetControl, []byte{value})
+	return err
+}
+
+// SetFlowControl asks the server to use hardware flow control on its side of the line
+func (t *rfc2217Transport) SetFlowControl(flow FlowControl) error {
+	value := byte(comPortControlNoFlow)
+	if flow == FlowRTSCTS {
+		value = comPortControlHardware
+	}
+	_, err := t.request(comPortSetControl, []byte{value})
+	return err
+}
+
+// GetModemStatusBits reports the last NOTIFY-MODEMSTATE the server sent
+func (t *rfc2217Transport) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	t.stateLock.Lock()
+	state := t.modemState
+	t.stateLock.Unlock()
+
+	return &serial.ModemStatusBits{
+		DCD: state&0x80 != 0,
+		RI:  state&0x40 != 0,
+		DSR: state&0x20 != 0,
+		CTS: state&0x10 != 0,
+	}, nil
+}
+
+var _ Transport = (*rfc2217Transport)(nil)
+var _ FlowController = (*rfc2217Transport)(nil)
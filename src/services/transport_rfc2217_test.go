@@ -0,0 +1,366 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// rfc2217TestServer is the server side of RFC 2217, enough of it to check what the client negotiates.
+// It accepts the COM-PORT option, acknowledges every subcommand with the value it got and keeps both.
+type rfc2217TestServer struct {
+	listener net.Listener
+	refuse   bool // Close the connection instead of accepting the COM-PORT option
+
+	lock        sync.Mutex
+	conn        net.Conn
+	subcommands [][]byte // Code followed by the value, as the client sent them
+	data        []byte   // Everything outside the Telnet framing
+	changed     chan struct{}
+}
+
+func startRFC2217TestServer(t *testing.T, refuse bool) *rfc2217TestServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &rfc2217TestServer{listener: listener, refuse: refuse, changed: make(chan struct{}, 1)}
+	t.Cleanup(func() {
+		listener.Close()
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	})
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conn = conn
+		s.lock.Unlock()
+		s.serve(conn)
+	}()
+	return s
+}
+
+// url is the port URL the client opens
+func (s *rfc2217TestServer) url() *url.URL {
+	return &url.URL{Scheme: "rfc2217", Host: s.listener.Addr().String()}
+}
+
+func (s *rfc2217TestServer) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if b != telnetIAC {
+			s.record(nil, b)
+			continue
+		}
+
+		cmd, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		switch cmd {
+		case telnetIAC:
+			s.record(nil, telnetIAC)
+		case telnetWILL:
+			option, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			if option == telnetOptComPort {
+				if s.refuse {
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{telnetIAC, telnetDO, telnetOptComPort})
+			}
+		case telnetDO, telnetDONT, telnetWONT:
+			if _, err := reader.ReadByte(); err != nil {
+				return
+			}
+		case telnetSB:
+			sub := []byte{}
+			for {
+				b, err := reader.ReadByte()
+				if err != nil {
+					return
+				}
+				if b == telnetIAC {
+					if b, err = reader.ReadByte(); err != nil {
+						return
+					}
+					if b == telnetSE {
+						break
+					}
+				}
+				sub = append(sub, b)
+			}
+			if len(sub) < 2 || sub[0] != telnetOptComPort {
+				continue
+			}
+			s.record(sub[1:], 0)
+			reply := []byte{telnetIAC, telnetSB, telnetOptComPort, sub[1] + comPortServerOffset}
+			reply = append(reply, escapeIAC(sub[2:])...)
+			conn.Write(append(reply, telnetIAC, telnetSE))
+		}
+	}
+}
+
+// record keeps a subcommand, or a data byte when subcommand is nil
+func (s *rfc2217TestServer) record(subcommand []byte, b byte) {
+	s.lock.Lock()
+	if subcommand != nil {
+		s.subcommands = append(s.subcommands, subcommand)
+	} else {
+		s.data = append(s.data, b)
+	}
+	s.lock.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// takeSubcommands returns the subcommands received so far and forgets them
+func (s *rfc2217TestServer) takeSubcommands() [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	subcommands := s.subcommands
+	s.subcommands = nil
+	return subcommands
+}
+
+// waitForData waits until the server has received want
+func (s *rfc2217TestServer) waitForData(t *testing.T, want []byte) {
+	t.Helper()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		s.lock.Lock()
+		got := append([]byte{}, s.data...)
+		s.lock.Unlock()
+		if bytes.Equal(got, want) {
+			return
+		}
+
+		select {
+		case <-s.changed:
+		case <-deadline:
+			t.Fatalf("server received %q, want %q", got, want)
+		}
+	}
+}
+
+// send writes raw bytes to the client, Telnet framing included
+func (s *rfc2217TestServer) send(b ...byte) {
+	s.lock.Lock()
+	conn := s.conn
+	s.lock.Unlock()
+	conn.Write(b)
+}
+
+func escapeIAC(value []byte) []byte {
+	escaped := []byte{}
+	for _, b := range value {
+		escaped = append(escaped, b)
+		if b == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+	}
+	return escaped
+}
+
+func openRFC2217Test(t *testing.T, server *rfc2217TestServer, mode *serial.Mode) *rfc2217Transport {
+	t.Helper()
+
+	transport, err := openRFC2217Transport(server.url(), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Close() })
+	return transport.(*rfc2217Transport)
+}
+
+func TestRFC2217Open(t *testing.T) {
+	tests := []struct {
+		name string
+		mode *serial.Mode
+		want [][]byte
+	}{
+		{
+			name: "without a mode only the modem state mask is set",
+			want: [][]byte{{comPortSetModemStateMask, 0xff}},
+		},
+		{
+			name: "115200 8N1",
+			mode: &serial.Mode{BaudRate: 115200, DataBits: 8, Parity: serial.NoParity, StopBits: serial.OneStopBit},
+			want: [][]byte{
+				{comPortSetModemStateMask, 0xff},
+				{comPortSetBaudRate, 0x00, 0x01, 0xc2, 0x00},
+				{comPortSetDataSize, 8},
+				{comPortSetParity, 1},
+				{comPortSetStopSize, 1},
+			},
+		},
+		{
+			name: "9600 7E2 with DTR off",
+			mode: &serial.Mode{
+				BaudRate:          9600,
+				DataBits:          7,
+				Parity:            serial.EvenParity,
+				StopBits:          serial.TwoStopBits,
+				InitialStatusBits: &serial.ModemOutputBits{DTR: false, RTS: true},
+			},
+			want: [][]byte{
+				{comPortSetModemStateMask, 0xff},
+				{comPortSetBaudRate, 0x00, 0x00, 0x25, 0x80},
+				{comPortSetDataSize, 7},
+				{comPortSetParity, 3},
+				{comPortSetStopSize, 2},
+				{comPortSetControl, comPortControlDTROff},
+				{comPortSetControl, comPortControlRTSOn},
+			},
+		},
+		{
+			name: "an IAC byte in the baud rate is escaped, zero data bits mean 8",
+			mode: &serial.Mode{BaudRate: 0xff, Parity: serial.MarkParity, StopBits: serial.OnePointFiveStopBits},
+			want: [][]byte{
+				{comPortSetModemStateMask, 0xff},
+				{comPortSetBaudRate, 0x00, 0x00, 0x00, 0xff},
+				{comPortSetDataSize, 8},
+				{comPortSetParity, 4},
+				{comPortSetStopSize, 3},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startRFC2217TestServer(t, false)
+			openRFC2217Test(t, server, test.mode)
+
+			if got := server.takeSubcommands(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("subcommands %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRFC2217OpenRefused(t *testing.T) {
+	server := startRFC2217TestServer(t, true)
+
+	if _, err := openRFC2217Transport(server.url(), nil); err == nil {
+		t.Fatal("open succeeded against a server that closed the connection")
+	}
+}
+
+func TestRFC2217Control(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*rfc2217Transport) error
+		want []byte
+	}{
+		{"DTR on", func(t *rfc2217Transport) error { return t.SetDTR(true) }, []byte{comPortSetControl, comPortControlDTROn}},
+		{"DTR off", func(t *rfc2217Transport) error { return t.SetDTR(false) }, []byte{comPortSetControl, comPortControlDTROff}},
+		{"RTS on", func(t *rfc2217Transport) error { return t.SetRTS(true) }, []byte{comPortSetControl, comPortControlRTSOn}},
+		{"RTS off", func(t *rfc2217Transport) error { return t.SetRTS(false) }, []byte{comPortSetControl, comPortControlRTSOff}},
+		{"hardware flow", func(t *rfc2217Transport) error { return t.SetFlowControl(FlowRTSCTS) }, []byte{comPortSetControl, comPortControlHardware}},
+		{"no flow", func(t *rfc2217Transport) error { return t.SetFlowControl(FlowNone) }, []byte{comPortSetControl, comPortControlNoFlow}},
+	}
+
+	server := startRFC2217TestServer(t, false)
+	transport := openRFC2217Test(t, server, nil)
+	server.takeSubcommands()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.set(transport); err != nil {
+				t.Fatal(err)
+			}
+			if got := server.takeSubcommands(); !reflect.DeepEqual(got, [][]byte{test.want}) {
+				t.Errorf("subcommands %v, want %v", got, [][]byte{test.want})
+			}
+		})
+	}
+}
+
+func TestRFC2217ConcurrentControl(t *testing.T) {
+	// SET-CONTROL requests in flight together each get an acknowledgement instead of one waiting out the timeout
+	server := startRFC2217TestServer(t, false)
+	transport := openRFC2217Test(t, server, nil)
+
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		go func() { errs <- transport.SetDTR(i%2 == 0) }()
+		go func() { errs <- transport.SetRTS(i%2 == 0) }()
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d of 20 requests acknowledged", i)
+		}
+	}
+}
+
+func TestRFC2217Data(t *testing.T) {
+	server := startRFC2217TestServer(t, false)
+	transport := openRFC2217Test(t, server, nil)
+	transport.SetReadTimeout(2 * time.Second)
+
+	// IAC in what we write is doubled on the wire and arrives as one byte
+	if _, err := transport.Write([]byte{'A', 0xff, 'B'}); err != nil {
+		t.Fatal(err)
+	}
+	server.waitForData(t, []byte{'A', 0xff, 'B'})
+
+	// Framing the server mixes into the stream never reaches Read
+	server.send(
+		'O', 'K', telnetIAC, telnetIAC,
+		telnetIAC, telnetSB, telnetOptComPort, comPortServerOffset+comPortNotifyModemState, 0x30, telnetIAC, telnetSE,
+		'\r', '\n',
+	)
+	got := []byte{}
+	buf := make([]byte, 16)
+	for len(got) < 5 {
+		n, err := transport.Read(buf)
+		if err != nil || n == 0 {
+			t.Fatalf("read %q, then %d bytes and %v", got, n, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if want := []byte{'O', 'K', 0xff, '\r', '\n'}; !bytes.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+
+	bits, err := transport.GetModemStatusBits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (serial.ModemStatusBits{CTS: true, DSR: true}); *bits != want {
+		t.Errorf("modem status %+v, want %+v", *bits, want)
+	}
+}
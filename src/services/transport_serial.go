@@ -0,0 +1,56 @@
+package services
+
+import (
+	"fmt"
+	"net/url"
+	"runtime"
+
+	"go.bug.st/serial"
+)
+
+// serialTransport is the local tty backend, go.bug.st/serial already provides everything a Transport needs
+type serialTransport struct {
+	serial.Port
+	control *lineControl // Side handle for termios settings go.bug.st/serial doesn't expose, nil if unavailable
+}
+
+func init() {
+	RegisterTransport("serial", openSerialTransport)
+}
+
+func openSerialTransport(target *url.URL, mode *serial.Mode) (Transport, error) {
+	name := devicePath(target)
+	if name == "" {
+		return nil, fmt.Errorf("serial port URL %q has no device", target.String())
+	}
+	// go.bug.st/serial can only set 1.5 stop bits on Windows, elsewhere it fails with a bare "invalid stop bits"
+	if mode != nil && mode.StopBits == serial.OnePointFiveStopBits && runtime.GOOS != "windows" {
+		return nil, fmt.Errorf("%s: 1.5 stop bits are not supported for serial ports on %s, use 1 or 2", name, runtime.GOOS)
+	}
+
+	// The control handle has to be opened first, go.bug.st/serial takes exclusive access to the tty
+	control, _ := openLineControl(name)
+
+	port, err := serial.Open(name, mode)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	return &serialTransport{Port: port, control: control}, nil
+}
+
+func (t *serialTransport) SetFlowControl(flow FlowControl) error {
+	if t.control == nil {
+		return ErrNotSupported
+	}
+	return t.control.SetHardwareFlow(flow == FlowRTSCTS)
+}
+
+func (t *serialTransport) Close() error {
+	t.control.Close()
+	return t.Port.Close()
+}
+
+var _ Transport = (*serialTransport)(nil)
+var _ FlowController = (*serialTransport)(nil)
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/creack/pty"
+	"go.bug.st/serial"
+	"golang.org/x/term"
+)
+
+// SimPTY is a ModemSim serving the master side of a pseudo-terminal,
+// anything that opens the slave path sees a modem
+type SimPTY struct {
+	Sim    *ModemSim
+	master *os.File
+	slave  *os.File
+	link   string
+}
+
+// StartSimPTY creates a pty and starts the simulator on it, link optionally symlinks the slave to a stable path
+func StartSimPTY(profile ModemSimProfile, link string) (*SimPTY, error) {
+	blocking, slave, err := pty.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not create pty: %w", err)
+	}
+
+	master, err := pollableFile(blocking)
+	if err != nil {
+		blocking.Close()
+		slave.Close()
+		return nil, fmt.Errorf("could not create pty: %w", err)
+	}
+
+	if _, err := term.MakeRaw(int(slave.Fd())); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, fmt.Errorf("could not set pty to raw mode: %w", err)
+	}
+
+	s := &SimPTY{
+		Sim:    NewModemSim(profile),
+		master: master,
+		slave:  slave,
+	}
+
+	if link != "" {
+		if err := linkPTY(slave.Name(), link); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("could not link pty to %s: %w", link, err)
+		}
+		s.link = link
+	}
+
+	// Our own handle on the slave stays open so the master never sees EIO between clients
+	go s.Sim.Serve(master)
+
+	return s, nil
+}
+
+// Path returns the device path clients should open
+func (s *SimPTY) Path() string {
+	if s.link != "" {
+		return s.link
+	}
+	return s.slave.Name()
+}
+
+// Close stops the simulator and removes the pty
+func (s *SimPTY) Close() error {
+	s.Sim.Stop()
+	if s.link != "" {
+		unlinkPTY(s.slave.Name(), s.link)
+	}
+	s.slave.Close()
+	return s.master.Close()
+}
+
+// simTransport opens the simulator's slave as an ordinary serial device,
+// so the real serial code path is exercised end to end
+type simTransport struct {
+	*serialTransport
+	simPTY *SimPTY
+}
+
+func init() {
+	RegisterTransport("sim", openSimTransport)
+}
+
+func openSimTransport(target *url.URL, mode *serial.Mode) (Transport, error) {
+	profile, err := SimProfileFromURL(target)
+	if err != nil {
+		return nil, err
+	}
+
+	simPTY, err := StartSimPTY(profile, "")
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := openSerialTransport(&url.URL{Scheme: "serial", Path: simPTY.Path()}, mode)
+	if err != nil {
+		simPTY.Close()
+		return nil, err
+	}
+
+	return &simTransport{serialTransport: port.(*serialTransport), simPTY: simPTY}, nil
+}
+
+func (t *simTransport) Close() error {
+	err := t.serialTransport.Close()
+	t.simPTY.Close()
+	return err
+}
+
+var _ Transport = (*simTransport)(nil)
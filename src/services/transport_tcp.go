@@ -0,0 +1,82 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// tcpTransport is a raw TCP byte stream, e.g. ser2net in raw mode.
+// There is no out-of-band channel so line settings are left to the remote end.
+type tcpTransport struct {
+	conn        net.Conn
+	readTimeout time.Duration
+}
+
+func init() {
+	RegisterTransport("tcp", openTCPTransport)
+}
+
+func openTCPTransport(target *url.URL, mode *serial.Mode) (Transport, error) {
+	if target.Host == "" {
+		return nil, fmt.Errorf("tcp port URL %q has no host:port", target.String())
+	}
+
+	conn, err := net.DialTimeout("tcp", target.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpTransport{conn: conn, readTimeout: serial.NoTimeout}, nil
+}
+
+func (t *tcpTransport) Read(p []byte) (int, error) {
+	if t.readTimeout < 0 {
+		return t.conn.Read(p)
+	}
+
+	t.conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	n, err := t.conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// Match the serial backend, a timeout is an empty read rather than an error
+		return n, nil
+	}
+
+	return n, err
+}
+
+func (t *tcpTransport) Write(p []byte) (int, error) {
+	return t.conn.Write(p)
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *tcpTransport) SetMode(mode *serial.Mode) error {
+	return ErrNotSupported
+}
+
+func (t *tcpTransport) SetReadTimeout(timeout time.Duration) error {
+	t.readTimeout = timeout
+	return nil
+}
+
+func (t *tcpTransport) SetDTR(dtr bool) error {
+	return ErrNotSupported
+}
+
+func (t *tcpTransport) SetRTS(rts bool) error {
+	return ErrNotSupported
+}
+
+func (t *tcpTransport) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return nil, ErrNotSupported
+}
+
+var _ Transport = (*tcpTransport)(nil)
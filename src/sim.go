@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"atcli/src/services"
+)
+
+// runSim implements `atcli sim [profile]`, a simulated modem on a pty for development without hardware
+func runSim(args []string) {
+	flags := flag.NewFlagSet("sim", flag.ExitOnError)
+	link := flags.String("link", "", "Symlink the simulated modem to this path, e.g. /tmp/modem")
+	faults := flags.String("fault", "", "Comma separated faults to inject, COMMAND:ACTION[:EVERY] e.g. AT+CSQ:error:3,AT+CGPSINFO:timeout")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: atcli sim [flags] [profile]\n\nProfiles: %s\n\n", strings.Join(services.SimProfileNames(), ", "))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	target := &url.URL{Scheme: "sim", Host: flags.Arg(0)}
+	if *faults != "" {
+		query := url.Values{}
+		for _, fault := range strings.Split(*faults, ",") {
+			query.Add("fault", fault)
+		}
+		target.RawQuery = query.Encode()
+	}
+
+	profile, err := services.SimProfileFromURL(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	simPTY, err := services.StartSimPTY(profile, *link)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer simPTY.Close()
+
+	fmt.Printf("Simulating a %s modem (profile %s) on %s\n", profile.Model, profile.Name, simPTY.Path())
+	fmt.Printf("Connect with: atcli --port %s\n", simPTY.Path())
+	fmt.Printf("Press Ctrl+C to stop\n")
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+}
@@ -1,6 +1,11 @@
 package types
 
-import "github.com/rivo/tview"
+import (
+	"strings"
+	"time"
+
+	"github.com/rivo/tview"
+)
 
 // CommandInterface is the interface for any command object.
 type CommandInterface interface {
@@ -16,16 +21,144 @@ type Command struct {
 	Run         func(args []string) error
 }
 
-// ATCommandPayload is used for sending AT commands via the event bus with flow lock ownership.
+// ATCommandPayload is used for sending AT commands via the event bus.
 type ATCommandPayload struct {
-	Command string
-	OwnerID string
+	Command  string
+	OwnerID  string          // Who sent the command, e.g. the flow it belongs to
+	Role     PortRole        // Which port to send on, empty means the main AT port
+	ID       string          // Identifies the transaction in its ATResult, one is made up when empty
+	Priority ATPriority      // Where the command goes in the port's queue, the zero value is a background poll
+	Timeout  time.Duration   // How long to wait for the final result code once sent, zero means the command's default
+	Body     string          // Sent with Ctrl-Z when the command opens a > prompt, e.g. the text of an SMS. Empty leaves the prompt to the user
+	Result   chan<- ATResult // Optional, also gets the ATResult, should be buffered
+}
+
+// ATPriority orders the commands waiting for a port, higher goes first and equal ones go in the order they came
+type ATPriority int
+
+const (
+	PriorityBackground ATPriority = iota // Polls such as the signal chart's AT+CSQ
+	PriorityFlow                         // Steps of a flow
+	PriorityUser                         // Typed by the user
+)
+
+// ATQueueStatus is the payload of EventATQueue
+type ATQueueStatus struct {
+	Port     string
+	Role     PortRole
+	Depth    int    // Commands waiting, not counting the one in flight
+	InFlight string // Command waiting for its final result code, empty when idle
+}
+
+// PromptReply is the payload of EventPromptReply, what to send to a > prompt the modem opened
+type PromptReply struct {
+	Role  PortRole // Which port the prompt is on, empty means the main AT port
+	Text  string
+	Abort bool // Send ESC instead of the text and Ctrl-Z
+}
+
+// ATResult is the payload of EventATResult, everything the modem said in answer to one command
+type ATResult struct {
+	ID       string
+	Port     string
+	Role     PortRole
+	Command  string
+	Lines    []string // Intermediate result lines, without the echo and the final result code
+	Final    string   // Final result code, e.g. OK, ERROR or +CME ERROR: 10, empty if none arrived
+	Err      error    // Set when the command could not be sent or timed out
+	Sent     time.Time
+	Duration time.Duration // From sending the command to the final result code
+}
+
+// OK reports whether the command succeeded
+func (r ATResult) OK() bool {
+	return r.Err == nil && (r.Final == "OK" || strings.HasPrefix(r.Final, "CONNECT"))
+}
+
+// PortRole is what an open port is used for when several are open at once
+type PortRole string
+
+const (
+	RoleAT    PortRole = "at"   // Main command port
+	RoleNMEA  PortRole = "nmea" // GNSS NMEA sentence stream, read only
+	RoleAuxAT PortRole = "aux"  // Secondary AT port
+)
+
+// SerialLine is the payload of EventSerialResponse, a line of traffic tagged with the port it came from
+type SerialLine struct {
+	Port string
+	Role PortRole
+	Text string
+}
+
+// Prompt is the payload of EventPrompt, a > prompt the modem opened for the text of a command
+type Prompt struct {
+	ID   string // Of the transaction whose command opened the prompt
+	Port string
+	Role PortRole
 }
 
 // ATFlowStep represents a single step in a multi-step AT command flow.
+// Command, Body, ExpectedResponses and When may use ${name} for variables given to the flow or captured by earlier steps,
+// in the regexps the values match literally.
 type ATFlowStep struct {
+	Name              string // Lets OnSuccess and OnFailure of other steps jump here
 	Command           string
-	ExpectedResponses []string // All must be received before next step
+	Body              string            // Text for a > prompt, see ATCommandPayload.Body
+	ExpectedResponses []string          // Regexps, all must match a line of the answer or a URC before next step. Empty means the command must end with OK
+	FailOn            []string          // Regexps that fail the step when any line matches, empty means ERROR, +CME ERROR: and +CMS ERROR:
+	Timeout           time.Duration     // For each attempt, zero means the command's default
+	Retries           int               // Extra attempts when the step fails
+	RetryDelay        time.Duration     // Pause between attempts, zero means a second
+	Optional          bool              // A failure is recorded but the flow carries on
+	Capture           map[string]string // Variable name to a regexp matched against the answer, the first group or else the whole match is kept
+	When              string            // Run only if this holds, e.g. ${pin} == READY, ${op} != "", ${csq} =~ ^[12] or just ${var}
+	OnSuccess         string            // Step to go to when this one passes, "end" finishes the flow, empty means the next step
+	OnFailure         string            // Step to go to when this one fails, the failure no longer stops the flow
+}
+
+// ATFlow is the payload of EventATModemFlow, a plain []ATFlowStep works too
+type ATFlow struct {
+	ID     string // Identifies the flow in its ATFlowResult, one is made up when empty
+	Name   string
+	Steps  []ATFlowStep
+	Vars   map[string]string   // Starting values for ${name}
+	Result chan<- ATFlowResult `json:"-"` // Optional, also gets the ATFlowResult, should be buffered
+}
+
+// ATFlowStepResult is what happened to one step of a flow
+type ATFlowStepResult struct {
+	Name     string
+	Command  string // With the variables filled in
+	Attempts int
+	Skipped  bool     // When didn't hold
+	Result   ATResult // Answer to the last attempt
+	URCs     []string // URCs seen while the last attempt waited for its expected responses
+	Err      error    // Why the step failed, nil when it passed
+}
+
+// ATFlowProgress is the payload of EventATFlowStep, published as each step of a flow finishes
+type ATFlowProgress struct {
+	ID    string
+	Name  string
+	Index int // Position of the step in the flow, from 0
+	Total int // Number of steps in the flow
+	Step  ATFlowStepResult
+}
+
+// ATFlowResult is the payload of EventATFlowResult
+type ATFlowResult struct {
+	ID       string
+	Name     string
+	Steps    []ATFlowStepResult // In the order they ran, a step appears again each time a branch goes back to it
+	Vars     map[string]string  // Given and captured variables at the end of the flow
+	Err      error              // The failure that stopped the flow, nil if it ran to the end
+	Duration time.Duration
+}
+
+// OK reports whether the flow ran to the end
+func (r ATFlowResult) OK() bool {
+	return r.Err == nil
 }
 
 type HistoryItem struct {
@@ -48,6 +181,101 @@ type LayoutInterface interface {
 
 type LayoutMap map[string]LayoutInterface
 
+// ConnectionState is the state of the link to the modem
+type ConnectionState string
+
+const (
+	ConnectionConnected    ConnectionState = "connected"
+	ConnectionLost         ConnectionState = "lost"
+	ConnectionReconnecting ConnectionState = "reconnecting"
+	ConnectionReconnected  ConnectionState = "reconnected"
+)
+
+// ConnectionStatus is the payload of EventConnectionState
+type ConnectionStatus struct {
+	Port    string
+	Role    PortRole
+	State   ConnectionState
+	Attempt int   // Reconnect attempt number, 0 when not reconnecting
+	Err     error // Why the connection was lost, only set for ConnectionLost
+}
+
+// LineMode is the payload of EventLineModeChanged, the line settings now in effect on a port
+type LineMode struct {
+	Port string
+	Role PortRole
+	Mode string // Short form, e.g. 115200 8E1 RTS/CTS
+}
+
+// SignalSample is the payload of EventSignalUpdated, the last AT+CSQ reading with the LTE one of AT+CESQ
+type SignalSample struct {
+	CSQ  int     // 0-31, 99 when not known
+	BER  int     // Bit error rate 0-7, 99 when not known
+	RSSI int     // In dBm, 0 when not known
+	RSRP int     // In dBm, 0 when not known
+	RSRQ float64 // In dB, 0 when not known
+	Time time.Time
+}
+
+// GPSFix is the payload of EventGPSUpdated
+type GPSFix struct {
+	Fix        bool    // False while the receiver has no position, the rest is then the last one known
+	Latitude   float64 // Decimal degrees, negative is south
+	Longitude  float64 // Decimal degrees, negative is west
+	Altitude   float64 // Meters
+	Satellites int     // Only known from NMEA
+	UTC        string  // e.g. 12:34:56 UTC
+	Date       string
+	Time       time.Time // When the position was read
+}
+
+// TimeUpdate is the payload of EventUpdateTime, the time of a GPS fix
+type TimeUpdate struct {
+	UTC  string // e.g. 12:34:56 UTC
+	Date string
+	Time time.Time // When the fix was read
+}
+
+// Registration is the payload of EventRegistrationUpdated, from a +CREG, +CGREG, +CEREG or +C5GREG answer or URC
+type Registration struct {
+	Port       string
+	Domain     string // CREG, CGREG, CEREG or C5GREG
+	Stat       int    // <stat> of 27.007, e.g. 1 registered home, 5 roaming, 3 denied
+	Status     string // Stat in words
+	Registered bool   // Home or roaming, including SMS only and CSFB not preferred
+	Area       string // LAC or TAC in hex, empty when not reported
+	CellID     string // In hex, empty when not reported
+	AccessTech int    // <AcT>, -1 when not reported
+	Time       time.Time
+}
+
+// ModemLines is the payload of EventModemLines, the state of the control lines on a port
+type ModemLines struct {
+	Port string
+	Role PortRole
+	DTR  bool // Outputs, as we last set them
+	RTS  bool
+	CTS  bool // Inputs, as last read from the port
+	DSR  bool
+	RI   bool
+	DCD  bool
+}
+
+// ModemLineChange is the payload of EventRingIndicator and EventCarrierDetect
+type ModemLineChange struct {
+	Port string
+	Role PortRole
+	On   bool
+}
+
+// ModemLineRequest is the payload of EventSetModemLine
+type ModemLineRequest struct {
+	Line   string // dtr or rts
+	Action string // on, off or pulse
+	Pulse  time.Duration
+	Role   PortRole // Empty means the main AT port
+}
+
 // EventType defines the type of event
 type EventType string
 
@@ -60,6 +288,8 @@ const (
 	EventCommandSent     EventType = "command_sent"
 	EventATModemCommand  EventType = "atmodem_command"
 	EventATModemFlow     EventType = "atmodem_flow"
+	EventATFlowStep      EventType = "atmodem_flow_step"
+	EventATFlowResult    EventType = "atmodem_flow_result"
 	EventCommandHistory  EventType = "command_history"
 	EventInputSetCommand EventType = "input_set_command"
 	EventReplyReceived   EventType = "reply_received"
@@ -75,6 +305,22 @@ const (
 	EventStopGPS         EventType = "stop_gps"
 	EventStartGPS        EventType = "start_gps"
 	EventUpdateTime      EventType = "update_time"
+	EventConnectionState EventType = "connection_state"
+	EventChangeBaudRate  EventType = "change_baud_rate"
+	EventLineModeChanged EventType = "line_mode_changed"
+	EventATResult        EventType = "at_result"
+	EventURC             EventType = "urc"
+	EventATQueue         EventType = "at_queue"
+	EventCancelAT        EventType = "cancel_at"
+	EventPrompt          EventType = "prompt"
+	EventPromptReply     EventType = "prompt_reply"
+	EventSetModemLine    EventType = "set_modem_line"
+	EventModemLines      EventType = "modem_lines"
+	EventRingIndicator   EventType = "ring_indicator"
+	EventCarrierDetect   EventType = "carrier_detect"
+
+	// Published by ModemMonitor from the answers and URCs it understands
+	EventRegistrationUpdated EventType = "registration_updated"
 )
 
 // Event represents an event in the system
@@ -0,0 +1,296 @@
+package views
+
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// eventsKept is how many traced events the panel remembers
+const eventsKept = 2000
+
+// eventsRefresh is how often the panel redraws while events come in
+const eventsRefresh = 250 * time.Millisecond
+
+// EventsView traces every event published on the bus, for the /events panel. It taps the bus rather than
+// subscribing to the event types, so it sees new ones without being told about them.
+type EventsView struct {
+	view     *tview.TextView
+	eventBus *services.EventBus
+
+	lock       sync.Mutex
+	tap        *services.EventTap
+	stop       chan struct{}
+	entries    []eventEntry
+	paused     bool
+	filter     eventFilter
+	filterText string
+	changed    bool
+}
+
+// eventEntry is a traced event, the payload is summed up as it was when it was published
+type eventEntry struct {
+	trace   services.EventTrace
+	summary string
+}
+
+// eventFilter keeps the events mentioning any of include, unless they mention one of exclude
+type eventFilter struct {
+	include []string
+	exclude []string
+}
+
+func NewEventsView(app *tview.Application, eventBus *services.EventBus) *EventsView {
+	// Redrawn directly, an EventAppRedraw would be traced and redraw the panel again
+	eventsView := tview.NewTextView().SetDynamicColors(true).SetChangedFunc(func() { app.Draw() })
+	eventsView.SetTitle(" Events ").SetBorder(true)
+	eventsView.SetBackgroundColor(tcell.ColorBlack)
+	eventsView.SetScrollable(true)
+	eventsView.SetWrap(false)
+
+	eventsView.SetText("[yellow]Event tracing inactive[white]\n\nUse /events to start tracing")
+
+	return &EventsView{
+		view:     eventsView,
+		eventBus: eventBus,
+	}
+}
+
+func (e *EventsView) GetName() string {
+	return "events"
+}
+
+func (e *EventsView) GetComponent() tview.Primitive {
+	return e.view
+}
+
+// Start taps the bus, until Stop
+func (e *EventsView) Start() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.tap != nil {
+		return
+	}
+
+	e.tap = e.eventBus.Tap(e.handleTrace)
+	e.stop = make(chan struct{})
+	e.changed = true
+	go e.refresh(e.stop)
+}
+
+// Stop removes the tap, the events traced so far are kept
+func (e *EventsView) Stop() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.tap == nil {
+		return
+	}
+
+	e.tap.Remove()
+	close(e.stop)
+	e.tap = nil
+}
+
+// SetPaused stops taking new events in, so the trace holds still to be read, or takes them in again
+func (e *EventsView) SetPaused(paused bool) {
+	e.lock.Lock()
+	e.paused = paused
+	e.changed = true
+	e.lock.Unlock()
+	e.render()
+}
+
+// IsPaused returns whether new events are left out
+func (e *EventsView) IsPaused() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.paused
+}
+
+// SetFilter shows only the events whose type, publisher or payload mention one of the comma or space
+// separated terms, a term starting with - hides the events mentioning it instead. No terms shows them all.
+func (e *EventsView) SetFilter(text string) {
+	e.lock.Lock()
+	e.filterText = strings.TrimSpace(text)
+	e.filter = parseEventFilter(text)
+	e.changed = true
+	e.lock.Unlock()
+	e.render()
+}
+
+// Clear forgets the events traced so far
+func (e *EventsView) Clear() {
+	e.lock.Lock()
+	e.entries = nil
+	e.changed = true
+	e.lock.Unlock()
+	e.render()
+}
+
+// Export writes the events the panel shows to path as NDJSON, one EventRecord per line, and returns how many
+func (e *EventsView) Export(path string) (int, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(file)
+	entries := e.shown()
+	for _, entry := range entries {
+		if err := encoder.Encode(services.NewEventRecord(entry.trace)); err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+	return len(entries), file.Close()
+}
+
+// handleTrace keeps a traced event. It runs inside every Publish, so it only takes the event in.
+func (e *EventsView) handleTrace(trace services.EventTrace) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.paused {
+		return
+	}
+
+	e.entries = append(e.entries, eventEntry{trace: trace, summary: services.SummarizePayload(trace.Event.Payload)})
+	if len(e.entries) >= 2*eventsKept {
+		e.entries = append([]eventEntry(nil), e.entries[len(e.entries)-eventsKept:]...)
+	}
+	e.changed = true
+}
+
+// refresh redraws the panel while events come in, until stop is closed
+func (e *EventsView) refresh(stop chan struct{}) {
+	ticker := time.NewTicker(eventsRefresh)
+	defer ticker.Stop()
+
+	for {
+		e.render()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// shown returns the kept events that pass the filter, in the order they were published
+func (e *EventsView) shown() []eventEntry {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	entries := e.entries
+	if len(entries) > eventsKept {
+		entries = entries[len(entries)-eventsKept:]
+	}
+
+	shown := make([]eventEntry, 0, len(entries))
+	for _, entry := range entries {
+		if e.filter.matches(entry) {
+			shown = append(shown, entry)
+		}
+	}
+	sort.SliceStable(shown, func(i, j int) bool {
+		return shown[i].trace.Seq < shown[j].trace.Seq
+	})
+	return shown
+}
+
+func (e *EventsView) render() {
+	e.lock.Lock()
+	if !e.changed {
+		e.lock.Unlock()
+		return
+	}
+	e.changed = false
+	paused := e.paused
+	filterText := e.filterText
+	e.lock.Unlock()
+
+	entries := e.shown()
+
+	var text strings.Builder
+	for _, entry := range entries {
+		trace := entry.trace
+		fmt.Fprintf(&text, "[gray]%s[white] [yellow]%s[white] [gray]%s, %d handlers", trace.Time.Format("15:04:05.000"),
+			trace.Event.Type, tview.Escape(trace.Publisher), len(trace.Handlers))
+		if trace.Queued > 0 {
+			fmt.Fprintf(&text, " (%d queued)", trace.Queued)
+		}
+		fmt.Fprintf(&text, " in %s[white] %s\n", trace.Duration.Round(time.Microsecond), tview.Escape(entry.summary))
+
+		// Each handler on a line of its own below the event, the slow one stands out
+		for _, handler := range trace.Handlers {
+			took := handler.Duration.Round(time.Microsecond).String()
+			if handler.Queued {
+				took = "queued"
+			}
+			fmt.Fprintf(&text, "[gray]    %s %s[white]\n", tview.Escape(handler.Name), took)
+		}
+	}
+
+	title := fmt.Sprintf(" Events %d ", len(entries))
+	if filterText != "" {
+		title += fmt.Sprintf("- filter %s ", tview.Escape(filterText))
+	}
+	if paused {
+		title += "- paused "
+	}
+
+	e.view.SetTitle(title)
+	e.view.SetText(text.String())
+	if !paused {
+		e.view.ScrollToEnd()
+	}
+}
+
+func parseEventFilter(text string) eventFilter {
+	var filter eventFilter
+	terms := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	for _, term := range terms {
+		if excluded, ok := strings.CutPrefix(term, "-"); ok {
+			if excluded != "" {
+				filter.exclude = append(filter.exclude, excluded)
+			}
+		} else {
+			filter.include = append(filter.include, term)
+		}
+	}
+	return filter
+}
+
+func (f eventFilter) matches(entry eventEntry) bool {
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return true
+	}
+
+	text := strings.ToLower(string(entry.trace.Event.Type) + " " + entry.trace.Publisher + " " + entry.summary)
+	for _, term := range f.exclude {
+		if strings.Contains(text, term) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, term := range f.include {
+		if strings.Contains(text, term) {
+			return true
+		}
+	}
+	return false
+}
+
+var _ types.ViewInterface = (*EventsView)(nil)
@@ -4,9 +4,6 @@ import (
 	"atcli/src/services"
 	"atcli/src/types"
 	"fmt"
-	"regexp"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
@@ -25,6 +22,7 @@ type GPSView struct {
 	lastUpdated time.Time
 	utcTime     string // Store the last parsed UTC time from GPS
 	date        string // Store the last parsed date (YYYYMMDD)
+	nmeaPort    bool   // A dedicated NMEA port is open, parse its sentences instead of polling AT+CGPSINFO
 }
 
 func NewGPSView(title string, app *tview.Application, eventBus *services.EventBus) *GPSView {
@@ -55,8 +53,8 @@ func NewGPSView(title string, app *tview.Application, eventBus *services.EventBu
 	gpsView.SetScrollable(false)
 	gpsView.SetChangedFunc(self.SetChanged)
 
-	// Subscribe to modem responses, start and stop GPS events
-	eventBus.Subscribe(types.EventSerialResponse, self.handleModemResponse)
+	// Subscribe to fixes, start and stop GPS events
+	services.TopicGPSUpdated.SubscribeWith(eventBus, self.handleGPSUpdated, viewEvents)
 	eventBus.Subscribe(types.EventStopGPS, self.handleStopGPS)
 	eventBus.Subscribe(types.EventStartGPS, self.handleStartGPS)
 
@@ -66,6 +64,11 @@ func NewGPSView(title string, app *tview.Application, eventBus *services.EventBu
 	return self
 }
 
+// SetNMEAPort tells the view a separate NMEA port is open, so the AT port is left free for commands
+func (g *GPSView) SetNMEAPort(enabled bool) {
+	g.nmeaPort = enabled
+}
+
 func (g *GPSView) SetChanged() {
 	g.eventBus.Publish(types.Event{Type: types.EventAppRedraw})
 }
@@ -90,145 +93,25 @@ func (g *GPSView) monitorGPS() {
 	}
 }
 
-// queryGPS sends the AT+CGPSINFO command to query GPS information
+// queryGPS asks the modem for the current fix with AT+CGPSINFO, the monitor reads the answer
 func (g *GPSView) queryGPS() {
-	// Send AT+CGPSINFO command to the modem
-	g.eventBus.Publish(types.Event{
-		Type:    types.EventATModemCommand,
-		Payload: "AT+CGPSINFO",
-	})
+	services.SendAT(g.eventBus, types.ATCommandPayload{Command: "AT+CGPSINFO"})
 }
 
-// handleModemResponse processes responses from the modem
-func (g *GPSView) handleModemResponse(event types.Event) {
+// handleGPSUpdated shows a fix, from AT+CGPSINFO or the NMEA port
+func (g *GPSView) handleGPSUpdated(fix types.GPSFix) {
 	if g.stopped {
 		return
 	}
 
-	if response, ok := event.Payload.(string); ok {
-		// Skip the command echo (lines starting with "->")
-		if strings.HasPrefix(response, "-> ") {
-			return
-		}
-
-		// Check if this is a GPS response
-		if strings.Contains(response, "+CGPSINFO:") {
-			services.LogMessage(response)
-			g.parseGPSResponse(response)
-		}
-	}
-}
-
-// parseGPSResponse extracts the GPS information from the response
-func (g *GPSView) parseGPSResponse(response string) {
-	// Extract GPS coordinates using regex
-	// Format: +CGPSINFO: <lat>,<N/S>,<lon>,<E/W>,<date>,<UTC time>,<alt>,<speed>,<course>
-	re := regexp.MustCompile(`\+CGPSINFO:\s*([^,]*),([^,]*),([^,]*),([^,]*),([^,]*),([^,]*),([^,]*),([^,]*),([^,]*)`)
-	matches := re.FindStringSubmatch(response)
-
-	if len(matches) >= 10 {
-		// Check if GPS data is available
-		if matches[1] == "" || matches[3] == "" {
-			g.updateGPSDisplay(false)
-			return
-		}
-
-		// Parse latitude (format: ddmm.mmmm)
-		latStr := matches[1]
-		latDir := matches[2]
-		lat, err := g.parseCoordinate(latStr)
-		if err == nil {
-			if latDir == "S" {
-				lat = -lat
-			}
-			g.latitude = lat
-		}
-
-		// Parse longitude (format: dddmm.mmmm)
-		lonStr := matches[3]
-		lonDir := matches[4]
-		lon, err := g.parseCoordinate(lonStr)
-		if err == nil {
-			if lonDir == "W" {
-				lon = -lon
-			}
-			g.longitude = lon
-		}
-		// Parse date (format: DDMMYY)
-		dateStr := matches[5]
-		if len(dateStr) == 6 {
-			g.date = fmt.Sprintf("%s-%s-%s", dateStr[0:2], dateStr[2:4], dateStr[4:6])
-		} else {
-			g.date = "N/A"
-		}
-
-		// Parse UTC time (format: hhmmss.ss as float)
-		utcTimeStr := matches[6]
-		utcTimeFloat, err := strconv.ParseFloat(utcTimeStr, 64)
-		var utcTimeFormatted string
-		if err == nil {
-			utcInt := int(utcTimeFloat)
-			hh := utcInt / 10000
-			mm := (utcInt / 100) % 100
-			ss := utcInt % 100
-			utcTimeFormatted = fmt.Sprintf("%02d:%02d:%02d UTC", hh, mm, ss)
-		} else {
-			utcTimeFormatted = "N/A"
-		}
-		g.utcTime = utcTimeFormatted
-
-		// Parse altitude (meters)
-		altStr := matches[7]
-		alt, err := strconv.ParseFloat(altStr, 64)
-		if err == nil {
-			g.altitude = alt
-		}
-
-		g.lastUpdated = time.Now()
-		g.updateGPSDisplay(true)
-	} else {
-		g.updateGPSDisplay(false)
-	}
-}
-
-// parseCoordinate converts NMEA format (ddmm.mmmm) to decimal degrees
-func (g *GPSView) parseCoordinate(coord string) (float64, error) {
-	if coord == "" {
-		return 0, fmt.Errorf("empty coordinate")
-	}
-
-	// Find the decimal point position
-	decimalPos := strings.Index(coord, ".")
-	if decimalPos < 0 {
-		return 0, fmt.Errorf("invalid coordinate format")
-	}
-
-	// For latitude: first 2 digits are degrees, rest is minutes
-	// For longitude: first 3 digits are degrees, rest is minutes
-	var degreeEndPos int
-	if len(coord) >= 5 && decimalPos >= 3 { // Longitude (dddmm.mmmm)
-		degreeEndPos = decimalPos - 2
-	} else { // Latitude (ddmm.mmmm)
-		degreeEndPos = decimalPos - 2
-	}
-
-	if degreeEndPos <= 0 {
-		return 0, fmt.Errorf("invalid coordinate format")
-	}
-
-	// Extract degrees and minutes
-	degrees, err := strconv.ParseFloat(coord[:degreeEndPos], 64)
-	if err != nil {
-		return 0, err
-	}
-
-	minutes, err := strconv.ParseFloat(coord[degreeEndPos:], 64)
-	if err != nil {
-		return 0, err
-	}
-
-	// Convert to decimal degrees
-	return degrees + (minutes / 60.0), nil
+	g.latitude = fix.Latitude
+	g.longitude = fix.Longitude
+	g.altitude = fix.Altitude
+	g.satellites = fix.Satellites
+	g.utcTime = fix.UTC
+	g.date = fix.Date
+	g.lastUpdated = fix.Time
+	g.updateGPSDisplay(fix.Fix)
 }
 
 // updateGPSDisplay updates the GPS display
@@ -272,6 +155,9 @@ func (g *GPSView) updateGPSDisplay(hasData bool) {
 		if g.altitude != 0 {
 			altitudeInfo = fmt.Sprintf("\n\n[green]Altitude:[white] %.1f meters", g.altitude)
 		}
+		if g.satellites > 0 {
+			altitudeInfo += fmt.Sprintf("\n[green]Satellites:[white] %d", g.satellites)
+		}
 
 		// Google Maps link
 		mapsLink := fmt.Sprintf("\n\n[blue]Google Maps:[white]\nhttps://maps.google.com/?q=%.6f,%.6f", g.latitude, g.longitude)
@@ -294,23 +180,6 @@ func (g *GPSView) updateGPSDisplay(hasData bool) {
 
 	// Update the text view
 	g.gpsView.SetText(displayText)
-
-	// Publish an event to indicate the GPS has been updated
-	g.eventBus.Publish(types.Event{
-		Type: types.EventGPSUpdated,
-	})
-
-	// Emit EventUpdateTime for status bar with UTC time, date, and last update
-	if g.utcTime != "" && g.utcTime != "N/A" {
-		g.eventBus.Publish(types.Event{
-			Type: types.EventUpdateTime,
-			Payload: map[string]interface{}{
-				"utc":         g.utcTime,
-				"date":        g.date,
-				"lastUpdated": g.lastUpdated,
-			},
-		})
-	}
 }
 
 func (g *GPSView) GetName() string {
@@ -336,7 +205,7 @@ func (g *GPSView) Start() {
 	// GPS initialization flow
 	initFlow := []types.ATFlowStep{
 		{Command: "AT+CGNSSPWR=0", ExpectedResponses: []string{"OK"}},
-		{Command: "AT+CGNSSPWR=1", ExpectedResponses: []string{"OK", "+CGNSSPWR: READY!"}},
+		{Command: "AT+CGNSSPWR=1", ExpectedResponses: []string{"OK", `\+CGNSSPWR: READY!`}},
 		{Command: "AT+CGNSSTST=1", ExpectedResponses: []string{"OK"}},
 		{Command: "AT+CGNSSPORTSWITCH=0,1", ExpectedResponses: []string{"OK"}},
 	}
@@ -350,8 +219,10 @@ func (g *GPSView) Start() {
 		// Set initial content
 		g.gpsView.SetText("[yellow]GPS monitoring active[white]\n\nWaiting for GPS data...")
 	}
-	// Start the GPS monitoring loop
-	go g.monitorGPS()
+	// With a dedicated NMEA port the fixes stream in on their own, only poll over AT without one
+	if !g.nmeaPort {
+		go g.monitorGPS()
+	}
 }
 
 // Stop stops the GPS monitoring
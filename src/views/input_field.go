@@ -3,6 +3,8 @@ package views
 import (
 	"atcli/src/services"
 	"atcli/src/types"
+	"fmt"
+	"strings"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -11,6 +13,11 @@ import (
 type InputField struct {
 	eventBus   *services.EventBus
 	inputField *tview.InputField
+	label      string
+
+	// While a > prompt is open the input collects the text for it instead of commands
+	prompt      *types.Prompt
+	promptLines []string
 }
 
 func NewInputField(eventBus *services.EventBus, label string, color tcell.Color) *InputField {
@@ -19,6 +26,7 @@ func NewInputField(eventBus *services.EventBus, label string, color tcell.Color)
 	self := &InputField{
 		eventBus:   eventBus,
 		inputField: inputField,
+		label:      label,
 	}
 
 	inputField.SetBackgroundColor(color)
@@ -27,6 +35,8 @@ func NewInputField(eventBus *services.EventBus, label string, color tcell.Color)
 
 	eventBus.Subscribe(types.EventFocusInput, self.handleFocusInput)
 	eventBus.Subscribe(types.EventInputSetCommand, self.handleSetCommand)
+	services.TopicPrompt.SubscribeWith(eventBus, self.handlePrompt, viewEvents)
+	eventBus.SubscribeWith(types.EventATResult, self.handleATResult, viewEvents)
 
 	return self
 }
@@ -48,6 +58,13 @@ func (i *InputField) SetDoneFunc(key tcell.Key) {
 	userInput := i.inputField.GetText()
 	i.inputField.SetText("")
 
+	// At a prompt Enter starts the next line of the text, Ctrl-Z sends it
+	if i.prompt != nil {
+		i.promptLines = append(i.promptLines, userInput)
+		i.setPromptLabel()
+		return
+	}
+
 	if userInput == "" {
 		return
 	}
@@ -58,8 +75,22 @@ func (i *InputField) SetDoneFunc(key tcell.Key) {
 	})
 }
 
-// Handle up/down keys for command history
+// Handle up/down keys for command history, and Ctrl-Z/Esc at a prompt
 func (i *InputField) SetInputCapture(event *tcell.EventKey) *tcell.EventKey {
+	if i.prompt != nil {
+		switch event.Key() {
+		case tcell.KeyCtrlZ:
+			i.answerPrompt(false)
+			return nil
+		case tcell.KeyEscape:
+			i.answerPrompt(true)
+			return nil
+		case tcell.KeyUp, tcell.KeyDown:
+			return nil
+		}
+		return event
+	}
+
 	switch event.Key() {
 	case tcell.KeyUp:
 		i.eventBus.Publish(types.Event{Type: types.EventCommandHistory, Payload: -1})
@@ -86,4 +117,53 @@ func (i *InputField) handleSetCommand(event types.Event) {
 	}
 }
 
+// handlePrompt switches the input to collecting the text for a > prompt, e.g. the body of an SMS
+func (i *InputField) handlePrompt(prompt types.Prompt) {
+	i.prompt = &prompt
+	i.promptLines = nil
+	i.inputField.SetPlaceholder("Enter for a new line, Ctrl-Z to send, Esc to abort")
+	i.setPromptLabel()
+	i.handleFocusInput(types.Event{Type: types.EventFocusInput})
+}
+
+// handleATResult leaves prompt mode once the command that opened it finished, e.g. it timed out or was cancelled
+func (i *InputField) handleATResult(event types.Event) {
+	result, ok := event.Payload.(types.ATResult)
+	if !ok || i.prompt == nil || result.ID != i.prompt.ID {
+		return
+	}
+	i.closePrompt()
+}
+
+// answerPrompt sends the collected lines and what is still in the field, or aborts the prompt
+func (i *InputField) answerPrompt(abort bool) {
+	lines := i.promptLines
+	if text := i.inputField.GetText(); text != "" || len(lines) == 0 {
+		lines = append(lines, text)
+	}
+
+	i.eventBus.Publish(types.Event{
+		Type:    types.EventPromptReply,
+		Payload: types.PromptReply{Role: i.prompt.Role, Text: strings.Join(lines, "\n"), Abort: abort},
+	})
+	i.closePrompt()
+}
+
+func (i *InputField) closePrompt() {
+	i.prompt = nil
+	i.promptLines = nil
+	i.inputField.SetText("")
+	i.inputField.SetPlaceholder("")
+	i.inputField.SetLabel(i.label)
+}
+
+// setPromptLabel shows the prompt and how many lines were typed so far
+func (i *InputField) setPromptLabel() {
+	if len(i.promptLines) == 0 {
+		i.inputField.SetLabel("> ")
+		return
+	}
+	i.inputField.SetLabel(fmt.Sprintf("> (%d) ", len(i.promptLines)+1))
+}
+
 var _ types.ViewInterface = (*InputField)(nil)
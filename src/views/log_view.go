@@ -34,7 +34,7 @@ func NewLogView(app *tview.Application, eventBus *services.EventBus) *LogView {
 	}
 
 	// Subscribe to log messages
-	eventBus.Subscribe(types.EventLogMessage, view.handleLogMessage)
+	eventBus.SubscribeWith(types.EventLogMessage, view.handleLogMessage, viewEvents)
 
 	return view
 }
@@ -0,0 +1,51 @@
+package views
+
+import (
+	"atcli/src/services"
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// PickPort shows a list of probed ports and returns the one the user chose.
+// It runs its own short lived application so it can be shown before the main layouts exist.
+func PickPort(candidates []services.PortCandidate) (string, error) {
+	app := tview.NewApplication()
+	selected := ""
+
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).
+		SetTitle(" Select the modem AT port (Esc to cancel) ").
+		SetBackgroundColor(tcell.ColorBlack)
+
+	for i, candidate := range candidates {
+		name := candidate.Name
+		shortcut := rune(0)
+		if i < 9 {
+			shortcut = rune('1' + i)
+		}
+		list.AddItem(tview.Escape(candidate.Describe()), "", shortcut, func() {
+			selected = name
+			app.Stop()
+		})
+	}
+
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			app.Stop()
+			return nil
+		}
+		return event
+	})
+
+	if err := app.SetRoot(list, true).Run(); err != nil {
+		return "", err
+	}
+
+	if selected == "" {
+		return "", fmt.Errorf("no port selected")
+	}
+
+	return selected, nil
+}
@@ -5,6 +5,7 @@ import (
 	"atcli/src/types"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -31,8 +32,11 @@ func NewReplyView(eventBus *services.EventBus, app *tview.Application, title str
 
 	replyView.SetInputCapture(self.SetInputCapture)
 
-	eventBus.Subscribe(types.EventSerialError, self.SerialError)
-	eventBus.Subscribe(types.EventSerialResponse, self.SerialResponse)
+	services.TopicSerialError.SubscribeWith(eventBus, self.SerialError, viewEvents)
+	services.TopicSerialResponse.SubscribeWith(eventBus, self.SerialResponse, viewEvents)
+	eventBus.SubscribeWith(types.EventATResult, self.ATResult, viewEvents)
+	eventBus.SubscribeWith(types.EventATFlowStep, self.FlowStep, viewEvents)
+	eventBus.SubscribeWith(types.EventATFlowResult, self.FlowResult, viewEvents)
 
 	return self
 }
@@ -72,15 +76,78 @@ func (r *ReplyView) Append(text string) {
 	r.replyLineNum++
 }
 
-func (r *ReplyView) SerialError(event types.Event) {
-	r.Append("[red]Serial read error: " + event.Payload.(error).Error() + "\n")
+func (r *ReplyView) SerialError(err error) {
+	r.Append("[red]Serial read error: " + err.Error() + "\n")
 }
 
-func (r *ReplyView) SerialResponse(event types.Event) {
-	clean := strings.TrimRight(event.Payload.(string), "\r\n")
+// ATResult shows a command that timed out or was cancelled, port errors arrive through SerialError
+func (r *ReplyView) ATResult(event types.Event) {
+	result, ok := event.Payload.(types.ATResult)
+	if !ok || result.Err == nil || services.IsPortError(result.Err) {
+		return
+	}
+	r.Append("[red]" + tview.Escape(result.Err.Error()) + "[white]\n")
+}
+
+func (r *ReplyView) SerialResponse(line types.SerialLine) {
+	// NMEA sentences arrive several times a second, they belong in the GPS view
+	if line.Role == types.RoleNMEA {
+		return
+	}
+
+	clean := strings.TrimRight(line.Text, "\r\n")
 	if clean != "" {
-		r.Append("[" + fmt.Sprint(r.replyLineNum) + "] <- " + clean + "\n")
+		source := ""
+		if line.Role != types.RoleAT {
+			source = "[gray](" + string(line.Role) + ")[white] "
+		}
+		r.Append("[" + fmt.Sprint(r.replyLineNum) + "] <- " + source + clean + "\n")
+	}
+}
+
+// FlowStep shows the progress of a flow as each step finishes
+func (r *ReplyView) FlowStep(event types.Event) {
+	progress, ok := event.Payload.(types.ATFlowProgress)
+	if !ok {
+		return
+	}
+
+	step := progress.Step
+	label := fmt.Sprintf("[yellow][%s %d/%d][white] ", tview.Escape(flowName(progress.Name, progress.ID)), progress.Index+1, progress.Total)
+	switch {
+	case step.Skipped:
+		r.Append(label + "[gray]skipped[white]\n")
+	case step.Err != nil:
+		r.Append(label + tview.Escape(step.Command) + " [red]failed: " + tview.Escape(step.Err.Error()) + "[white]\n")
+	default:
+		attempts := ""
+		if step.Attempts > 1 {
+			attempts = fmt.Sprintf(" after %d attempts", step.Attempts)
+		}
+		r.Append(label + tview.Escape(step.Command) + " [green]ok[white]" + attempts + "\n")
+	}
+}
+
+// FlowResult shows how a flow ended
+func (r *ReplyView) FlowResult(event types.Event) {
+	result, ok := event.Payload.(types.ATFlowResult)
+	if !ok {
+		return
+	}
+
+	name := tview.Escape(flowName(result.Name, result.ID))
+	if result.Err != nil {
+		r.Append("[red]Flow " + name + " failed: " + tview.Escape(result.Err.Error()) + "[white]\n")
+		return
+	}
+	r.Append(fmt.Sprintf("[green]Flow %s finished in %s[white]\n", name, result.Duration.Round(time.Millisecond)))
+}
+
+func flowName(name string, id string) string {
+	if name != "" {
+		return name
 	}
+	return id
 }
 
 var _ types.ViewInterface = (*ReplyView)(nil)
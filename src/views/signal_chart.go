@@ -4,9 +4,6 @@ import (
 	"atcli/src/services"
 	"atcli/src/types"
 	"fmt"
-	"regexp"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
@@ -45,10 +42,10 @@ func NewSignalChart(title string, app *tview.Application, eventBus *services.Eve
 	signalChartView.SetScrollable(false)
 	signalChartView.SetChangedFunc(self.SetChanged)
 
-	// Subscribe to modem responses, start and stop signal events
-	eventBus.Subscribe(types.EventSerialResponse, self.handleModemResponse)
+	// Subscribe to start and stop signal events
 	eventBus.Subscribe(types.EventStopSignal, self.handleStopSignal)
 	eventBus.Subscribe(types.EventStartSignal, self.handleStartSignal)
+	services.TopicSignalUpdated.SubscribeWith(eventBus, self.handleSignalUpdated, viewEvents)
 
 	// Set initial content
 	self.signalChartView.SetText("[yellow]Signal monitoring inactive[white]\n\nUse /signal to start monitoring")
@@ -80,47 +77,19 @@ func (s *SignalChart) monitorSignalStrength() {
 	}
 }
 
-// querySignalStrength sends the AT+CSQ command to query signal strength
+// querySignalStrength asks the modem for the signal strength with AT+CSQ, the monitor reads the answer
 func (s *SignalChart) querySignalStrength() {
-	// Send AT+CSQ command to the modem
-	s.eventBus.Publish(types.Event{
-		Type:    types.EventATModemCommand,
-		Payload: "AT+CSQ",
-	})
+	services.SendAT(s.eventBus, types.ATCommandPayload{Command: "AT+CSQ"})
 }
 
-// handleModemResponse processes responses from the modem
-func (s *SignalChart) handleModemResponse(event types.Event) {
+// handleSignalUpdated shows a reading, whoever asked for it
+func (s *SignalChart) handleSignalUpdated(sample types.SignalSample) {
 	if s.stopped {
 		return
 	}
 
-	if response, ok := event.Payload.(string); ok {
-		// Skip the command echo (lines starting with "->")
-		if strings.HasPrefix(response, "-> ") {
-			return
-		}
-
-		// Check if this is a CSQ response
-		if strings.Contains(response, "+CSQ:") {
-			s.parseCSQResponse(response)
-		}
-	}
-}
-
-// parseCSQResponse extracts the signal strength from the CSQ response
-func (s *SignalChart) parseCSQResponse(response string) {
-	// Extract CSQ value using regex
-	re := regexp.MustCompile(`\+CSQ:\s*(\d+),\s*(\d+)`)
-	matches := re.FindStringSubmatch(response)
-
-	if len(matches) >= 3 {
-		csq, err := strconv.Atoi(matches[1])
-		if err == nil {
-			s.signalCSQ = csq
-			s.updateSignalDisplay()
-		}
-	}
+	s.signalCSQ = sample.CSQ
+	s.updateSignalDisplay()
 }
 
 // updateSignalDisplay updates the signal strength display
@@ -192,11 +161,6 @@ func (s *SignalChart) updateSignalDisplay() {
 
 	// Update the text view
 	s.signalChartView.SetText(displayText)
-
-	// Publish an event to indicate the signal has been updated
-	s.eventBus.Publish(types.Event{
-		Type: types.EventSignalUpdated,
-	})
 }
 
 func (s *SignalChart) GetName() string {
@@ -20,7 +20,11 @@ type StatusBar struct {
 	lastDate    string
 	lastUpdated time.Time
 	portName    string
-	baudRate    int
+	lineMode    string
+	lines       *types.ModemLines // nil until the port reports its control lines
+	queue       types.ATQueueStatus
+	connState   types.ConnectionState
+	attempt     int
 }
 
 func NewStatusBar(eventBus *services.EventBus) *StatusBar {
@@ -45,30 +49,57 @@ func NewStatusBar(eventBus *services.EventBus) *StatusBar {
 		eventBus:  eventBus,
 	}
 
-	s.eventBus.Subscribe(types.EventUpdateTime, s.handleUpdateTime)
+	services.TopicUpdateTime.SubscribeWith(s.eventBus, s.handleUpdateTime, viewEvents)
+	s.eventBus.SubscribeWith(types.EventConnectionState, s.handleConnectionState, viewEvents)
+	s.eventBus.SubscribeWith(types.EventLineModeChanged, s.handleLineModeChanged, viewEvents)
+	s.eventBus.SubscribeWith(types.EventModemLines, s.handleModemLines, viewEvents)
+	s.eventBus.SubscribeWith(types.EventATQueue, s.handleATQueue, viewEvents)
 	go s.refreshTimer()
 
 	return s
 }
 
-func (s *StatusBar) handleUpdateTime(event types.Event) {
-	data, ok := event.Payload.(map[string]interface{})
-	if !ok {
+func (s *StatusBar) handleUpdateTime(update types.TimeUpdate) {
+	s.lastUTCTime = update.UTC
+	s.lastDate = update.Date
+	s.lastUpdated = update.Time
+	s.updateText()
+}
+
+func (s *StatusBar) handleLineModeChanged(event types.Event) {
+	lineMode, ok := event.Payload.(types.LineMode)
+	if !ok || lineMode.Role != types.RoleAT {
+		return
+	}
+	s.SetLineMode(lineMode.Mode)
+}
+
+func (s *StatusBar) handleModemLines(event types.Event) {
+	lines, ok := event.Payload.(types.ModemLines)
+	if !ok || lines.Role != types.RoleAT {
 		return
 	}
-	utc, ok := data["utc"].(string)
-	if !ok {
+	s.lines = &lines
+	s.setStatus()
+}
+
+func (s *StatusBar) handleATQueue(event types.Event) {
+	queue, ok := event.Payload.(types.ATQueueStatus)
+	if !ok || queue.Role != types.RoleAT {
 		return
 	}
-	date, _ := data["date"].(string)
-	lastUpdated, ok := data["lastUpdated"].(time.Time)
-	if !ok {
+	s.queue = queue
+	s.setStatus()
+}
+
+func (s *StatusBar) handleConnectionState(event types.Event) {
+	status, ok := event.Payload.(types.ConnectionStatus)
+	if !ok || status.Role != types.RoleAT {
 		return
 	}
-	s.lastUTCTime = utc
-	s.lastDate = date
-	s.lastUpdated = lastUpdated
-	s.updateText()
+	s.connState = status.State
+	s.attempt = status.Attempt
+	s.setStatus()
 }
 
 func (s *StatusBar) refreshTimer() {
@@ -80,8 +111,7 @@ func (s *StatusBar) refreshTimer() {
 
 func (s *StatusBar) updateText() {
 	// Left: connection info
-	left := fmt.Sprintf("[green]Connected to:[white] %s [green]Baud rate:[white] %d", s.portName, s.baudRate)
-	s.leftView.SetText(left)
+	s.setStatus()
 
 	// Right: time/date info
 	right := ""
@@ -101,8 +131,9 @@ func (s *StatusBar) SetPortName(portName string) {
 	s.setStatus()
 }
 
-func (s *StatusBar) SetBaudRate(baudRate int) {
-	s.baudRate = baudRate
+// SetLineMode shows the effective line settings, e.g. 115200 8E1 RTS/CTS
+func (s *StatusBar) SetLineMode(lineMode string) {
+	s.lineMode = lineMode
 	s.setStatus()
 }
 
@@ -115,7 +146,61 @@ func (s *StatusBar) GetComponent() tview.Primitive {
 }
 
 func (s *StatusBar) setStatus() {
-	s.leftView.SetText(fmt.Sprintf("[green]Connected to:[white] %s [green]Baud rate:[white] %d", s.portName, s.baudRate))
+	s.leftView.SetText(fmt.Sprintf("%s[white] %s [green]Mode:[white] %s%s%s", s.connectionLabel(), s.portName, s.lineMode, s.linesLabel(), s.queueLabel()))
+}
+
+// queueLabel shows how many commands wait behind the one in flight, nothing while the port is idle
+func (s *StatusBar) queueLabel() string {
+	if s.queue.Depth == 0 && s.queue.InFlight == "" {
+		return ""
+	}
+
+	label := fmt.Sprintf(" [green]Queue:[white] %d", s.queue.Depth)
+	if s.queue.InFlight != "" {
+		label += fmt.Sprintf(" [gray](%s)[white]", tview.Escape(s.queue.InFlight))
+	}
+	return label
+}
+
+// linesLabel shows the control lines, bright when asserted and grey when not
+func (s *StatusBar) linesLabel() string {
+	if s.lines == nil {
+		return ""
+	}
+
+	label := " [green]Lines:"
+	for _, line := range []struct {
+		name string
+		on   bool
+	}{
+		{"DTR", s.lines.DTR},
+		{"RTS", s.lines.RTS},
+		{"CTS", s.lines.CTS},
+		{"DSR", s.lines.DSR},
+		{"RI", s.lines.RI},
+		{"DCD", s.lines.DCD},
+	} {
+		if line.on {
+			label += " [white]" + line.name
+		} else {
+			label += " [gray]" + line.name
+		}
+	}
+	return label + "[white]"
+}
+
+// connectionLabel describes the connection state in front of the port name
+func (s *StatusBar) connectionLabel() string {
+	switch s.connState {
+	case types.ConnectionLost:
+		return "[red]Connection lost:"
+	case types.ConnectionReconnecting:
+		return fmt.Sprintf("[yellow]Reconnecting (attempt %d):", s.attempt)
+	case types.ConnectionReconnected:
+		return "[green]Reconnected to:"
+	default:
+		return "[green]Connected to:"
+	}
 }
 
 var _ types.ViewInterface = (*StatusBar)(nil)
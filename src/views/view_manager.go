@@ -1,6 +1,13 @@
 package views
 
-import "atcli/src/types"
+import (
+	"atcli/src/services"
+	"atcli/src/types"
+)
+
+// viewEvents is how the views subscribe to what the ports publish. Drawing waits for the UI, queued it doesn't
+// hold up the serial reader, and a view that falls far behind loses its oldest events rather than stalling it.
+var viewEvents = services.SubscribeOptions{Queue: 1024, Overflow: services.OverflowDropOldest}
 
 type ViewManager struct {
 	viewRegistry types.ViewMap